@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	// maxCBORDepth bounds the nesting of CBOR payloads, which come from
+	// untrusted devices
+	maxCBORDepth = 32
+	// cborBreak ends the items of indefinite length
+	cborBreak = 0xff
+)
+
+// decodeCBOR decodes the CBOR payload into the values encoding/json decodes
+// into, so the same paths find values in both. Numbers become float64,
+// text strings string, arrays []interface{}, maps map[string]interface{}
+// with integer keys in decimal, and null and undefined nil. Byte strings
+// are kept as []byte and tags are dropped. The payload must hold exactly
+// one item.
+func decodeCBOR(payload []byte) (interface{}, error) {
+	d := cborDecoder{data: payload}
+	value, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("cbor: %d bytes after the item", len(d.data)-d.pos)
+	}
+	return value, nil
+}
+
+// cborDecoder reads CBOR items from data, starting at pos
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads the initial byte of an item and its argument. indefinite is
+// set for the items of indefinite length.
+func (d *cborDecoder) head() (major byte, arg uint64, indefinite bool, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, false, fmt.Errorf("cbor: unexpected end of payload")
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info == 31:
+		return major, 0, true, nil
+	case info > 27:
+		return 0, 0, false, fmt.Errorf("cbor: reserved additional information %d", info)
+	}
+	size := 1 << (info - 24)
+	if len(d.data)-d.pos < size {
+		return 0, 0, false, fmt.Errorf("cbor: unexpected end of payload")
+	}
+	b := d.data[d.pos : d.pos+size]
+	d.pos += size
+	switch size {
+	case 1:
+		arg = uint64(b[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(b))
+	default:
+		arg = binary.BigEndian.Uint64(b)
+	}
+	return major, arg, false, nil
+}
+
+// item reads the next item, nested depth levels deep
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("cbor: nested more than %d levels", maxCBORDepth)
+	}
+	start := d.pos
+	major, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return float64(arg), nil
+	case 1:
+		return -1 - float64(arg), nil
+	case 2, 3:
+		b, err := d.bytes(major, arg, indefinite)
+		if err != nil || major == 2 {
+			return b, err
+		}
+		return string(b), nil
+	case 4:
+		// Every item takes a byte, so a longer count is corrupt
+		if !indefinite && arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("cbor: array of %d items exceeds the payload", arg)
+		}
+		var array []interface{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.more() {
+				break
+			}
+			value, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		if array == nil {
+			array = []interface{}{}
+		}
+		return array, nil
+	case 5:
+		if !indefinite && arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, fmt.Errorf("cbor: map of %d pairs exceeds the payload", arg)
+		}
+		m := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.more() {
+				break
+			}
+			key, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case string:
+				m[key] = value
+			case float64:
+				m[strconv.FormatFloat(key, 'f', -1, 64)] = value
+			default:
+				return nil, fmt.Errorf("cbor: map key of type %T", key)
+			}
+		}
+		return m, nil
+	case 6:
+		if indefinite {
+			return nil, fmt.Errorf("cbor: tag of indefinite length")
+		}
+		return d.item(depth + 1)
+	}
+
+	// Major type 7 holds the simple values and floats
+	info := d.data[start] & 0x1f
+	switch {
+	case indefinite:
+		return nil, fmt.Errorf("cbor: unexpected break")
+	case info == 20:
+		return false, nil
+	case info == 21:
+		return true, nil
+	case info == 22 || info == 23:
+		return nil, nil
+	case info == 25:
+		return halfFloat(uint16(arg)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// more reads the break ending the items of indefinite length, and reports
+// whether it was there
+func (d *cborDecoder) more() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// bytes reads the content of a byte or text string of major type major and
+// length arg, or of the chunks of an indefinite length string
+func (d *cborDecoder) bytes(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("cbor: string of %d bytes exceeds the payload", arg)
+		}
+		b := d.data[d.pos : d.pos+int(arg)]
+		d.pos += int(arg)
+		return b, nil
+	}
+	var b []byte
+	for !d.more() {
+		chunkmajor, chunklen, chunkindefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkmajor != major || chunkindefinite {
+			return nil, fmt.Errorf("cbor: invalid chunk of an indefinite length string")
+		}
+		chunk, err := d.bytes(major, chunklen, false)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+	return b, nil
+}
+
+// halfFloat converts the IEEE 754 half precision float h
+func halfFloat(h uint16) float64 {
+	exponent := int(h>>10) & 0x1f
+	mantissa := float64(h & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		value = math.Inf(1)
+		if mantissa != 0 {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
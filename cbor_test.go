@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cborTests are payloads with the value they decode to, or with an error
+// containing err. They seed FuzzDecodeCBOR.
+var cborTests = []struct {
+	name    string
+	payload []byte
+	want    interface{}
+	err     string
+}{
+	{name: "integer", payload: []byte{0x18, 0x64}, want: 100.0},
+	{name: "negative integer", payload: []byte{0x38, 0x63}, want: -100.0},
+	{name: "half float", payload: []byte{0xf9, 0x3c, 0x00}, want: 1.0},
+	{name: "negative half float", payload: []byte{0xf9, 0xc4, 0x00}, want: -4.0},
+	{name: "largest half float", payload: []byte{0xf9, 0x7b, 0xff}, want: 65504.0},
+	{name: "subnormal half float", payload: []byte{0xf9, 0x00, 0x01}, want: math.Ldexp(1, -24)},
+	{name: "infinite half float", payload: []byte{0xf9, 0x7c, 0x00}, want: math.Inf(1)},
+	{name: "single float", payload: []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, want: 100000.0},
+	{name: "double float", payload: []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}, want: 1.1},
+	{name: "text", payload: []byte{0x62, 'h', 'i'}, want: "hi"},
+	{name: "indefinite text", payload: []byte{0x7f, 0x62, 'h', 'i', 0x61, '!', 0xff}, want: "hi!"},
+	{name: "indefinite bytes", payload: []byte{0x5f, 0x41, 0x01, 0x42, 0x02, 0x03, 0xff}, want: []byte{1, 2, 3}},
+	{name: "indefinite array", payload: []byte{0x9f, 0x01, 0xf9, 0x3e, 0x00, 0xff}, want: []interface{}{1.0, 1.5}},
+	{name: "empty indefinite array", payload: []byte{0x9f, 0xff}, want: []interface{}{}},
+	{name: "indefinite map", payload: []byte{0xbf, 0x61, 't', 0x0a, 0x01, 0xf5, 0xff}, want: map[string]interface{}{"t": 10.0, "1": true}},
+	{
+		name:    "nested",
+		payload: []byte{0xa1, 0x61, 'a', 0x82, 0xf6, 0xc1, 0xa1, 0x61, 'b', 0x9f, 0x02, 0xff},
+		want:    map[string]interface{}{"a": []interface{}{nil, map[string]interface{}{"b": []interface{}{2.0}}}},
+	},
+	{name: "deepest nesting", payload: append(bytes.Repeat([]byte{0x81}, maxCBORDepth), 0x00), want: nestedCBOR(maxCBORDepth)},
+	{name: "too deep nesting", payload: append(bytes.Repeat([]byte{0x81}, maxCBORDepth+1), 0x00), err: "nested more than"},
+	{name: "too deep indefinite nesting", payload: bytes.Repeat([]byte{0x9f}, maxCBORDepth+2), err: "nested more than"},
+	{name: "array longer than the payload", payload: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: "exceeds the payload"},
+	{name: "map longer than the payload", payload: []byte{0xba, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01}, err: "exceeds the payload"},
+	{name: "string longer than the payload", payload: []byte{0x7b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: "exceeds the payload"},
+	{name: "unterminated indefinite array", payload: []byte{0x9f, 0x01}, err: "unexpected end"},
+	{name: "nested indefinite chunk", payload: []byte{0x7f, 0x7f, 0xff, 0xff}, err: "invalid chunk"},
+	{name: "break in an array", payload: []byte{0x82, 0x01, 0xff}, err: "unexpected break"},
+	{name: "array map key", payload: []byte{0xa1, 0x80, 0x01}, err: "map key"},
+	{name: "trailing bytes", payload: []byte{0x01, 0x02}, err: "after the item"},
+	{name: "reserved information", payload: []byte{0x1c}, err: "reserved"},
+	{name: "empty", payload: nil, err: "unexpected end"},
+}
+
+// nestedCBOR returns 0 nested in depth single item arrays
+func nestedCBOR(depth int) interface{} {
+	var value interface{} = 0.0
+	for i := 0; i < depth; i++ {
+		value = []interface{}{value}
+	}
+	return value
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	for _, test := range cborTests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := decodeCBOR(test.payload)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %v, error %v, want an error containing %q", value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, test.want) {
+				t.Errorf("got %#v, want %#v", value, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORHalfFloatNaN(t *testing.T) {
+	value, err := decodeCBOR([]byte{0xf9, 0x7e, 0x00})
+	if f, ok := value.(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Errorf("got %v, %v, want NaN", value, err)
+	}
+}
+
+// cborShape returns the number of items in value and how deeply they nest
+func cborShape(value interface{}) (items, depth int) {
+	var children []interface{}
+	switch value := value.(type) {
+	case []interface{}:
+		children = value
+	case map[string]interface{}:
+		for _, child := range value {
+			children = append(children, child)
+		}
+	case []byte:
+		return len(value), 0
+	case string:
+		return len(value), 0
+	}
+	items = 1
+	for _, child := range children {
+		n, d := cborShape(child)
+		items += n
+		if d+1 > depth {
+			depth = d + 1
+		}
+	}
+	return items, depth
+}
+
+// FuzzDecodeCBOR checks that decodeCBOR returns an error rather than
+// panicking on any payload, and that what it decodes stays within the
+// depth limit and is no larger than the payload
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, test := range cborTests {
+		f.Add(test.payload)
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		value, err := decodeCBOR(payload)
+		if err != nil {
+			if value != nil {
+				t.Errorf("got %v with error %v", value, err)
+			}
+			return
+		}
+		items, depth := cborShape(value)
+		if depth > maxCBORDepth {
+			t.Errorf("decoded %d levels of nesting, more than %d", depth, maxCBORDepth)
+		}
+		// Every item and every byte of a string takes at least a byte
+		if items > len(payload) {
+			t.Errorf("decoded %d items and string bytes from %d bytes", items, len(payload))
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// defaultCheckTimeout bounds how long the check subcommand waits on the
+	// health endpoint or the MQTT server
+	defaultCheckTimeout = 2 * time.Second
+)
+
+// checkCommand is the check subcommand, which exits with 0 if the service
+// is healthy and 1 otherwise, for container healthchecks
+var checkCommand = cli.Command{
+	Name:   "check",
+	Usage:  "Check the health of the local service through its health endpoint, or if there is none, by connecting to the MQTT server",
+	Action: check,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:   "timeout",
+			Value:  defaultCheckTimeout,
+			Usage:  "Time to wait on the health endpoint or the MQTT server before failing",
+			EnvVar: "CHECK_TIMEOUT",
+		},
+	},
+}
+
+// check implements the check subcommand. The service options are the
+// global flags, which the config file fills in as for the service itself.
+func check(ctx *cli.Context) error {
+	global := ctx.Parent()
+	if _, err := loadConfigFile(global); err != nil {
+		log.Error("Failed to load config file: ", err)
+		return cli.NewExitError(nil, 1)
+	}
+
+	timeout := ctx.Duration("timeout")
+	if timeout <= 0 {
+		log.Error("The check timeout must be positive")
+		return cli.NewExitError(nil, 1)
+	}
+
+	var err error
+	if addr := global.String("health-addr"); len(addr) > 0 {
+		err = checkHealthEndpoint(addr, timeout)
+	} else {
+		err = checkMQTT(global, timeout)
+	}
+	if err != nil {
+		log.Error("Check failed: ", err)
+		return cli.NewExitError(nil, 1)
+	}
+	return nil
+}
+
+// checkHealthEndpoint requests /healthz from the health endpoints served on
+// addr, which may leave out the host or listen on all of them
+func checkHealthEndpoint(addr string, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid health address %s: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkMQTT connects to the MQTT server with the service credentials and
+// disconnects again
+func checkMQTT(ctx *cli.Context, timeout time.Duration) error {
+	tlsconfig, err := mqttTLSConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	clientopts := mqtt.NewClientOptions()
+	clientopts.AddBroker(ctx.String("mqtt-server"))
+	if tlsconfig != nil {
+		clientopts.SetTLSConfig(tlsconfig)
+	}
+	clientopts.SetClientID(fmt.Sprintf("math-diff-service-check-%d", os.Getpid()))
+	clientopts.SetUsername(ctx.String("service-id"))
+	clientopts.SetPassword(ctx.String("service-token"))
+	clientopts.SetConnectTimeout(timeout)
+	clientopts.SetAutoReconnect(false)
+
+	client := mqtt.NewClient(clientopts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out connecting to %s after %v", ctx.String("mqtt-server"), timeout)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	client.Disconnect(0)
+	return nil
+}
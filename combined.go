@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// combinedEntry is the entry of an output topic in the CombinedOutput
+// payload. Output is the last payload of the topic, as JSON if it is JSON
+// and as a string otherwise, and Time is when it was computed.
+type combinedEntry struct {
+	Output json.RawMessage `json:"output"`
+	Time   string          `json:"ts"`
+}
+
+// startCombined starts a ticker that publishes the combined output every
+// CombinedInterval, if one is set. Without one, the combined output is
+// published whenever a topic produces an output.
+func (d *Device) startCombined(ctrl deviceControl) {
+	if len(d.combined) == 0 || d.combinedinterval <= 0 || d.paused {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopcombined = stop
+
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mu.Lock()
+				// The ticker may have been stopped while waiting on the lock
+				select {
+				case <-stop:
+				default:
+					d.publishCombined(ctrl)
+				}
+				d.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}(d.combinedinterval)
+}
+
+// stopCombined stops the ticker started by startCombined
+func (d *Device) stopCombined() {
+	if d.stopcombined != nil {
+		close(d.stopcombined)
+		d.stopcombined = nil
+	}
+}
+
+// publishCombined publishes the last output of every topic as a single JSON
+// object to the CombinedOutput topic, keyed by the output topics, including
+// the _min and _max topics of minmax topics and the PairDiff output topic.
+// Nothing is published until a topic has an output. The device lock must be
+// held.
+func (d *Device) publishCombined(ctrl deviceControl) {
+	entries := make(map[string]combinedEntry)
+	d.eachTopic(func(index int, t *topic) {
+		sent := t.lastsent.UTC().Format(time.RFC3339)
+		if len(t.lastpayload) > 0 {
+			entries[t.outtopic] = combinedEntry{Output: combinedOutput(t.lastpayload), Time: sent}
+		}
+		for i, suffix := range []string{minTopicSuffix, maxTopicSuffix} {
+			if len(t.lastextremes[i]) > 0 {
+				entries[t.outtopic+suffix] = combinedEntry{Output: combinedOutput(t.lastextremes[i]), Time: sent}
+			}
+		}
+	})
+	if d.pair != nil && len(d.pair.lastpayload) > 0 {
+		entries[d.pair.outtopic] = combinedEntry{Output: combinedOutput(d.pair.lastpayload), Time: d.pair.lastsent.UTC().Format(time.RFC3339)}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	logitem := log.WithFields(log.Fields{
+		"deviceid": ctrl.Id(),
+		"outtopic": d.combined,
+	})
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		logitem.Errorf("Failed to encode combined output: %v", err)
+		return
+	}
+	d.combinedsent = d.opts.now()
+	d.publish(ctrl, logitem, d.combined, string(payload))
+}
+
+// combinedOutput returns payload as JSON. Plain results and JSON outputs are
+// JSON already, while edge events, units, and non-finite results are quoted.
+func combinedOutput(payload string) json.RawMessage {
+	if json.Valid([]byte(payload)) {
+		return json.RawMessage(payload)
+	}
+	quoted, _ := json.Marshal(payload)
+	return quoted
+}
@@ -0,0 +1,1336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openchirp/math-diff-service/internal/processor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultOutputTopicSuffix = "_diff"
+)
+
+const (
+	// defaultPrecision of -1 publishes the shortest exact representation
+	defaultPrecision = -1
+	// defaultMaxPoints bounds the samples of a time window
+	defaultMaxPoints = 1000
+	// defaultMaxTopicsPerDevice bounds the input topics of a device, which
+	// each cost a subscription
+	defaultMaxTopicsPerDevice = 64
+	// maxMedianWindow bounds the median filter, which sorts its inputs on
+	// every message
+	maxMedianWindow = 25
+	// defaultIgnoreEpsilon is the difference from an IgnoreValues entry
+	// within which an input matches it, which absorbs the rounding of
+	// payloads parsed as floats
+	defaultIgnoreEpsilon = 1e-9
+)
+
+const (
+	unitStrip       = "strip"
+	unitPassthrough = "passthrough"
+	unitJSON        = "json"
+)
+
+const (
+	parseBaseDecimal = "10"
+	parseBaseAuto    = "auto"
+)
+
+const (
+	edgeRising  = "rising"
+	edgeFalling = "falling"
+	edgeBoth    = "both"
+)
+
+const (
+	// signRising and signFalling are the events of signchange mode
+	signRising  = "rising"
+	signFalling = "falling"
+)
+
+const (
+	// minTopicSuffix and maxTopicSuffix are appended to the output topic
+	// of a minmax topic
+	minTopicSuffix = "_min"
+	maxTopicSuffix = "_max"
+)
+
+const (
+	modeDiff       = "diff"
+	modeRate       = "rate"
+	modeCounter    = "counter"
+	modeSum        = "sum"
+	modeDiff2      = "diff2"
+	modeAvg        = "avg"
+	modeIntegrate  = "integrate"
+	modeDaily      = "daily"
+	modeStdDev     = "stddev"
+	modeMinMax     = "minmax"
+	modeSignChange = "signchange"
+	modeSlope      = "slope"
+	modeEdges      = "edges"
+	modeEdgeCount  = "edgecount"
+	modePercentile = "percentile"
+	// modeExpression is used by every topic of a link with an Expression,
+	// and is not an accepted Mode value
+	modeExpression = "expression"
+)
+
+// modeNames lists every accepted Mode value
+var modeNames = []string{modeDiff, modeRate, modeCounter, modeSum, modeDiff2, modeAvg, modeIntegrate, modeDaily, modeStdDev, modeMinMax, modeSignChange, modeSlope, modeEdges, modeEdgeCount, modePercentile}
+
+const (
+	smoothNone = "none"
+	smoothEWMA = "ewma"
+)
+
+const (
+	smoothTargetInput  = "input"
+	smoothTargetOutput = "output"
+)
+
+const (
+	defaultSmoothAlpha = 0.2
+)
+
+const (
+	// defaultMaxJumpResync is the number of consecutive outliers after
+	// which the new level is accepted
+	defaultMaxJumpResync = 3
+)
+
+const (
+	// resetTopic is the device subtopic that clears the stored state when
+	// any payload arrives. A payload naming an input topic clears only it.
+	resetTopic = "diff_reset"
+)
+
+const (
+	// defaultPairSeparator joins the two PairDiff topics into the default output topic
+	defaultPairSeparator = "_minus_"
+)
+
+const (
+	defaultTimestampDelimiter = "@"
+)
+
+const (
+	windowFillWait    = "wait"
+	windowFillPartial = "partial"
+)
+
+const (
+	counterResetValue = "value"
+	counterResetZero  = "zero"
+)
+
+const (
+	numberFormatFixed    = "fixed"
+	numberFormatShortest = "shortest"
+)
+
+const (
+	clampModeClip = "clip"
+	clampModeDrop = "drop"
+)
+
+const (
+	outputFormatPlain = "plain"
+	outputFormatJSON  = "json"
+)
+
+const (
+	payloadFormatText = "text"
+	payloadFormatCBOR = "cbor"
+)
+
+// rateUnits maps the accepted RateUnit and TimeUnit values to their durations
+var rateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+}
+
+// configure parses the link config, replacing any previous configuration
+// and state. Keys the config leaves unset fall back to the service options
+// in opts. It returns an empty string on success, or the error to report in
+// the device's service status.
+func (l *link) configure(logitem *log.Entry, config map[string]string, opts *serviceOptions) string {
+	config, status := expandConfigJSON(logitem, config)
+	if len(status) > 0 {
+		return status
+	}
+	lists := make(map[string][]string, len(listKeys))
+	for _, list := range listKeys {
+		entries, err := parseList(config[list.key], list.separators)
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\": %v", list.key, config[list.key], err)
+			return fmt.Sprintf("Error: %s has an %v", list.key, err)
+		}
+		lists[list.key] = entries
+	}
+	// The topics of ConfigJSON are taken literally
+	if len(strings.TrimSpace(config[configKeyConfigJSON])) == 0 {
+		if status := applyInlineOptions(lists); len(status) > 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyInputTopics, config[configKeyInputTopics])
+			return status
+		}
+	}
+
+	inputTopics := lists[configKeyInputTopics]
+	if opts.maxTopics > 0 && len(inputTopics) > opts.maxTopics {
+		logitem.Warnf("%s has %d topics, more than the limit of %d", configKeyInputTopics, len(inputTopics), opts.maxTopics)
+		return fmt.Sprintf("Error: %s has %d topics but the service allows at most %d per device", configKeyInputTopics, len(inputTopics), opts.maxTopics)
+	}
+	l.maxtopics = opts.maxTopics
+	if status := checkTopicLists(lists); len(status) > 0 {
+		return status
+	}
+	outputTopics := lists[configKeyOutputTopics]
+	maxValues := lists[configKeyMaxValue]
+	counterBits := lists[configKeyCounterBits]
+	modes := lists[configKeyMode]
+	if len(modes) > 1 {
+		logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMode, config[configKeyMode])
+		return fmt.Sprintf("Error: %s takes a single mode for all topics, with %s listing them per topic", configKeyMode, configKeyModes)
+	}
+	topicModes := lists[configKeyModes]
+	absolutes := lists[configKeyAbsolute]
+	scales := lists[configKeyScale]
+	jsonFields := lists[configKeyJSONField]
+	arrayDiffs := lists[configKeyArrayDiff]
+	integers := lists[configKeyOutputInteger]
+	inverts := lists[configKeyInvert]
+	initialValues := lists[configKeyInitialValues]
+	converts := lists[configKeyConvert]
+	validMins := lists[configKeyValidMin]
+	validMaxs := lists[configKeyValidMax]
+	extractRegexes := lists[configKeyExtractRegex]
+	encodings := lists[configKeyEncoding]
+	payloadOffsets := lists[configKeyPayloadOffset]
+	payloadBase64s := lists[configKeyPayloadBase64]
+	jsonPaths := lists[configKeyJSONPath]
+	allFields := lists[configKeyJSONAllFields]
+	payloadFormats := lists[configKeyPayloadFormat]
+
+	l.publishfirst = false
+	if value, ok := config[configKeyPublishFirst]; ok && len(value) > 0 {
+		publishfirst, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPublishFirst, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyPublishFirst)
+		}
+		l.publishfirst = publishfirst
+	}
+
+	l.resetzero = false
+	if value, ok := config[configKeyCounterReset]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case counterResetValue:
+		case counterResetZero:
+			l.resetzero = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyCounterReset, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyCounterReset, counterResetValue, counterResetZero)
+		}
+	}
+
+	l.rateunit = time.Second
+	if value, ok := config[configKeyRateUnit]; ok && len(value) > 0 {
+		unit, ok := rateUnits[strings.ToLower(strings.TrimSpace(value))]
+		if !ok {
+			logitem.Warnf("Unknown %s \"%s\"", configKeyRateUnit, value)
+			return fmt.Sprintf("Error: %s must be second, minute, or hour", configKeyRateUnit)
+		}
+		l.rateunit = unit
+	}
+	if value, ok := config[configKeyRatePer]; ok && len(value) > 0 {
+		if _, ok := config[configKeyRateUnit]; ok && len(config[configKeyRateUnit]) > 0 {
+			return fmt.Sprintf("Error: %s cannot be combined with %s", configKeyRatePer, configKeyRateUnit)
+		}
+		rateper, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || rateper <= 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyRatePer, value)
+			return fmt.Sprintf("Error: %s must be a positive duration like 1m", configKeyRatePer)
+		}
+		l.rateunit = rateper
+	}
+
+	l.timeunit = time.Second
+	if value, ok := config[configKeyTimeUnit]; ok && len(value) > 0 {
+		unit, ok := rateUnits[strings.ToLower(strings.TrimSpace(value))]
+		if !ok {
+			logitem.Warnf("Unknown %s \"%s\"", configKeyTimeUnit, value)
+			return fmt.Sprintf("Error: %s must be second, minute, or hour", configKeyTimeUnit)
+		}
+		l.timeunit = unit
+	}
+
+	l.resettime = 0
+	if value, ok := config[configKeyResetTime]; ok && len(value) > 0 {
+		resettime, err := time.Parse("15:04", strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyResetTime, value)
+			return fmt.Sprintf("Error: %s must be a time of day like 00:00", configKeyResetTime)
+		}
+		l.resettime = time.Duration(resettime.Hour())*time.Hour + time.Duration(resettime.Minute())*time.Minute
+	}
+
+	l.timezone = time.Local
+	if value, ok := config[configKeyTimezone]; ok && len(value) > 0 {
+		timezone, err := time.LoadLocation(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to load %s \"%s\": %v", configKeyTimezone, value, err)
+			return fmt.Sprintf("Error: %s must be a time zone like America/New_York", configKeyTimezone)
+		}
+		l.timezone = timezone
+	}
+
+	l.precision = defaultPrecision
+	l.precisionset = false
+	if value, ok := config[configKeyPrecision]; ok && len(value) > 0 {
+		precision, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || precision < -1 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPrecision, value)
+			return fmt.Sprintf("Error: %s must be an integer of -1 or greater", configKeyPrecision)
+		}
+		l.precision = precision
+		l.precisionset = true
+	}
+
+	l.shortest = false
+	if value, ok := config[configKeyFormat]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case numberFormatFixed:
+		case numberFormatShortest:
+			l.shortest = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyFormat, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyFormat, numberFormatFixed, numberFormatShortest)
+		}
+		if l.shortest && l.precisionset && l.precision >= 0 {
+			return fmt.Sprintf("Error: %s %s cannot be combined with a %s", configKeyFormat, numberFormatShortest, configKeyPrecision)
+		}
+	}
+
+	l.mindiff = 0
+	if value, ok := config[configKeyMinDiff]; ok && len(value) > 0 {
+		mindiff, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || mindiff < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMinDiff, value)
+			return fmt.Sprintf("Error: %s must be a non-negative number", configKeyMinDiff)
+		}
+		l.mindiff = mindiff
+	}
+
+	l.deadband = 0
+	if value, ok := config[configKeyDeadBand]; ok && len(value) > 0 {
+		deadband, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || deadband < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyDeadBand, value)
+			return fmt.Sprintf("Error: %s must be a non-negative number", configKeyDeadBand)
+		}
+		l.deadband = deadband
+	}
+
+	l.ignorevalues = nil
+	for _, entry := range lists[configKeyIgnoreValues] {
+		value, err := strconv.ParseFloat(entry, 64)
+		if err != nil || isNonFinite(value) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyIgnoreValues, config[configKeyIgnoreValues])
+			return fmt.Sprintf("Error: %s entry \"%s\" must be a finite number", configKeyIgnoreValues, entry)
+		}
+		l.ignorevalues = append(l.ignorevalues, value)
+	}
+	l.ignoreepsilon = defaultIgnoreEpsilon
+	if value, ok := config[configKeyIgnoreEpsilon]; ok && len(value) > 0 {
+		epsilon, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(epsilon >= 0) || math.IsInf(epsilon, 1) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyIgnoreEpsilon, value)
+			return fmt.Sprintf("Error: %s must be a non-negative number", configKeyIgnoreEpsilon)
+		}
+		l.ignoreepsilon = epsilon
+	}
+
+	l.maxfields = defaultMaxJSONFields
+	if value, ok := config[configKeyJSONMaxFields]; ok && len(value) > 0 {
+		maxfields, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || maxfields < 1 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyJSONMaxFields, value)
+			return fmt.Sprintf("Error: %s must be a positive integer", configKeyJSONMaxFields)
+		}
+		l.maxfields = maxfields
+	}
+
+	l.percentile = 0
+	if value, ok := config[configKeyPercentile]; ok && len(value) > 0 {
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(percentile > 0 && percentile <= 100) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPercentile, value)
+			return fmt.Sprintf("Error: %s must be a number greater than 0 and at most 100", configKeyPercentile)
+		}
+		l.percentile = percentile
+	}
+
+	l.edgetype = ""
+	if value, ok := config[configKeyEdgeType]; ok && len(value) > 0 {
+		switch edgetype := strings.ToLower(strings.TrimSpace(value)); edgetype {
+		case edgeRising, edgeFalling, edgeBoth:
+			l.edgetype = edgetype
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyEdgeType, value)
+			return fmt.Sprintf("Error: %s must be %s, %s, or %s", configKeyEdgeType, edgeRising, edgeFalling, edgeBoth)
+		}
+	}
+
+	l.maxjump = 0
+	if value, ok := config[configKeyMaxJump]; ok && len(value) > 0 {
+		maxjump, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || maxjump < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMaxJump, value)
+			return fmt.Sprintf("Error: %s must be a non-negative number", configKeyMaxJump)
+		}
+		l.maxjump = maxjump
+	}
+
+	l.maxjumpresync = defaultMaxJumpResync
+	if value, ok := config[configKeyMaxJumpResync]; ok && len(value) > 0 {
+		resync, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || resync < 1 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMaxJumpResync, value)
+			return fmt.Sprintf("Error: %s must be a positive integer", configKeyMaxJumpResync)
+		}
+		l.maxjumpresync = resync
+	}
+
+	l.clampmin = math.Inf(-1)
+	if value, ok := config[configKeyClampMin]; ok && len(value) > 0 {
+		clampmin, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || isNonFinite(clampmin) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyClampMin, value)
+			return fmt.Sprintf("Error: %s must be a finite number", configKeyClampMin)
+		}
+		l.clampmin = clampmin
+	}
+
+	l.clampmax = math.Inf(1)
+	if value, ok := config[configKeyClampMax]; ok && len(value) > 0 {
+		clampmax, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || isNonFinite(clampmax) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyClampMax, value)
+			return fmt.Sprintf("Error: %s must be a finite number", configKeyClampMax)
+		}
+		l.clampmax = clampmax
+	}
+	if l.clampmin > l.clampmax {
+		return fmt.Sprintf("Error: %s must not be greater than %s", configKeyClampMin, configKeyClampMax)
+	}
+
+	l.clampdrop = false
+	if value, ok := config[configKeyClampMode]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case clampModeClip:
+		case clampModeDrop:
+			l.clampdrop = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyClampMode, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyClampMode, clampModeClip, clampModeDrop)
+		}
+	}
+
+	l.smooth = false
+	if value, ok := config[configKeySmooth]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case smoothNone:
+		case smoothEWMA:
+			l.smooth = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeySmooth, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeySmooth, smoothNone, smoothEWMA)
+		}
+	}
+
+	l.alpha = defaultSmoothAlpha
+	if value, ok := config[configKeySmoothAlpha]; ok && len(value) > 0 {
+		alpha, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(alpha > 0 && alpha <= 1) {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeySmoothAlpha, value)
+			return fmt.Sprintf("Error: %s must be greater than 0 and at most 1, since it is the weight given to the newest sample", configKeySmoothAlpha)
+		}
+		l.alpha = alpha
+	}
+
+	l.smoothoutput = false
+	if value, ok := config[configKeySmoothTarget]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case smoothTargetInput:
+		case smoothTargetOutput:
+			l.smoothoutput = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeySmoothTarget, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeySmoothTarget, smoothTargetInput, smoothTargetOutput)
+		}
+	}
+
+	l.window = 0
+	l.windowduration = 0
+	if value, ok := config[configKeyWindow]; ok && len(value) > 0 {
+		window, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			// Min/max and slope windows may also span a duration
+			var duration time.Duration
+			if duration, err = time.ParseDuration(strings.TrimSpace(value)); err == nil && duration > 0 {
+				l.windowduration = duration
+			}
+		} else if window > 0 {
+			l.window = window
+		}
+		if l.window == 0 && l.windowduration == 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyWindow, value)
+			return fmt.Sprintf("Error: %s must be a positive integer, or a duration in %s or %s mode", configKeyWindow, modeMinMax, modeSlope)
+		}
+	}
+
+	l.medianwindow = 0
+	if value, ok := config[configKeyMedianWindow]; ok && len(value) > 0 {
+		medianwindow, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || medianwindow < 3 || medianwindow > maxMedianWindow || medianwindow%2 == 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMedianWindow, value)
+			return fmt.Sprintf("Error: %s must be an odd integer from 3 to %d", configKeyMedianWindow, maxMedianWindow)
+		}
+		l.medianwindow = medianwindow
+	}
+
+	l.maxpoints = defaultMaxPoints
+	if value, ok := config[configKeyMaxPoints]; ok && len(value) > 0 {
+		maxpoints, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || maxpoints < 2 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMaxPoints, value)
+			return fmt.Sprintf("Error: %s must be an integer of at least 2", configKeyMaxPoints)
+		}
+		l.maxpoints = maxpoints
+	}
+
+	l.windowpartial = false
+	if value, ok := config[configKeyWindowFill]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case windowFillWait:
+		case windowFillPartial:
+			l.windowpartial = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyWindowFill, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyWindowFill, windowFillWait, windowFillPartial)
+		}
+	}
+
+	l.seedretained = false
+	if value, ok := config[configKeySeedRetained]; ok && len(value) > 0 {
+		seedretained, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeySeedRetained, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeySeedRetained)
+		}
+		l.seedretained = seedretained
+	}
+
+	l.jsonoutput = false
+	if value, ok := config[configKeyOutputFormat]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case outputFormatPlain:
+		case outputFormatJSON:
+			l.jsonoutput = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyOutputFormat, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyOutputFormat, outputFormatPlain, outputFormatJSON)
+		}
+	}
+
+	l.mininterval = 0
+	if value, ok := config[configKeyMinInterval]; ok && len(value) > 0 {
+		mininterval, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || mininterval < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMinInterval, value)
+			return fmt.Sprintf("Error: %s must be a non-negative duration, such as 1s or 500ms", configKeyMinInterval)
+		}
+		l.mininterval = mininterval
+	}
+
+	l.staletimeout = 0
+	if value, ok := config[configKeyStaleTimeout]; ok && len(value) > 0 {
+		staletimeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || staletimeout < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyStaleTimeout, value)
+			return fmt.Sprintf("Error: %s must be a non-negative duration, such as 10m", configKeyStaleTimeout)
+		}
+		l.staletimeout = staletimeout
+	}
+
+	l.stalemarker = defaultStaleMarker
+	if value, ok := config[configKeyStaleMarker]; ok && len(value) > 0 {
+		l.stalemarker = value
+	}
+
+	l.republish = 0
+	if value, ok := config[configKeyRepublish]; ok && len(value) > 0 {
+		republish, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || republish < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyRepublish, value)
+			return fmt.Sprintf("Error: %s must be a non-negative duration, such as 5m", configKeyRepublish)
+		}
+		l.republish = republish
+	}
+
+	l.qos = opts.qos
+	if value, ok := config[configKeyQoS]; ok && len(value) > 0 {
+		qos, err := strconv.ParseUint(strings.TrimSpace(value), 10, 8)
+		if err != nil || qos > 2 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyQoS, value)
+			return fmt.Sprintf("Error: %s must be 0, 1, or 2", configKeyQoS)
+		}
+		l.qos = byte(qos)
+	}
+
+	l.retain = opts.retain
+	if value, ok := config[configKeyRetain]; ok && len(value) > 0 {
+		retain, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyRetain, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyRetain)
+		}
+		l.retain = retain
+	}
+
+	l.allownonfinite = false
+	if value, ok := config[configKeyAllowNonFinite]; ok && len(value) > 0 {
+		allownonfinite, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyAllowNonFinite, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyAllowNonFinite)
+		}
+		l.allownonfinite = allownonfinite
+	}
+
+	l.dryrun = false
+	if value, ok := config[configKeyDryRun]; ok && len(value) > 0 {
+		dryrun, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyDryRun, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyDryRun)
+		}
+		l.dryrun = dryrun
+	}
+
+	l.publishstats = false
+	if value, ok := config[configKeyPublishStats]; ok && len(value) > 0 {
+		publishstats, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPublishStats, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyPublishStats)
+		}
+		l.publishstats = publishstats
+	}
+
+	l.statsinterval = defaultStatsInterval
+	if value, ok := config[configKeyStatsInterval]; ok && len(value) > 0 {
+		statsinterval, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || statsinterval <= 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyStatsInterval, value)
+			return fmt.Sprintf("Error: %s must be a positive duration, such as 5m", configKeyStatsInterval)
+		}
+		l.statsinterval = statsinterval
+	}
+
+	l.combined = ""
+	if value, ok := config[configKeyCombinedOutput]; ok && len(value) > 0 {
+		l.combined = strings.TrimSpace(value)
+		if strings.ContainsAny(l.combined, "+#") {
+			return fmt.Sprintf("Error: %s must be a topic without wildcards", configKeyCombinedOutput)
+		}
+	}
+
+	l.combinedinterval = 0
+	if value, ok := config[configKeyCombinedPeriod]; ok && len(value) > 0 {
+		combinedinterval, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || combinedinterval < 0 {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyCombinedPeriod, value)
+			return fmt.Sprintf("Error: %s must be a non-negative duration, such as 1m", configKeyCombinedPeriod)
+		}
+		if len(l.combined) == 0 {
+			return fmt.Sprintf("Error: %s requires %s", configKeyCombinedPeriod, configKeyCombinedOutput)
+		}
+		l.combinedinterval = combinedinterval
+	}
+
+	l.publisherrors = false
+	if value, ok := config[configKeyPublishErrors]; ok && len(value) > 0 {
+		publisherrors, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPublishErrors, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyPublishErrors)
+		}
+		l.publisherrors = publisherrors
+	}
+
+	l.numbers = numberFormat{}
+	if value, ok := config[configKeyStripUnits]; ok && len(value) > 0 {
+		stripunits, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyStripUnits, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyStripUnits)
+		}
+		l.numbers.stripunits = stripunits
+	}
+	if value, ok := config[configKeyDecimalComma]; ok && len(value) > 0 {
+		decimalcomma, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyDecimalComma, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyDecimalComma)
+		}
+		l.numbers.decimalcomma = decimalcomma
+	}
+	l.unithandling = ""
+	if value, ok := config[configKeyUnitHandling]; ok && len(value) > 0 {
+		switch unithandling := strings.ToLower(strings.TrimSpace(value)); unithandling {
+		case unitStrip, unitPassthrough, unitJSON:
+			l.unithandling = unithandling
+			l.numbers.stripunits = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyUnitHandling, value)
+			return fmt.Sprintf("Error: %s must be %s, %s, or %s", configKeyUnitHandling, unitStrip, unitPassthrough, unitJSON)
+		}
+	}
+	if value, ok := config[configKeyParseBase]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case parseBaseDecimal:
+		case parseBaseAuto:
+			l.numbers.prefixed = true
+		default:
+			logitem.Warnf("Unknown %s \"%s\"", configKeyParseBase, value)
+			return fmt.Sprintf("Error: %s must be %s or %s", configKeyParseBase, parseBaseDecimal, parseBaseAuto)
+		}
+	}
+
+	l.expression = nil
+	if value, ok := config[configKeyExpression]; ok && len(strings.TrimSpace(value)) > 0 {
+		if len(modes) > 0 || len(topicModes) > 0 {
+			return fmt.Sprintf("Error: %s cannot be combined with %s or %s", configKeyExpression, configKeyMode, configKeyModes)
+		}
+		expression, err := processor.CompileExpression(value)
+		if err != nil {
+			logitem.Warnf("Failed to compile %s \"%s\": %v", configKeyExpression, value, err)
+			return fmt.Sprintf("Error: %s: %v", configKeyExpression, err)
+		}
+		l.expression = expression
+	}
+
+	l.timestamped = false
+	if value, ok := config[configKeyTimestamped]; ok && len(value) > 0 {
+		timestamped, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			logitem.Warnf("Failed to parse %s value \"%s\"", configKeyTimestamped, value)
+			return fmt.Sprintf("Error: %s must be true or false", configKeyTimestamped)
+		}
+		l.timestamped = timestamped
+	}
+
+	l.tsdelimiter = defaultTimestampDelimiter
+	if value, ok := config[configKeyTimestampDelim]; ok && len(value) > 0 {
+		l.tsdelimiter = value
+	}
+
+	l.outputprefix = strings.TrimSpace(config[configKeyOutputPrefix])
+	l.outputsuffix = opts.defaultSuffix
+	if value, ok := config[configKeyOutputSuffix]; ok && len(strings.TrimSpace(value)) > 0 {
+		l.outputsuffix = strings.TrimSpace(value)
+	}
+
+	l.pair = nil
+	if value, ok := config[configKeyPairDiff]; ok && len(strings.TrimSpace(value)) > 0 {
+		pairTopics := lists[configKeyPairDiff]
+		if len(pairTopics) != 2 || len(pairTopics[0]) == 0 || len(pairTopics[1]) == 0 {
+			return fmt.Sprintf("Error: %s must be two comma separated topics", configKeyPairDiff)
+		}
+		if pairTopics[0] == pairTopics[1] {
+			return fmt.Sprintf("Error: %s topics must differ", configKeyPairDiff)
+		}
+		for _, intopic := range inputTopics {
+			if intopic == pairTopics[0] || intopic == pairTopics[1] {
+				return fmt.Sprintf("Error: %s topic %s is also listed in %s", configKeyPairDiff, intopic, configKeyInputTopics)
+			}
+		}
+		l.pair = &pair{
+			intopics: [2]string{pairTopics[0], pairTopics[1]},
+			outtopic: strings.TrimSpace(config[configKeyPairOutput]),
+			values:   [2]float64{math.NaN(), math.NaN()},
+		}
+		if len(l.pair.outtopic) == 0 {
+			l.pair.outtopic = l.outputprefix + pairTopics[0] + defaultPairSeparator + pairTopics[1]
+		}
+	}
+
+	if len(inputTopics) == 0 && l.pair == nil {
+		return fmt.Sprintf("Error: %s or %s must be set", configKeyInputTopics, configKeyPairDiff)
+	}
+
+	l.topics = make([]topic, len(inputTopics))
+
+	// diffs and firsts record whether any topic applies the options of
+	// consecutive diffs and PublishFirstSample
+	diffs, firsts := false, false
+	for i, intopic := range inputTopics {
+		t := &l.topics[i]
+		t.intopic = intopic
+		t.index = i
+		t.wildcard = isWildcard(intopic)
+		if i < len(outputTopics) && (len(outputTopics[i]) > 0) {
+			if t.wildcard {
+				return fmt.Sprintf("Error: %s for the wildcard topic %s must be empty, since each matched topic gets its own output", configKeyOutputTopics, intopic)
+			}
+			t.outtopic = outputTopics[i]
+		} else {
+			// if no output topic specified, decorate the input topic
+			t.outtopic = l.outputprefix + intopic + l.outputsuffix
+		}
+		if t.wildcard {
+			for _, level := range strings.Split(intopic, "/") {
+				if level != wildcardLevel && strings.ContainsAny(level, "+#") {
+					return fmt.Sprintf("Error: %s topic %s may only use + wildcards spanning a whole level", configKeyInputTopics, intopic)
+				}
+			}
+			if i < len(initialValues) && len(initialValues[i]) > 0 {
+				return fmt.Sprintf("Error: %s cannot seed the wildcard topic %s", configKeyInitialValues, intopic)
+			}
+		}
+		t.logitem = logitem.WithFields(log.Fields{
+			"topic":    intopic,
+			"index":    i,
+			"outtopic": t.outtopic,
+		})
+		t.state = processor.NewState(l.window)
+		t.median = nil
+		if l.medianwindow > 0 {
+			t.median = processor.NewRing(l.medianwindow)
+		}
+		t.reset()
+		t.seeding = l.seedretained
+
+		if i < len(maxValues) && (len(maxValues[i]) > 0) {
+			maxvalue, err := strconv.ParseFloat(maxValues[i], 64)
+			if err != nil || maxvalue <= 0 {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyMaxValue, maxValues[i])
+				return fmt.Sprintf("Error: %s for %s must be a positive number", configKeyMaxValue, intopic)
+			}
+			t.maxvalue = maxvalue
+		}
+
+		if bits := topicEntry(counterBits, i); len(bits) > 0 {
+			switch bits {
+			case "8", "16", "32", "64":
+				t.counterbits, _ = strconv.Atoi(bits)
+			default:
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyCounterBits, bits)
+				return fmt.Sprintf("Error: %s for %s must be 8, 16, 32, or 64", configKeyCounterBits, intopic)
+			}
+			if t.maxvalue > 0 {
+				return fmt.Sprintf("Error: %s and %s cannot both be set for %s", configKeyCounterBits, configKeyMaxValue, intopic)
+			}
+		}
+
+		// A Modes entry overrides the Mode default for the topic
+		t.mode = modeDiff
+		mode, modeKey := topicEntry(modes, i), configKeyMode
+		if i < len(topicModes) && len(topicModes[i]) > 0 {
+			mode, modeKey = topicModes[i], configKeyModes
+		}
+		if l.expression != nil {
+			t.mode = modeExpression
+		} else if len(mode) > 0 {
+			t.mode = strings.ToLower(mode)
+			if !validMode(t.mode) {
+				logitem.Warnf("Unknown %s \"%s\"", modeKey, mode)
+				return fmt.Sprintf("Error: %s for %s must be one of %s", modeKey, intopic, strings.Join(modeNames, ", "))
+			}
+			if (t.mode == modeAvg || t.mode == modeStdDev || t.mode == modePercentile) && l.window == 0 && l.windowduration == 0 {
+				return fmt.Sprintf("Error: %s %s for %s requires %s", modeKey, t.mode, intopic, configKeyWindow)
+			}
+		}
+		t.convert = nil
+		if convert := topicEntry(converts, i); len(convert) > 0 {
+			var err error
+			if t.convert, err = parseConversion(convert); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\": %v", configKeyConvert, convert, err)
+				return fmt.Sprintf("Error: %s for %s must be %sscale,offset or one of %s", configKeyConvert, intopic, conversionLinear, strings.Join(conversionNames(), ", "))
+			}
+		}
+
+		if l.windowduration > 0 && t.mode != modeMinMax && t.mode != modeSlope {
+			return fmt.Sprintf("Error: %s must be a number of samples for the %s topic %s, since only %s and %s mode take a duration", configKeyWindow, t.mode, intopic, modeMinMax, modeSlope)
+		}
+		if t.mode == modePercentile && l.percentile == 0 {
+			return fmt.Sprintf("Error: %s %s for %s requires %s", modeKey, modePercentile, intopic, configKeyPercentile)
+		}
+		if t.mode == modeSlope && l.windowduration == 0 {
+			return fmt.Sprintf("Error: %s %s for %s requires %s to be a duration", modeKey, modeSlope, intopic, configKeyWindow)
+		}
+		t.proc = l.newProcessor(t)
+
+		if absolute := topicEntry(absolutes, i); len(absolute) > 0 {
+			var err error
+			if t.absolute, err = strconv.ParseBool(absolute); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyAbsolute, absolute)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyAbsolute, intopic)
+			}
+		}
+
+		if invert := topicEntry(inverts, i); len(invert) > 0 {
+			var err error
+			if t.invert, err = strconv.ParseBool(invert); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyInvert, invert)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyInvert, intopic)
+			}
+		}
+
+		if integer := topicEntry(integers, i); len(integer) > 0 {
+			var err error
+			if t.integer, err = strconv.ParseBool(integer); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyOutputInteger, integer)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyOutputInteger, intopic)
+			}
+		}
+
+		if arraydiff := topicEntry(arrayDiffs, i); len(arraydiff) > 0 {
+			var err error
+			if t.arraydiff, err = strconv.ParseBool(arraydiff); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyArrayDiff, arraydiff)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyArrayDiff, intopic)
+			}
+		}
+
+		if field := topicEntry(jsonFields, i); len(field) > 0 {
+			var err error
+			if t.jsonpath, err = fieldPath(field); err != nil {
+				return fmt.Sprintf("Error: %s for %s %v", configKeyJSONField, intopic, err)
+			}
+		}
+		if path := topicEntry(jsonPaths, i); len(path) > 0 {
+			if t.jsonpath != nil {
+				return fmt.Sprintf("Error: %s and %s cannot both be set for %s", configKeyJSONField, configKeyJSONPath, intopic)
+			}
+			var err error
+			if t.jsonpath, err = parseJSONPath(path); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\": %v", configKeyJSONPath, path, err)
+				return fmt.Sprintf("Error: %s for %s %v", configKeyJSONPath, intopic, err)
+			}
+		}
+
+		if expr := topicEntry(extractRegexes, i); len(expr) > 0 {
+			var err error
+			if t.extract, err = regexp.Compile(expr); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\": %v", configKeyExtractRegex, expr, err)
+				return fmt.Sprintf("Error: %s for %s is invalid: %v", configKeyExtractRegex, intopic, err)
+			}
+			if t.extract.NumSubexp() == 0 {
+				return fmt.Sprintf("Error: %s for %s must have a capture group for the value", configKeyExtractRegex, intopic)
+			}
+			if t.jsonpath != nil || t.arraydiff {
+				return fmt.Sprintf("Error: %s cannot be combined with %s, %s, or %s for %s", configKeyExtractRegex, configKeyJSONField, configKeyJSONPath, configKeyArrayDiff, intopic)
+			}
+		}
+
+		// Binary payloads are decoded rather than parsed as text
+		t.encoding, t.offset = nil, 0
+		if encoding := topicEntry(encodings, i); len(encoding) > 0 {
+			if t.encoding = parsePayloadEncoding(encoding); t.encoding == nil {
+				logitem.Warnf("Unknown %s \"%s\"", configKeyEncoding, encoding)
+				return fmt.Sprintf("Error: %s for %s must be one of %s", configKeyEncoding, intopic, strings.Join(payloadEncodingNames(), ", "))
+			}
+			if t.extract != nil || t.jsonpath != nil || t.arraydiff {
+				return fmt.Sprintf("Error: %s cannot be combined with %s, %s, %s, or %s for %s", configKeyEncoding, configKeyExtractRegex, configKeyJSONField, configKeyJSONPath, configKeyArrayDiff, intopic)
+			}
+			if l.timestamped {
+				return fmt.Sprintf("Error: %s cannot be combined with %s for %s", configKeyEncoding, configKeyTimestamped, intopic)
+			}
+		}
+		if offset := topicEntry(payloadOffsets, i); len(offset) > 0 {
+			var err error
+			if t.offset, err = strconv.Atoi(offset); err != nil || t.offset < 0 {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPayloadOffset, offset)
+				return fmt.Sprintf("Error: %s for %s must be a non-negative integer", configKeyPayloadOffset, intopic)
+			}
+			if t.encoding == nil {
+				return fmt.Sprintf("Error: %s for %s requires %s", configKeyPayloadOffset, intopic, configKeyEncoding)
+			}
+		}
+
+		t.base64 = false
+		if base64 := topicEntry(payloadBase64s, i); len(base64) > 0 {
+			var err error
+			if t.base64, err = strconv.ParseBool(base64); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyPayloadBase64, base64)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyPayloadBase64, intopic)
+			}
+		}
+
+		t.cbor = false
+		if format := topicEntry(payloadFormats, i); len(format) > 0 {
+			switch strings.ToLower(format) {
+			case payloadFormatText:
+			case payloadFormatCBOR:
+				t.cbor = true
+			default:
+				logitem.Warnf("Unknown %s \"%s\"", configKeyPayloadFormat, format)
+				return fmt.Sprintf("Error: %s for %s must be %s or %s", configKeyPayloadFormat, intopic, payloadFormatText, payloadFormatCBOR)
+			}
+		}
+		if t.cbor {
+			if t.extract != nil || t.encoding != nil || t.arraydiff {
+				return fmt.Sprintf("Error: %s %s cannot be combined with %s, %s, or %s for %s", configKeyPayloadFormat, payloadFormatCBOR, configKeyExtractRegex, configKeyEncoding, configKeyArrayDiff, intopic)
+			}
+			if l.timestamped {
+				return fmt.Sprintf("Error: %s %s cannot be combined with %s for %s", configKeyPayloadFormat, payloadFormatCBOR, configKeyTimestamped, intopic)
+			}
+		}
+
+		if all := topicEntry(allFields, i); len(all) > 0 {
+			var err error
+			if t.allfields, err = strconv.ParseBool(all); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyJSONAllFields, all)
+				return fmt.Sprintf("Error: %s for %s must be true or false", configKeyJSONAllFields, intopic)
+			}
+		}
+		if t.allfields {
+			switch {
+			case t.wildcard:
+				return fmt.Sprintf("Error: %s cannot be set for the wildcard topic %s", configKeyJSONAllFields, intopic)
+			case t.jsonpath != nil || t.extract != nil || t.encoding != nil || t.arraydiff:
+				return fmt.Sprintf("Error: %s cannot be combined with %s, %s, %s, %s, or %s for %s", configKeyJSONAllFields, configKeyJSONField, configKeyJSONPath, configKeyExtractRegex, configKeyEncoding, configKeyArrayDiff, intopic)
+			case i < len(outputTopics) && len(outputTopics[i]) > 0:
+				return fmt.Sprintf("Error: %s for the %s topic %s must be empty, since each field gets its own output", configKeyOutputTopics, configKeyJSONAllFields, intopic)
+			case i < len(initialValues) && len(initialValues[i]) > 0:
+				return fmt.Sprintf("Error: %s cannot seed the %s topic %s", configKeyInitialValues, configKeyJSONAllFields, intopic)
+			}
+		}
+
+		t.scale = 1.0
+		if scale := topicEntry(scales, i); len(scale) > 0 {
+			var err error
+			if t.scale, err = strconv.ParseFloat(scale, 64); err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyScale, scale)
+				return fmt.Sprintf("Error: %s for %s must be a number", configKeyScale, intopic)
+			}
+		}
+
+		// Inputs outside the valid range are rejected, bounds included
+		t.validmin, t.validmax = math.Inf(-1), math.Inf(1)
+		if validmin := topicEntry(validMins, i); len(validmin) > 0 {
+			var err error
+			if t.validmin, err = strconv.ParseFloat(validmin, 64); err != nil || isNonFinite(t.validmin) {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyValidMin, validmin)
+				return fmt.Sprintf("Error: %s for %s must be a number", configKeyValidMin, intopic)
+			}
+		}
+		if validmax := topicEntry(validMaxs, i); len(validmax) > 0 {
+			var err error
+			if t.validmax, err = strconv.ParseFloat(validmax, 64); err != nil || isNonFinite(t.validmax) {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyValidMax, validmax)
+				return fmt.Sprintf("Error: %s for %s must be a number", configKeyValidMax, intopic)
+			}
+		}
+		if t.validmin > t.validmax {
+			return fmt.Sprintf("Error: %s must not be greater than %s for %s", configKeyValidMin, configKeyValidMax, intopic)
+		}
+
+		// A known initial value lets the first message produce a diff
+		if i < len(initialValues) && len(initialValues[i]) > 0 {
+			initial, err := strconv.ParseFloat(initialValues[i], 64)
+			if err != nil {
+				logitem.Warnf("Failed to parse %s value \"%s\"", configKeyInitialValues, initialValues[i])
+				return fmt.Sprintf("Error: %s for %s must be a number", configKeyInitialValues, intopic)
+			}
+			if t.arraydiff {
+				return fmt.Sprintf("Error: %s cannot seed the %s topic %s", configKeyInitialValues, configKeyArrayDiff, intopic)
+			}
+			if t.mode != modeSum {
+				t.state.Seed(t.convert.apply(initial), opts.now())
+			}
+		}
+
+		// Options the processor of the topic would ignore are refused
+		// rather than silently dropped
+		if l.consecutiveDiff(t) {
+			diffs = true
+			firsts = firsts || (t.mode != modeRate && t.mode != modeDiff2)
+		} else if t.maxvalue > 0 {
+			return fmt.Sprintf("Error: %s for %s %s", configKeyMaxValue, intopic, diffOptionScope)
+		} else if t.counterbits > 0 && len(counterBits) > 1 {
+			return fmt.Sprintf("Error: %s for %s %s", configKeyCounterBits, intopic, diffOptionScope)
+		}
+		if t.mode == modeIntegrate && !t.arraydiff {
+			firsts = true
+		}
+	}
+	if !diffs {
+		switch {
+		case l.maxjump > 0:
+			return fmt.Sprintf("Error: %s %s, and none of the topics is", configKeyMaxJump, diffOptionScope)
+		case l.mindiff > 0:
+			return fmt.Sprintf("Error: %s %s, and none of the topics is", configKeyMinDiff, diffOptionScope)
+		case len(counterBits) == 1 && len(counterBits[0]) > 0:
+			return fmt.Sprintf("Error: %s %s, and none of the topics is", configKeyCounterBits, diffOptionScope)
+		}
+	}
+	if l.publishfirst && !firsts {
+		return fmt.Sprintf("Error: %s only applies to %s, %s, and %s topics, and none of the topics is", configKeyPublishFirst, modeDiff, modeCounter, modeIntegrate)
+	}
+
+	return l.validateTopics()
+}
+
+// validateTopics checks the resolved input and output topics for empty,
+// duplicate, and reserved entries, for outputs that would feed back into an
+// input, and for outputs of different entries that collide. It returns the
+// error to report, or an empty string.
+func (l *link) validateTopics() string {
+	inputs := make(map[string]bool)
+	// first maps the input topics to their first entry, which the entries
+	// sharing the topic are the siblings of
+	first := make(map[string]int)
+	for i := range l.topics {
+		t := &l.topics[i]
+		if len(t.intopic) == 0 {
+			return fmt.Sprintf("Error: %s entry %d is empty", configKeyInputTopics, i+1)
+		}
+		j, ok := first[t.intopic]
+		if !ok {
+			first[t.intopic] = i
+			inputs[t.intopic] = true
+			continue
+		}
+		// An input topic may only be listed again to extract another value
+		shared := &l.topics[j]
+		if t.wildcard || t.extract == nil || shared.extract == nil {
+			return fmt.Sprintf("Error: %s lists %s more than once, which requires an %s for each entry", configKeyInputTopics, t.intopic, configKeyExtractRegex)
+		}
+		for _, sibling := range append([]int{j}, shared.siblings...) {
+			if l.topics[sibling].extract.String() == t.extract.String() {
+				return fmt.Sprintf("Error: %s lists %s more than once with the same %s", configKeyInputTopics, t.intopic, configKeyExtractRegex)
+			}
+		}
+		shared.shared, t.shared = true, true
+		shared.siblings = append(shared.siblings, i)
+	}
+	if l.pair != nil {
+		inputs[l.pair.intopics[0]] = true
+		inputs[l.pair.intopics[1]] = true
+	}
+	if inputs[resetTopic] {
+		return fmt.Sprintf("Error: %s is reserved for resetting the diff state", resetTopic)
+	}
+
+	l.outputs = nil
+	sources := make(map[string]string)
+	status := ""
+	l.eachOutput(func(outtopic, source string) {
+		switch {
+		case len(status) > 0:
+		case outtopic == resetTopic:
+			status = fmt.Sprintf("Error: Output topic %s of %s is reserved for resetting the diff state", outtopic, source)
+		case inputs[outtopic]:
+			status = fmt.Sprintf("Error: Output topic %s is also an input topic, which would feed back into itself", outtopic)
+		case len(sources[outtopic]) > 0:
+			status = fmt.Sprintf("Error: The outputs of %s and %s collide on %s", sources[outtopic], source, outtopic)
+		default:
+			sources[outtopic] = source
+			l.outputs = append(l.outputs, outtopic)
+		}
+	})
+	return status
+}
+
+// eachOutput calls fn with every topic the device may publish to, other
+// than those of topics matched by wildcards and of the fields of
+// JsonAllFields topics, which match and field leave out instead, along
+// with the input topic or config key it publishes for
+func (l *link) eachOutput(fn func(outtopic, source string)) {
+	for _, t := range l.topics {
+		if t.template() {
+			continue
+		}
+		fn(t.outtopic, t.intopic)
+		fn(t.outtopic+statusTopicSuffix, t.intopic)
+		if t.mode == modeMinMax {
+			fn(t.outtopic+minTopicSuffix, t.intopic)
+			fn(t.outtopic+maxTopicSuffix, t.intopic)
+		}
+	}
+	if l.pair != nil {
+		fn(l.pair.outtopic, configKeyPairDiff)
+		fn(l.pair.outtopic+statusTopicSuffix, configKeyPairDiff)
+	}
+	if l.publisherrors {
+		fn(errorTopic, configKeyPublishErrors)
+	}
+	if l.publishstats {
+		fn(statsTopic, configKeyPublishStats)
+	}
+	if len(l.combined) > 0 {
+		fn(l.combined, configKeyCombinedOutput)
+	}
+}
+
+// feedsBack reports whether topic, delivered as the input intopic, is one of
+// the device's own outputs instead. Messages may carry the full topic, so
+// the trailing levels are compared.
+func (l *link) feedsBack(intopic, topic string) bool {
+	if hasTopicSuffix(topic, intopic) {
+		return false
+	}
+	for _, outtopic := range l.outputs {
+		if hasTopicSuffix(topic, outtopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTopicSuffix reports whether the trailing levels of topic are suffix
+func hasTopicSuffix(topic, suffix string) bool {
+	if !strings.HasSuffix(topic, suffix) {
+		return false
+	}
+	return len(topic) == len(suffix) || topic[len(topic)-len(suffix)-1] == '/'
+}
+
+// linkStatus is the status reported for a successfully parsed link config.
+// It spells out the order the output options apply in when Invert makes it
+// matter.
+func (l *link) linkStatus() string {
+	for _, t := range l.topics {
+		if t.invert {
+			return "Success: diffs are inverted, then scaled, then made absolute"
+		}
+	}
+	return "Success"
+}
+
+// listKeys are the config keys whose values are lists, with the separators
+// of their entries
+var listKeys = []struct {
+	key        string
+	separators string
+}{
+	{configKeyInputTopics, listSeparators},
+	{configKeyOutputTopics, listSeparators},
+	{configKeyMaxValue, listSeparators},
+	{configKeyCounterBits, listSeparators},
+	{configKeyMode, listSeparators},
+	{configKeyModes, listSeparators},
+	{configKeyAbsolute, listSeparators},
+	{configKeyScale, listSeparators},
+	{configKeyJSONField, listSeparators},
+	{configKeyArrayDiff, listSeparators},
+	{configKeyOutputInteger, listSeparators},
+	{configKeyInvert, listSeparators},
+	{configKeyInitialValues, listSeparators},
+	{configKeyConvert, convertSeparators},
+	{configKeyPairDiff, listSeparators},
+	{configKeyIgnoreValues, listSeparators},
+	{configKeyValidMin, listSeparators},
+	{configKeyValidMax, listSeparators},
+	{configKeyExtractRegex, regexSeparators},
+	{configKeyEncoding, listSeparators},
+	{configKeyPayloadOffset, listSeparators},
+	{configKeyPayloadBase64, listSeparators},
+	{configKeyJSONPath, listSeparators},
+	{configKeyJSONAllFields, listSeparators},
+	{configKeyPayloadFormat, listSeparators},
+}
+
+// topicListKeys are the list keys with an entry per input topic
+var topicListKeys = []string{
+	configKeyOutputTopics,
+	configKeyMaxValue,
+	configKeyCounterBits,
+	configKeyModes,
+	configKeyAbsolute,
+	configKeyScale,
+	configKeyJSONField,
+	configKeyArrayDiff,
+	configKeyOutputInteger,
+	configKeyInvert,
+	configKeyInitialValues,
+	configKeyConvert,
+	configKeyValidMin,
+	configKeyValidMax,
+	configKeyExtractRegex,
+	configKeyEncoding,
+	configKeyPayloadOffset,
+	configKeyPayloadBase64,
+	configKeyJSONPath,
+	configKeyJSONAllFields,
+	configKeyPayloadFormat,
+}
+
+// checkTopicLists returns the error status for the first per-topic list of
+// lists that has more than one entry but not one per input topic, so that a
+// list and InputTopics out of step are not applied to the wrong topics, or
+// else an empty string
+func checkTopicLists(lists map[string][]string) string {
+	topics := len(lists[configKeyInputTopics])
+	for _, key := range topicListKeys {
+		if entries := len(lists[key]); entries > 1 && entries != topics {
+			return fmt.Sprintf("Error: %s has %d entries but %s has %d", key, entries, configKeyInputTopics, topics)
+		}
+	}
+	return ""
+}
+
+// diffOptionScope describes the topics that apply the options of
+// consecutive diffs, for configuration errors
+var diffOptionScope = fmt.Sprintf("only applies to %s, %s, %s, and %s topics, except %s over a %s and %s topics", modeDiff, modeRate, modeCounter, modeDiff2, modeDiff, configKeyWindow, configKeyArrayDiff)
+
+// consecutiveDiff reports whether the processor of t diffs consecutive
+// samples, which is the only one applying options such as MaxJump. A diff
+// over a window diffs against the oldest sample instead.
+func (l *link) consecutiveDiff(t *topic) bool {
+	if t.arraydiff {
+		return false
+	}
+	switch t.mode {
+	case modeRate, modeCounter, modeDiff2:
+		return true
+	case modeDiff:
+		return l.window == 0
+	}
+	return false
+}
+
+// validMode reports whether mode is one of the accepted Mode values
+func validMode(mode string) bool {
+	for _, name := range modeNames {
+		if mode == name {
+			return true
+		}
+	}
+	return false
+}
+
+// topicEntry returns the entry of list for the topic at index i.
+// A list with a single entry applies to every topic.
+func topicEntry(list []string, i int) string {
+	if len(list) == 1 {
+		return list[0]
+	}
+	if i < len(list) {
+		return list[i]
+	}
+	return ""
+}
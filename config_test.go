@@ -0,0 +1,352 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configure parses config into a new link, returning the error status or
+// an empty string
+func configure(config map[string]string) (*link, string) {
+	l := new(link)
+	return l, l.configure(log.WithField("deviceid", "device"), config, testOptions())
+}
+
+func TestConfigureValidatesTopics(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		// status is a part of the status expected, or empty for success
+		status string
+	}{
+		{
+			name:   "no input topics",
+			config: map[string]string{configKeyInputTopics: ""},
+			status: "InputTopics",
+		},
+		{
+			name:   "empty entry",
+			config: map[string]string{configKeyInputTopics: "a,,b"},
+			status: "InputTopics entry 2 is empty",
+		},
+		{
+			name:   "duplicate input topics",
+			config: map[string]string{configKeyInputTopics: "a, b, a"},
+			status: "InputTopics lists a more than once",
+		},
+		{
+			name:   "reset topic as an input",
+			config: map[string]string{configKeyInputTopics: "a, " + resetTopic},
+			status: resetTopic + " is reserved",
+		},
+		{
+			name:   "reset topic as a pair input",
+			config: map[string]string{configKeyInputTopics: "a", configKeyPairDiff: "b, " + resetTopic},
+			status: resetTopic + " is reserved",
+		},
+		{
+			name:   "reset topic as an output",
+			config: map[string]string{configKeyInputTopics: "a", configKeyOutputTopics: resetTopic},
+			status: "Output topic " + resetTopic + " of a is reserved",
+		},
+		{
+			name:   "reset topic as the pair output",
+			config: map[string]string{configKeyInputTopics: "a", configKeyPairDiff: "b, c", configKeyPairOutput: resetTopic},
+			status: "Output topic " + resetTopic + " of PairDiff is reserved",
+		},
+		{
+			name:   "output topic is an input topic",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "b"},
+			status: "Output topic b is also an input topic",
+		},
+		{
+			name:   "suffix makes an output an input topic",
+			config: map[string]string{configKeyInputTopics: "a, a_diff"},
+			status: "Output topic a_diff is also an input topic",
+		},
+		{
+			name:   "more output topics than input topics",
+			config: map[string]string{configKeyInputTopics: "a", configKeyOutputTopics: "x, y"},
+			status: "OutputTopics has 2 entries but InputTopics has 1",
+		},
+		{
+			name:   "fewer per-topic entries than input topics",
+			config: map[string]string{configKeyInputTopics: "a, b, c", configKeyAbsolute: "true, false"},
+			status: "Absolute has 2 entries but InputTopics has 3",
+		},
+		{
+			name:   "more per-topic entries than input topics",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyCounterBits: "8, 16, 32"},
+			status: "CounterBits has 3 entries but InputTopics has 2",
+		},
+		{
+			name:   "fewer modes than input topics",
+			config: map[string]string{configKeyInputTopics: "a, b, c", configKeyModes: "rate, counter"},
+			status: "Modes has 2 entries but InputTopics has 3",
+		},
+		{
+			name:   "list of modes in Mode",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyMode: "diff, rate"},
+			status: "Mode takes a single mode for all topics",
+		},
+		{
+			name:   "windowed mode from Mode",
+			config: map[string]string{configKeyInputTopics: "a", configKeyMode: modeAvg},
+			status: "Mode avg for a requires Window",
+		},
+		{
+			name:   "windowed mode from Modes",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyModes: "diff, avg"},
+			status: "Modes avg for b requires Window",
+		},
+		{
+			name:   "valid",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "x"},
+		},
+		{
+			name:   "valid per-topic lists",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyScale: "2", configKeyInvert: "true, false", configKeyModes: "rate,"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, status := configure(test.config)
+			if len(test.status) == 0 {
+				if len(status) > 0 {
+					t.Errorf("got status %q, want success", status)
+				}
+				return
+			}
+			if !strings.HasPrefix(status, "Error: ") || !strings.Contains(status, test.status) {
+				t.Errorf("got status %q, want an error containing %q", status, test.status)
+			}
+		})
+	}
+}
+
+func TestConfigureRefusesCollidingOutputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		status string
+	}{
+		{
+			name:   "explicit duplicates",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "x, x"},
+			status: "The outputs of a and b collide on x",
+		},
+		{
+			name:   "explicit output equal to a generated one",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "b_diff"},
+			status: "The outputs of a and b collide on b_diff",
+		},
+		{
+			name:   "prefixed outputs",
+			config: map[string]string{configKeyInputTopics: "a/x, b/x", configKeyOutputPrefix: "out/", configKeyOutputTopics: "out/b/x_diff"},
+			status: "The outputs of a/x and b/x collide on out/b/x_diff",
+		},
+		{
+			name:   "status suffix",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "x, x" + statusTopicSuffix},
+			status: "The outputs of a and b collide on x" + statusTopicSuffix,
+		},
+		{
+			name:   "minmax suffixes",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyModes: "minmax, diff", configKeyOutputTopics: "x, x" + maxTopicSuffix},
+			status: "The outputs of a and b collide on x" + maxTopicSuffix,
+		},
+		{
+			name:   "pair output",
+			config: map[string]string{configKeyInputTopics: "a", configKeyPairDiff: "b, c", configKeyPairOutput: "a_diff"},
+			status: "The outputs of a and PairDiff collide on a_diff",
+		},
+		{
+			name:   "stats topic",
+			config: map[string]string{configKeyInputTopics: "a", configKeyOutputTopics: statsTopic, configKeyPublishStats: "true"},
+			status: "The outputs of a and PublishStats collide on " + statsTopic,
+		},
+		{
+			name:   "error topic",
+			config: map[string]string{configKeyInputTopics: "a", configKeyOutputTopics: errorTopic, configKeyPublishErrors: "true"},
+			status: "The outputs of a and PublishErrors collide on " + errorTopic,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, status := configure(test.config); status != "Error: "+test.status {
+				t.Errorf("got status %q, want %q", status, "Error: "+test.status)
+			}
+		})
+	}
+}
+
+func TestConfigureAcceptsDistinctOutputs(t *testing.T) {
+	for _, config := range []map[string]string{
+		{configKeyInputTopics: "a, b", configKeyOutputTopics: "x, y"},
+		{configKeyInputTopics: "a/x, b/x"},
+		{configKeyInputTopics: "a, b", configKeyModes: "minmax, diff", configKeyOutputTopics: "x, x_diff"},
+		{configKeyInputTopics: "a", configKeyPairDiff: "b, c", configKeyPublishStats: "true", configKeyPublishErrors: "true"},
+	} {
+		if _, status := configure(config); len(status) > 0 {
+			t.Errorf("%v: got status %q", config, status)
+		}
+	}
+}
+
+func TestConfigureExtractRegexList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{`T=(\d{1,3})`, []string{`T=(\d{1,3})`}},
+		{`T=(\d{1,3}); H=(\d+)`, []string{`T=(\d{1,3})`, `H=(\d+)`}},
+		{"T=(\\d{1,3})\nH=(\\d+)", []string{`T=(\d{1,3})`, `H=(\d+)`}},
+		{`"a;b=(\d)"; H=(\d+)`, []string{`a;b=(\d)`, `H=(\d+)`}},
+	}
+	for _, test := range tests {
+		config := map[string]string{
+			configKeyInputTopics:  "a, b",
+			configKeyExtractRegex: test.value,
+		}
+		if len(test.want) == 1 {
+			config[configKeyInputTopics] = "a"
+		}
+		l, status := configure(config)
+		if len(status) > 0 {
+			t.Errorf("%q: got status %q", test.value, status)
+			continue
+		}
+		var got []string
+		for _, t := range l.topics {
+			got = append(got, t.extract.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got expressions %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestConfigureRefusesIgnoredDiffOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		status string
+	}{
+		{
+			name:   "MaxJump in sum mode",
+			config: map[string]string{configKeyInputTopics: "a", configKeyMode: modeSum, configKeyMaxJump: "5"},
+			status: "MaxJump " + diffOptionScope,
+		},
+		{
+			name:   "MaxJump over a window",
+			config: map[string]string{configKeyInputTopics: "a", configKeyWindow: "5", configKeyMaxJump: "5"},
+			status: "MaxJump " + diffOptionScope,
+		},
+		{
+			name:   "MaxJump of an array topic",
+			config: map[string]string{configKeyInputTopics: "a", configKeyArrayDiff: "true", configKeyMaxJump: "5"},
+			status: "MaxJump " + diffOptionScope,
+		},
+		{
+			name:   "MinDiff over a window",
+			config: map[string]string{configKeyInputTopics: "a", configKeyWindow: "5", configKeyMinDiff: "1"},
+			status: "MinDiff " + diffOptionScope,
+		},
+		{
+			name:   "MinDiff in avg mode",
+			config: map[string]string{configKeyInputTopics: "a", configKeyMode: modeAvg, configKeyWindow: "5", configKeyMinDiff: "1"},
+			status: "MinDiff " + diffOptionScope,
+		},
+		{
+			name:   "MaxValue of an integrate topic",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyModes: "counter, integrate", configKeyMaxValue: "100, 100"},
+			status: "MaxValue for b " + diffOptionScope,
+		},
+		{
+			name:   "shared CounterBits in avg mode",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyMode: modeAvg, configKeyWindow: "5", configKeyCounterBits: "16"},
+			status: "CounterBits " + diffOptionScope,
+		},
+		{
+			name:   "CounterBits of an array topic",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyArrayDiff: "false, true", configKeyCounterBits: "16, 16"},
+			status: "CounterBits for b " + diffOptionScope,
+		},
+		{
+			name:   "PublishFirstSample in rate mode",
+			config: map[string]string{configKeyInputTopics: "a", configKeyMode: modeRate, configKeyPublishFirst: "true"},
+			status: "PublishFirstSample only applies to diff, counter, and integrate topics",
+		},
+		{
+			name:   "PublishFirstSample over a window",
+			config: map[string]string{configKeyInputTopics: "a", configKeyWindow: "5", configKeyPublishFirst: "true"},
+			status: "PublishFirstSample only applies to diff, counter, and integrate topics",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, status := configure(test.config); !strings.HasPrefix(status, "Error: "+test.status) {
+				t.Errorf("got status %q, want %q", status, "Error: "+test.status)
+			}
+		})
+	}
+}
+
+func TestConfigureAcceptsDiffOptions(t *testing.T) {
+	for _, config := range []map[string]string{
+		{configKeyInputTopics: "a", configKeyMaxJump: "5"},
+		{configKeyInputTopics: "a, b", configKeyModes: "sum, rate", configKeyMaxJump: "5"},
+		{configKeyInputTopics: "a", configKeyMinDiff: "1"},
+		{configKeyInputTopics: "a, b", configKeyModes: "avg, counter", configKeyWindow: "5", configKeyMinDiff: "1"},
+		{configKeyInputTopics: "a", configKeyMaxValue: "100"},
+		{configKeyInputTopics: "a, b", configKeyModes: "counter, integrate", configKeyMaxValue: "100,"},
+		{configKeyInputTopics: "a, b", configKeyModes: "sum, counter", configKeyCounterBits: "16"},
+		{configKeyInputTopics: "a, b", configKeyModes: "counter, sum", configKeyCounterBits: "16,"},
+		{configKeyInputTopics: "a", configKeyPublishFirst: "true"},
+		{configKeyInputTopics: "a", configKeyMode: modeIntegrate, configKeyPublishFirst: "true"},
+		{configKeyInputTopics: "a", configKeyWindow: "5", configKeyPublishFirst: "false"},
+	} {
+		if _, status := configure(config); len(status) > 0 {
+			t.Errorf("%v: got status %q", config, status)
+		}
+	}
+}
+
+func TestConfigureRefusesNonFiniteClamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		status string
+	}{
+		{
+			name:   "NaN ClampMin",
+			config: map[string]string{configKeyInputTopics: "a", configKeyClampMin: "NaN"},
+			status: "ClampMin must be a finite number",
+		},
+		{
+			name:   "Inf ClampMin",
+			config: map[string]string{configKeyInputTopics: "a", configKeyClampMin: "-Inf"},
+			status: "ClampMin must be a finite number",
+		},
+		{
+			name:   "NaN ClampMax",
+			config: map[string]string{configKeyInputTopics: "a", configKeyClampMax: "NaN"},
+			status: "ClampMax must be a finite number",
+		},
+		{
+			name:   "Inf ClampMax",
+			config: map[string]string{configKeyInputTopics: "a", configKeyClampMax: "Inf"},
+			status: "ClampMax must be a finite number",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, status := configure(test.config); status != "Error: "+test.status {
+				t.Errorf("got status %q, want %q", status, "Error: "+test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// reloadableFlags are the flags a SIGHUP applies without a restart
+var reloadableFlags = map[string]bool{
+	"log-level":         true,
+	"log-format":        true,
+	"default-precision": true,
+	"default-republish": true,
+}
+
+// configFile is the YAML file named by the config flag, which sets the flags
+// that were given neither on the command line nor in the environment. The
+// file is a mapping from flag names to values, such as:
+//
+//	framework-server: https://api.openchirp.io
+//	log-level: 4
+type configFile struct {
+	path string
+	// overridden are the flags given on the command line or in the
+	// environment, which the file does not change
+	overridden map[string]bool
+}
+
+// loadConfigFile reads the config file, if any, into the unset flags
+func loadConfigFile(ctx *cli.Context) (*configFile, error) {
+	f := &configFile{
+		path:       ctx.String("config"),
+		overridden: make(map[string]bool),
+	}
+	if len(f.path) == 0 {
+		return f, nil
+	}
+
+	for name, envvar := range flagEnvVars(ctx.App.Flags) {
+		if ctx.IsSet(name) {
+			f.overridden[name] = true
+		} else if _, ok := os.LookupEnv(envvar); ok && len(envvar) > 0 {
+			f.overridden[name] = true
+		}
+	}
+
+	values, err := f.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if err := f.set(ctx, value); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// reload reads the config file again and returns the names of the
+// reloadable flags it changed. Changes to other flags are only logged,
+// since they require a restart. Keys removed from the file keep their
+// current value, and a file with an invalid value changes nothing.
+func (f *configFile) reload(ctx *cli.Context) ([]string, error) {
+	if len(f.path) == 0 {
+		return nil, nil
+	}
+
+	values, err := f.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Every value is checked before any is set, so an invalid one leaves
+	// all the settings as they were
+	for _, value := range values {
+		if err := f.check(ctx, value); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []string
+	for _, value := range values {
+		old := ctx.String(value.name)
+		if err := f.set(ctx, value); err != nil {
+			return changed, err
+		}
+		if ctx.String(value.name) == old {
+			continue
+		}
+		if !reloadableFlags[value.name] {
+			log.Warnf("Changing %s in %s requires a restart", value.name, f.path)
+			ctx.Set(value.name, old)
+			continue
+		}
+		changed = append(changed, value.name)
+	}
+	return changed, nil
+}
+
+// configValue is a flag value read from the config file
+type configValue struct {
+	name  string
+	value string
+	line  int
+}
+
+// read parses the config file and checks that it only sets known flags.
+// Overridden flags are left out.
+func (f *configFile) read(ctx *cli.Context) ([]configValue, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	if len(doc.Content) == 0 {
+		// Empty file
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of flag names to values", f.path, root.Line)
+	}
+
+	envvars := flagEnvVars(ctx.App.Flags)
+	var values []configValue
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if _, ok := envvars[key.Value]; !ok || key.Value == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown key \"%s\"", f.path, key.Line, key.Value)
+		}
+		if value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s:%d: key \"%s\" must have a single value", f.path, value.Line, key.Value)
+		}
+
+		// Flags and environment variables take precedence
+		if f.overridden[key.Value] {
+			continue
+		}
+		values = append(values, configValue{name: key.Value, value: value.Value, line: value.Line})
+	}
+	return values, nil
+}
+
+// check parses the value read from the config file as its flag would,
+// without setting the flag
+func (f *configFile) check(ctx *cli.Context, value configValue) error {
+	var err error
+	switch flagNamed(ctx.App.Flags, value.name).(type) {
+	case cli.IntFlag:
+		_, err = strconv.ParseInt(value.value, 0, strconv.IntSize)
+	case cli.BoolFlag, cli.BoolTFlag:
+		_, err = strconv.ParseBool(value.value)
+	case cli.DurationFlag:
+		_, err = time.ParseDuration(value.value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s:%d: invalid value \"%s\" for key \"%s\": %v", f.path, value.line, value.value, value.name, err)
+	}
+	return nil
+}
+
+// set sets the flag to the value read from the config file
+func (f *configFile) set(ctx *cli.Context, value configValue) error {
+	if err := ctx.Set(value.name, value.value); err != nil {
+		return fmt.Errorf("%s:%d: invalid value \"%s\" for key \"%s\": %v", f.path, value.line, value.value, value.name, err)
+	}
+	return nil
+}
+
+// flagNamed returns the flag of flags with name, or nil if there is none
+func flagNamed(flags []cli.Flag, name string) cli.Flag {
+	for _, flag := range flags {
+		if flag.GetName() == name {
+			return flag
+		}
+	}
+	return nil
+}
+
+// flagEnvVars maps the names of flags to their environment variable
+func flagEnvVars(flags []cli.Flag) map[string]string {
+	envvars := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		switch f := flag.(type) {
+		case cli.StringFlag:
+			envvars[f.Name] = f.EnvVar
+		case cli.IntFlag:
+			envvars[f.Name] = f.EnvVar
+		case cli.BoolFlag:
+			envvars[f.Name] = f.EnvVar
+		case cli.BoolTFlag:
+			envvars[f.Name] = f.EnvVar
+		case cli.DurationFlag:
+			envvars[f.Name] = f.EnvVar
+		}
+	}
+	return envvars
+}
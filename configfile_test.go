@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// configFileContext returns a context with a few reloadable flags and one
+// that requires a restart, reading the config file at path
+func configFileContext(t *testing.T, path string) *cli.Context {
+	t.Helper()
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "config"},
+		cli.IntFlag{Name: "log-level", Value: 4},
+		cli.IntFlag{Name: "default-precision", Value: defaultPrecision},
+		cli.DurationFlag{Name: "default-republish"},
+		cli.StringFlag{Name: "mqtt-server", Value: "tcp://localhost:1883"},
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range app.Flags {
+		f.Apply(set)
+	}
+	if err := set.Set("config", path); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(app, set, nil)
+}
+
+// writeConfigFile replaces the contents of the config file at path
+func writeConfigFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "log-level: 4\ndefault-precision: 2\n")
+	ctx := configFileContext(t, path)
+	f, err := loadConfigFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfigFile(t, path, "log-level: 5\ndefault-precision: 3\nmqtt-server: tcp://broker:1883\n")
+	changed, err := f.reload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"log-level", "default-precision"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("got changed %v, want %v", changed, want)
+	}
+	if server := ctx.String("mqtt-server"); server != "tcp://localhost:1883" {
+		t.Errorf("got mqtt-server %s, want it unchanged until a restart", server)
+	}
+}
+
+func TestConfigFileReloadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "log-level: 4\ndefault-precision: 2\n")
+	ctx := configFileContext(t, path)
+	f, err := loadConfigFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contents := range []string{
+		"log-level: 5\ndefault-precision: 3\ndefault-republish: soon\n",
+		"log-level: 5\ndefault-precision: two\n",
+		"log-level: 5\nunknown: 1\n",
+	} {
+		writeConfigFile(t, path, contents)
+		if changed, err := f.reload(ctx); err == nil || len(changed) > 0 {
+			t.Errorf("%q: got changed %v, error %v, want only an error", contents, changed, err)
+		}
+		if level, precision := ctx.Int("log-level"), ctx.Int("default-precision"); level != 4 || precision != 2 {
+			t.Errorf("%q: got log-level %d and default-precision %d, want 4 and 2", contents, level, precision)
+		}
+	}
+}
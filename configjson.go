@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// topicConfig is an entry of ConfigJSON, which configures one input topic.
+// Fields left out fall back to the link-wide keys and defaults, as empty
+// entries of the per-topic lists do.
+type topicConfig struct {
+	In          string   `json:"in"`
+	Out         string   `json:"out"`
+	Mode        string   `json:"mode"`
+	Scale       *float64 `json:"scale"`
+	Convert     string   `json:"convert"`
+	Initial     *float64 `json:"initial"`
+	MaxValue    *float64 `json:"maxvalue"`
+	CounterBits *int     `json:"counterbits"`
+	Absolute    *bool    `json:"absolute"`
+	Invert      *bool    `json:"invert"`
+	Integer     *bool    `json:"integer"`
+	ArrayDiff   *bool    `json:"arraydiff"`
+	JSONField   string   `json:"jsonfield"`
+	ValidMin    *float64 `json:"validmin"`
+	ValidMax    *float64 `json:"validmax"`
+	Extract     string   `json:"extractregex"`
+	Encoding    string   `json:"encoding"`
+	Offset      *int     `json:"offset"`
+	Base64      *bool    `json:"base64"`
+	JSONPath    string   `json:"jsonpath"`
+	AllFields   *bool    `json:"allfields"`
+	Format      string   `json:"format"`
+}
+
+// expandConfigJSON returns config with the per-topic lists built from its
+// ConfigJSON entries, which replace any lists config sets itself. A config
+// without ConfigJSON is returned as is. The error to report is returned if
+// ConfigJSON is invalid, or else an empty string.
+func expandConfigJSON(logitem *log.Entry, config map[string]string) (map[string]string, string) {
+	value := strings.TrimSpace(config[configKeyConfigJSON])
+	if len(value) == 0 {
+		return config, ""
+	}
+
+	var topics []topicConfig
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&topics); err != nil {
+		logitem.Warnf("Failed to parse %s value \"%s\": %v", configKeyConfigJSON, value, err)
+		return nil, fmt.Sprintf("Error: %s %s", configKeyConfigJSON, describeJSONError(value, err))
+	}
+	if decoder.More() {
+		return nil, fmt.Sprintf("Error: %s must be a single JSON array", configKeyConfigJSON)
+	}
+
+	lists := make(map[string][]string)
+	for i, t := range topics {
+		if len(strings.TrimSpace(t.In)) == 0 {
+			return nil, fmt.Sprintf("Error: %s entry %d has no \"in\" topic", configKeyConfigJSON, i+1)
+		}
+		for key, entry := range map[string]string{
+			configKeyInputTopics:   t.In,
+			configKeyOutputTopics:  t.Out,
+			configKeyModes:         t.Mode,
+			configKeyScale:         formatOptionalFloat(t.Scale),
+			configKeyConvert:       t.Convert,
+			configKeyInitialValues: formatOptionalFloat(t.Initial),
+			configKeyMaxValue:      formatOptionalFloat(t.MaxValue),
+			configKeyCounterBits:   formatOptionalInt(t.CounterBits),
+			configKeyAbsolute:      formatOptionalBool(t.Absolute),
+			configKeyInvert:        formatOptionalBool(t.Invert),
+			configKeyOutputInteger: formatOptionalBool(t.Integer),
+			configKeyArrayDiff:     formatOptionalBool(t.ArrayDiff),
+			configKeyJSONField:     t.JSONField,
+			configKeyValidMin:      formatOptionalFloat(t.ValidMin),
+			configKeyValidMax:      formatOptionalFloat(t.ValidMax),
+			configKeyExtractRegex:  t.Extract,
+			configKeyEncoding:      t.Encoding,
+			configKeyPayloadOffset: formatOptionalInt(t.Offset),
+			configKeyPayloadBase64: formatOptionalBool(t.Base64),
+			configKeyJSONPath:      t.JSONPath,
+			configKeyJSONAllFields: formatOptionalBool(t.AllFields),
+			configKeyPayloadFormat: t.Format,
+		} {
+			if len(entry) > 0 && len(lists[key]) < i {
+				// Pad the entries of the topics that left it out
+				lists[key] = append(lists[key], make([]string, i-len(lists[key]))...)
+			}
+			if len(entry) > 0 || len(lists[key]) > 0 {
+				lists[key] = append(lists[key], entry)
+			}
+		}
+	}
+
+	expanded := make(map[string]string, len(config))
+	for key, value := range config {
+		expanded[key] = value
+	}
+	for _, key := range configJSONKeys {
+		if len(strings.TrimSpace(config[key])) > 0 {
+			logitem.Warnf("Ignoring %s, since %s is set", key, configKeyConfigJSON)
+		}
+		delete(expanded, key)
+		if entries, ok := lists[key]; ok {
+			expanded[key] = joinList(entries, listKeySeparator(key))
+		}
+	}
+	return expanded, ""
+}
+
+// configJSONKeys are the per-topic keys ConfigJSON replaces
+var configJSONKeys = []string{
+	configKeyInputTopics,
+	configKeyOutputTopics,
+	configKeyModes,
+	configKeyScale,
+	configKeyConvert,
+	configKeyInitialValues,
+	configKeyMaxValue,
+	configKeyCounterBits,
+	configKeyAbsolute,
+	configKeyInvert,
+	configKeyOutputInteger,
+	configKeyArrayDiff,
+	configKeyJSONField,
+	configKeyValidMin,
+	configKeyValidMax,
+	configKeyExtractRegex,
+	configKeyEncoding,
+	configKeyPayloadOffset,
+	configKeyPayloadBase64,
+	configKeyJSONPath,
+	configKeyJSONAllFields,
+	configKeyPayloadFormat,
+}
+
+// describeJSONError describes err decoding text, with the line and column
+// it occurred at when known
+func describeJSONError(text string, err error) string {
+	var offset int64
+	message := err.Error()
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+		// The error names Go types, which mean nothing to the device owner
+		want := "a string"
+		switch err.Type.Kind() {
+		case reflect.Float64, reflect.Int:
+			want = "a number"
+		case reflect.Bool:
+			want = "true or false"
+		case reflect.Slice:
+			want = "an array of objects"
+		case reflect.Struct:
+			want = "an object"
+		}
+		message = fmt.Sprintf("expected %s, not a JSON %s", want, err.Value)
+	default:
+		return fmt.Sprintf("is invalid: %s", message)
+	}
+	if offset > int64(len(text)) {
+		offset = int64(len(text))
+	}
+	before := text[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := len(before) - strings.LastIndex(before, "\n")
+	return fmt.Sprintf("is invalid at line %d, column %d: %s", line, column, message)
+}
+
+// joinList renders entries as a list separated by the first of separators,
+// quoting them so any separators or whitespace they contain survive
+func joinList(entries []string, separators string) string {
+	var buf bytes.Buffer
+	for i, entry := range entries {
+		if i > 0 {
+			buf.WriteByte(separators[0])
+		}
+		if len(entry) == 0 {
+			continue
+		}
+		buf.WriteByte('"')
+		for j := 0; j < len(entry); j++ {
+			if entry[j] == '"' || entry[j] == '\\' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(entry[j])
+		}
+		buf.WriteByte('"')
+	}
+	return buf.String()
+}
+
+// listKeySeparator returns the separators of the list key
+func listKeySeparator(key string) string {
+	for _, list := range listKeys {
+		if list.key == key {
+			return list.separators
+		}
+	}
+	return listSeparators
+}
+
+// formatOptionalFloat renders v, or an empty entry if it is nil
+func formatOptionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'g', -1, 64)
+}
+
+// formatOptionalInt renders v, or an empty entry if it is nil
+func formatOptionalInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+// formatOptionalBool renders v, or an empty entry if it is nil
+func formatOptionalBool(v *bool) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// conversionLinear prefixes a custom conversion of linear:scale,offset
+	conversionLinear = "linear:"
+)
+
+// conversion converts the input values of a topic to another unit before
+// any other processing, as value*scale + offset
+type conversion struct {
+	scale  float64
+	offset float64
+}
+
+// conversions are the built in Convert values
+var conversions = map[string]conversion{
+	"f2c":     {5.0 / 9, -32 * 5.0 / 9},
+	"c2f":     {9.0 / 5, 32},
+	"c2k":     {1, 273.15},
+	"k2c":     {1, -273.15},
+	"psi2kpa": {6.894757293168361, 0},
+	"kpa2psi": {1 / 6.894757293168361, 0},
+	"bar2kpa": {100, 0},
+	"kpa2bar": {0.01, 0},
+	"ft2m":    {0.3048, 0},
+	"m2ft":    {1 / 0.3048, 0},
+	"mph2kmh": {1.609344, 0},
+	"kmh2mph": {1 / 1.609344, 0},
+}
+
+// conversionNames returns the sorted names of the built in conversions
+func conversionNames() []string {
+	names := make([]string, 0, len(conversions))
+	for name := range conversions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseConversion parses a Convert value, either the name of a built in
+// conversion or linear:scale,offset
+func parseConversion(value string) (*conversion, error) {
+	value = strings.ToLower(value)
+	if c, ok := conversions[value]; ok {
+		return &c, nil
+	}
+	if !strings.HasPrefix(value, conversionLinear) {
+		return nil, fmt.Errorf("unknown conversion %q", value)
+	}
+	params := strings.Split(strings.TrimPrefix(value, conversionLinear), ",")
+	if len(params) != 2 {
+		return nil, fmt.Errorf("linear conversion %q needs a scale and offset", value)
+	}
+	for i := range params {
+		params[i] = strings.TrimSpace(params[i])
+	}
+	scale, err := strconv.ParseFloat(params[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid linear scale %q", params[0])
+	}
+	offset, err := strconv.ParseFloat(params[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid linear offset %q", params[1])
+	}
+	return &conversion{scale: scale, offset: offset}, nil
+}
+
+// apply converts value, or returns it as is if c is nil
+func (c *conversion) apply(value float64) float64 {
+	if c == nil {
+		return value
+	}
+	return value*c.scale + c.offset
+}
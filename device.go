@@ -0,0 +1,1484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openchirp/framework"
+	"github.com/openchirp/framework/utils"
+	"github.com/openchirp/math-diff-service/internal/processor"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// topic holds the configuration and running state of a single input topic
+type topic struct {
+	intopic  string
+	outtopic string
+	// index is the position of the topic in InputTopics
+	index int
+	// mode selects the processing applied to the topic
+	mode string
+	// maxvalue is the value at which the counter wraps, or 0 if it never wraps
+	maxvalue float64
+	// counterbits is the width the counter wraps at instead, or 0 if unused
+	counterbits int
+	// convert converts the inputs before any other processing, if set
+	convert *conversion
+	// absolute publishes the magnitude of the diff
+	absolute bool
+	// invert publishes the previous minus the current value
+	invert bool
+	// scale is multiplied into the published value
+	scale float64
+	// integer rounds the published value to the nearest integer
+	integer bool
+	// jsonpath is the path of the numeric field in JSON payloads, or nil
+	// for plain numeric payloads
+	jsonpath []jsonStep
+	// pathwarned is when a payload missing the value at jsonpath was last
+	// logged
+	pathwarned time.Time
+	// arraydiff diffs JSON arrays of numbers element by element
+	arraydiff bool
+	// extract finds the value in the payload as its first capture group,
+	// or is nil for payloads that are the value
+	extract *regexp.Regexp
+	// shared is set when other entries extract their values from the same
+	// input topic. Only the first of them is subscribed, and processes
+	// the messages of its siblings, the indexes of the others, after its
+	// own.
+	shared   bool
+	siblings []int
+	// encoding decodes binary payloads, which hold the value after offset
+	// bytes, or is nil for text payloads
+	encoding *payloadEncoding
+	offset   int
+	// base64 decodes the payloads from base64 before parsing them
+	base64 bool
+	// cbor decodes the payloads as CBOR, whose value is found at jsonpath
+	// like in JSON payloads
+	cbor bool
+	// validmin and validmax bound the inputs accepted, which are infinite
+	// if unbounded
+	validmin float64
+	validmax float64
+	// wildcard topics hold no state of their own. Each concrete topic they
+	// match gets its own topic in matches, keyed by the concrete topic.
+	wildcard bool
+	matches  map[string]*topic
+	// allfields topics diff every numeric field of their JSON payloads, and
+	// hold no state of their own either. Each field gets its own topic in
+	// matches, keyed by the field, which is set in the topic of the field.
+	allfields bool
+	field     string
+	// limitwarned is set once a wildcard or allfields topic was found to
+	// match more topics than the device may have
+	limitwarned bool
+
+	// state is the running state that proc computes the outputs from
+	state *processor.State
+	proc  processor.Processor
+	// logitem logs the decisions of proc
+	logitem *log.Entry
+	// smoothed is the running ewma of the input or output
+	smoothed float64
+	// unit is the unit stripped from the latest input, once unitseen
+	unit     string
+	unitseen bool
+	// median holds the latest inputs of the median filter, or is nil if
+	// unused
+	median *processor.Ring
+	// lastarray is the previous array in array diff mode
+	lastarray []float64
+	// seeding treats the next message as the retained message, which only
+	// seeds the state
+	seeding bool
+	// staletimer fires when the topic receives no message for StaleTimeout
+	// after staletouched, when it was last started or restarted
+	staletimer   *time.Timer
+	staletouched time.Time
+	// lastpayload is the last payload published, sent at lastsent
+	lastpayload string
+	lastsent    time.Time
+	// lastboxed is lastpayload converted for Publish, or nil if not yet
+	lastboxed interface{}
+	// lastextremes are the last _min and _max payloads of a minmax topic,
+	// which are republished and published in the combined output like
+	// lastpayload
+	lastextremes [2]string
+	// lastinput is when the topic last received a message
+	lastinput time.Time
+}
+
+// pairKey is the subscription key of the two PairDiff topics, distinguishing
+// them from the integer index keys of the regular input topics
+type pairKey int
+
+// resetKey is the subscription key of the reset command topic
+type resetKey struct{}
+
+// pair holds the configuration and latest values of the two topics whose
+// difference is published
+type pair struct {
+	intopics [2]string
+	outtopic string
+	// values are the latest values of each topic, or NaN until reported
+	values [2]float64
+	// lastpayload is the last difference published, sent at lastsent
+	lastpayload string
+	lastsent    time.Time
+}
+
+// reset clears the running state, so the topic starts over as if just linked
+func (t *topic) reset() {
+	t.state.Reset()
+	t.smoothed = math.NaN()
+	t.unit, t.unitseen = "", false
+	if t.median != nil {
+		t.median.Reset()
+	}
+	t.lastarray = nil
+	t.lastpayload = ""
+	t.lastboxed = nil
+	t.lastextremes = [2]string{}
+}
+
+// subscribed reports whether the input topic is subscribed for t, rather
+// than for the first entry sharing it
+func (t *topic) subscribed() bool {
+	return !t.shared || t.siblings != nil
+}
+
+// name identifies the topic in the saved state and statistics. Entries
+// sharing an input topic are told apart by their ExtractRegex, and the
+// fields of JsonAllFields topics by their key.
+func (t *topic) name() string {
+	if len(t.field) > 0 {
+		return t.intopic + fieldNameSeparator + t.field
+	}
+	if t.shared {
+		return t.intopic + "(" + t.extract.String() + ")"
+	}
+	return t.intopic
+}
+
+// carry takes over the running state of old, which was configured for the
+// same input topic. State that depends on the mode or window is only
+// kept when those are unchanged.
+func (t *topic) carry(old *topic) {
+	t.state.Last = old.state.Last
+	t.state.LastTime = old.state.LastTime
+	t.state.LastPublish = old.state.LastPublish
+	t.lastinput = old.lastinput
+	if t.median != nil && old.median != nil && t.median.Size() == old.median.Size() {
+		t.median = old.median
+	}
+	if t.mode != old.mode {
+		return
+	}
+	t.state.Pending = old.state.Pending
+	t.state.PendingSince = old.state.PendingSince
+	t.state.LastDiff = old.state.LastDiff
+	t.state.Sum = old.state.Sum
+	t.state.Period = old.state.Period
+	t.state.Samples = old.state.Samples
+	t.state.Min = old.state.Min
+	t.state.Max = old.state.Max
+	if t.state.Window != nil && old.state.Window != nil && t.state.Window.Size() == old.state.Window.Size() {
+		t.state.Window = old.state.Window
+	}
+	t.lastpayload = old.lastpayload
+	t.lastboxed = old.lastboxed
+	t.lastextremes = old.lastextremes
+	t.lastsent = old.lastsent
+	t.smoothed = old.smoothed
+	t.lastarray = old.lastarray
+}
+
+// newProcessor creates the processor for the mode of t, which computes its
+// outputs from the state of t
+func (l *link) newProcessor(t *topic) processor.Processor {
+	opts := processor.Options{
+		PublishFirst:  l.publishfirst,
+		MaxValue:      t.maxvalue,
+		CounterBits:   t.counterbits,
+		MaxJump:       l.maxjump,
+		MaxJumpResync: l.maxjumpresync,
+		MinDiff:       l.mindiff,
+		MinInterval:   l.mininterval,
+		WindowPartial: l.windowpartial,
+		MaxSamples:    l.maxpoints,
+		Log:           t.logitem,
+		Debugging:     debugging,
+	}
+	switch t.mode {
+	case modeRate:
+		return processor.NewRate(t.state, opts, l.rateunit)
+	case modeCounter:
+		return processor.NewCounter(t.state, opts, l.resetzero)
+	case modeSum:
+		return processor.NewSum(t.state, opts)
+	case modeDiff2:
+		return processor.NewDiff2(t.state, opts)
+	case modeAvg:
+		return processor.NewAvg(t.state, opts)
+	case modeIntegrate:
+		return processor.NewIntegrate(t.state, opts, l.timeunit)
+	case modePercentile:
+		return processor.NewPercentile(t.state, opts, l.percentile)
+	case modeEdges:
+		// Edge events default to rising edges, and counts to both
+		return processor.NewEdges(t.state, opts, l.edgetype != edgeFalling, l.edgetype == edgeFalling || l.edgetype == edgeBoth)
+	case modeEdgeCount:
+		return processor.NewEdgeCount(t.state, opts, l.edgetype != edgeFalling, l.edgetype != edgeRising)
+	case modeSlope:
+		return processor.NewSlope(t.state, opts, l.windowduration, l.rateunit)
+	case modeSignChange:
+		return processor.NewSignChange(t.state, opts, l.deadband)
+	case modeMinMax:
+		return processor.NewMinMax(t.state, opts, l.windowduration)
+	case modeStdDev:
+		return processor.NewStdDev(t.state, opts)
+	case modeDaily:
+		return processor.NewDaily(t.state, opts, l.resettime, l.timezone)
+	case modeExpression:
+		return processor.NewExpression(t.state, opts, l.expression, t.index)
+	default:
+		return processor.NewDiff(t.state, opts)
+	}
+}
+
+// link holds the configuration parsed from the link config, along with the
+// per-topic state that depends on it
+type link struct {
+	topics []topic
+	// pair is the cross-topic difference, or nil if not configured
+	pair *pair
+	// outputs are the topics the device publishes to, other than those of
+	// topics matched by wildcards
+	outputs []string
+	// rateunit is the time unit a rate is expressed in
+	rateunit time.Duration
+	// timeunit is the time unit integrate mode integrates over
+	timeunit time.Duration
+	// resettime is the time of day in timezone that daily mode takes its
+	// baseline at, as an offset from midnight
+	resettime time.Duration
+	timezone  *time.Location
+	// resetzero publishes 0 instead of the new value after a counter reset
+	resetzero bool
+	// precision is the number of decimal places published, if precisionset,
+	// and the service's default precision otherwise
+	precision    int
+	precisionset bool
+	// shortest publishes the shortest representation in %g style
+	shortest bool
+	// mindiff is the dead-band that a change must reach to be published
+	mindiff float64
+	// deadband is the largest diff a sign change ignores
+	deadband float64
+	// ignorevalues are the sentinel inputs dropped without updating the
+	// state, which match inputs within ignoreepsilon of them
+	ignorevalues  []float64
+	ignoreepsilon float64
+	// percentile is the percentile percentile mode publishes, or 0 if unset
+	percentile float64
+	// edgetype selects the edges detected, or is empty for the default of
+	// the mode
+	edgetype string
+	// maxjump is the largest plausible change between samples, or 0 if
+	// unlimited. After maxjumpresync consecutive outliers the new level is
+	// accepted.
+	maxjump       float64
+	maxjumpresync int
+	// results outside of clampmin and clampmax are clipped to the range, or
+	// dropped if clampdrop is set
+	clampmin  float64
+	clampmax  float64
+	clampdrop bool
+	// smooth enables the ewma filter with weight alpha
+	smooth bool
+	alpha  float64
+	// smoothoutput applies the filter to the diff instead of the input
+	smoothoutput bool
+	// window is the number of samples a windowed diff spans, or 0 if unused
+	window int
+	// windowduration is the time a min/max or slope window spans, or 0 if
+	// unused. It holds at most maxpoints samples.
+	windowduration time.Duration
+	maxpoints      int
+	// windowpartial diffs against the earliest sample until the window fills
+	windowpartial bool
+	// medianwindow is the number of inputs the median filter spans, or 0 if
+	// unused
+	medianwindow int
+	// numbers is the format of plain text payloads
+	numbers numberFormat
+	// unithandling is what is done with the units stripped from plain text
+	// payloads, or empty if they are not tracked
+	unithandling string
+	// expression replaces the mode of every topic, if set
+	expression *processor.Expr
+	// timestamped payloads carry their sample time after tsdelimiter
+	timestamped bool
+	tsdelimiter string
+	// publishfirst publishes the first sample as a diff against zero
+	publishfirst bool
+	// seedretained seeds the state from the retained message of each topic
+	seedretained bool
+	// outputprefix and outputsuffix decorate the default output topics
+	outputprefix string
+	outputsuffix string
+	// mininterval is the least time between publishes of a topic
+	mininterval time.Duration
+	// staletimeout is how long a topic may go without a message before
+	// stalemarker is published, or 0 if disabled
+	staletimeout time.Duration
+	stalemarker  string
+	// republish is the interval the last payload of each topic is
+	// published again at when no new one was published, or 0 to use the
+	// service's default interval
+	republish time.Duration
+	// dryrun logs the outputs instead of publishing them
+	dryrun bool
+	// allownonfinite passes NaN and infinite inputs and results through
+	allownonfinite bool
+	// publishstats publishes the device statistics every statsinterval
+	publishstats  bool
+	statsinterval time.Duration
+	// combined is the device topic the last outputs of all topics are
+	// published to together instead of their own output topics, or empty.
+	// They are published every combinedinterval, or on every output if 0.
+	combined         string
+	combinedinterval time.Duration
+	// publisherrors publishes the payloads that fail to parse
+	publisherrors bool
+	// jsonoutput publishes a JSON object with the sample instead of the result
+	jsonoutput bool
+	// qos and retain are the MQTT QoS and retained flag of the outputs
+	qos    byte
+	retain bool
+	// maxtopics is the most input topics the device may have, including
+	// the topics matched by wildcards, or 0 if unlimited
+	maxtopics int
+	// maxfields is the most fields each JsonAllFields topic tracks
+	maxfields int
+}
+
+// Device holds the device specific last values and target topics for the difference.
+type Device struct {
+	// mu guards everything below. The framework may dispatch messages for
+	// several input topics of the device concurrently, and the state store
+	// snapshots devices from its own goroutine.
+	mu sync.Mutex
+	link
+	// id is the device id, known once linked
+	id string
+	// opts are the service options shared by all devices
+	opts *serviceOptions
+	// dropped counts the messages that could not be parsed as a number
+	dropped uint64
+	// clamped counts the results dropped for being outside the clamp range
+	clamped uint64
+	// nonfinite counts the NaN and infinite inputs dropped
+	nonfinite uint64
+	// ignored counts the inputs dropped for matching IgnoreValues
+	ignored uint64
+	// rejected counts the inputs dropped for being outside the valid range
+	rejected uint64
+	// wronglength counts the binary payloads dropped for having the wrong
+	// length
+	wronglength uint64
+	// pathmisses counts the JSON payloads dropped for holding no number at
+	// the path of their topic
+	pathmisses uint64
+	// processed counts the messages received on the input topics
+	processed uint64
+	// panics counts the panics recovered from while processing
+	panics uint64
+	// stoprepublish stops the republish ticker, or is nil if not running
+	stoprepublish chan struct{}
+	// stopstats stops the stats ticker, or is nil if not running
+	stopstats chan struct{}
+	// stopcombined stops the combined output ticker, or is nil if not
+	// running
+	stopcombined chan struct{}
+	// combinedsent is when the combined output was last published
+	combinedsent time.Time
+	// errorsent maps the input topics to when their last parse error was
+	// published
+	errorsent map[string]time.Time
+	// paused is set once the service shuts down, after which messages are
+	// ignored
+	paused bool
+	// logitem is the log entry of the device, or nil until the first
+	// message
+	logitem *log.Entry
+	// buf is reused to format plain payloads
+	buf []byte
+	// lastmessage is when the device last received a message or was
+	// linked, and evicted is set while its windows are evicted for being
+	// idle since. evictions counts the times they were.
+	lastmessage time.Time
+	evicted     bool
+	evictions   uint64
+	// publishfailures counts the outputs dropped because publishing them
+	// failed, and failedinarow those since the last successful publish.
+	// They are guarded by pubmu rather than mu, since the workers of the
+	// publish queue update them.
+	pubmu           sync.Mutex
+	publishfailures uint64
+	failedinarow    uint64
+}
+
+// serviceOptions are the service wide options that apply to every device.
+// They are set once at startup and only read afterwards, except for the
+// ones guarded by mu, which a SIGHUP reloads, and stats and pulse, which
+// guard themselves.
+type serviceOptions struct {
+	// stats are the counters of the service status, which are first so
+	// they are 64-bit aligned
+	stats serviceStats
+	// store persists the topic state across restarts, or nil if disabled
+	store *stateStore
+	// dryrun logs the outputs of all devices instead of publishing them
+	dryrun bool
+	// defaultSuffix is the OutputSuffix of devices that do not set one
+	defaultSuffix string
+	// devices are the linked devices, which are paused on shutdown
+	devices deviceRegistry
+	// pulse refreshes the service status as messages are processed
+	pulse statusPulse
+	// qos and retain are the QoS and Retain of devices that set neither
+	qos    byte
+	retain bool
+	// clock returns the time messages are taken to arrive at, or is nil
+	// for the wall clock. Replays set it to the time of each sample.
+	clock func() time.Time
+	// maxTopics is the most input topics a device may have, and maxDevices
+	// the most devices that may be linked, or 0 if unlimited
+	maxTopics  int
+	maxDevices int
+	// queue publishes the outputs of every device, or is nil if they are
+	// published while processing the message
+	queue *publishQueue
+	// conn carries the device topics under the framework, so that they use
+	// the MQTT TLS and client options, or is nil if the framework client
+	// carries them
+	conn *mqttConn
+
+	mu sync.RWMutex
+	// precision is the Precision of devices that do not set one
+	precision int
+	// republish is the Republish interval of devices that do not set one
+	republish time.Duration
+}
+
+// reload sets the reloadable options from the flags
+func (o *serviceOptions) reload(ctx *cli.Context) error {
+	precision := ctx.Int("default-precision")
+	if precision < -1 {
+		return fmt.Errorf("default precision must be -1 or greater")
+	}
+	republish := ctx.Duration("default-republish")
+	if republish < 0 {
+		return fmt.Errorf("default republish interval must not be negative")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.precision = precision
+	o.republish = republish
+	return nil
+}
+
+// defaultPrecision returns the Precision of devices that do not set one
+func (o *serviceOptions) defaultPrecision() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.precision
+}
+
+// now returns the current time of the clock, or the wall clock if unset
+func (o *serviceOptions) now() time.Time {
+	if o.clock != nil {
+		return o.clock()
+	}
+	return time.Now()
+}
+
+// defaultRepublish returns the Republish interval of devices that do not
+// set one
+func (o *serviceOptions) defaultRepublish() time.Duration {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.republish
+}
+
+// deviceControl is the part of framework.DeviceControl a device uses, so
+// the device can be driven without a framework connection
+type deviceControl interface {
+	Id() string
+	Config() map[string]string
+	Subscribe(subtopic string, key interface{}) error
+	Unsubscribe(subtopics ...string) error
+	Publish(subtopic string, payload interface{}) error
+}
+
+// optionPublisher is implemented by device controls that can publish with a
+// given QoS and retained flag. The framework's DeviceControl publishes with
+// its own defaults only, so under the framework the device topics are
+// published over the service's own connection instead.
+type optionPublisher interface {
+	PublishOptions(subtopic string, payload interface{}, qos byte, retain bool) error
+}
+
+// newDeviceFactory returns the constructor the framework calls when a new
+// device has been linked. Every device shares opts.
+func newDeviceFactory(opts *serviceOptions) func() framework.Device {
+	return func() framework.Device {
+		d := new(Device)
+		d.opts = opts
+		return framework.Device(d)
+	}
+}
+
+// ProcessLink is called once, during the initial setup of a
+// device, and is provided the service config for the linking device.
+func (d *Device) ProcessLink(ctrl *framework.DeviceControl) string {
+	return d.processLink(d.control(ctrl))
+}
+
+// processLink implements ProcessLink on any deviceControl
+func (d *Device) processLink(ctrl deviceControl) (status string) {
+	logitem := log.WithField("deviceid", ctrl.Id())
+	logitem.Debug("Linking with config:", ctrl.Config())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.recoverPanic(logitem, "ProcessLink", &status)
+
+	d.id = ctrl.Id()
+	if status := d.configure(logitem, ctrl.Config(), d.opts); len(status) > 0 {
+		return status
+	}
+	if !d.opts.devices.register(d, ctrl, d.opts.maxDevices) {
+		logitem.Warnf("Refusing link beyond the limit of %d devices", d.opts.maxDevices)
+		d.opts.stats.countRefused()
+		return fmt.Sprintf("Error: the service is at its limit of %d devices", d.opts.maxDevices)
+	}
+	if d.opts.store != nil {
+		d.restore(d.opts.store.register(d.id, d))
+	}
+	d.lastmessage = d.opts.now()
+	d.subscribe(ctrl)
+	d.startStaleTimers(ctrl)
+	d.startRepublish(ctrl)
+	d.startStats(ctrl)
+	d.startCombined(ctrl)
+
+	logitem.Debug("Finished Linking")
+
+	// This message is sent to the service status for the linking device
+	return d.linkStatus()
+}
+
+// ProcessUnlink is called once, when the service has been unlinked from
+// the device. It removes the subscriptions, stops the timers, and releases
+// the state of the device.
+func (d *Device) ProcessUnlink(ctrl *framework.DeviceControl) {
+	d.processUnlink(d.control(ctrl))
+}
+
+// processUnlink implements ProcessUnlink on any deviceControl
+func (d *Device) processUnlink(ctrl deviceControl) {
+	logitem := log.WithField("deviceid", ctrl.Id())
+	logitem.Debug("Unlinked:")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.recoverPanic(logitem, "ProcessUnlink", nil)
+
+	d.unsubscribe(ctrl)
+	d.stopStaleTimers()
+	d.stopRepublish()
+	d.stopStats()
+	d.stopCombined()
+	if d.opts.store != nil {
+		d.opts.store.unregister(ctrl.Id())
+	}
+	d.opts.devices.unregister(d)
+
+	// Release the topic state, so a relink starts from a clean slate
+	d.link = link{}
+	d.id = ""
+	d.dropped = 0
+	d.clamped = 0
+	d.nonfinite = 0
+	d.ignored = 0
+	d.rejected = 0
+	d.wronglength = 0
+	d.pathmisses = 0
+	d.processed = 0
+	d.panics = 0
+	d.errorsent = nil
+	d.combinedsent = time.Time{}
+	d.pubmu.Lock()
+	d.publishfailures = 0
+	d.resetPublishFailing()
+	d.pubmu.Unlock()
+}
+
+// ProcessConfigChange is called when the link config of the device changes.
+// The merged config is parsed the same way as in ProcessLink and the
+// subscriptions are replaced. Topics that exist in both the old and new
+// config keep their state. An invalid config leaves the device untouched.
+func (d *Device) ProcessConfigChange(ctrl *framework.DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
+	return d.processConfigChange(d.control(ctrl), cchanges, coriginal)
+}
+
+// processConfigChange implements ProcessConfigChange on any deviceControl
+func (d *Device) processConfigChange(ctrl deviceControl, cchanges, coriginal map[string]string) (status string, handled bool) {
+	logitem := log.WithField("deviceid", ctrl.Id())
+	logitem.Debug("Processing Config Change:", cchanges)
+
+	config := make(map[string]string, len(coriginal)+len(cchanges))
+	for key, value := range coriginal {
+		config[key] = value
+	}
+	for key, value := range cchanges {
+		config[key] = value
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.recoverPanic(logitem, "ProcessConfigChange", &status)
+
+	var nl link
+	if status := nl.configure(logitem, config, d.opts); len(status) > 0 {
+		return status, true
+	}
+
+	// Carry over the state of topics that remain
+	for i := range nl.topics {
+		for j := range d.topics {
+			if nl.topics[i].name() == d.topics[j].name() {
+				nl.topics[i].carry(&d.topics[j])
+				for concrete, old := range d.topics[j].matches {
+					if t := nl.rematch(&nl.topics[i], concrete); t != nil {
+						t.carry(old)
+					}
+				}
+				break
+			}
+		}
+	}
+	if nl.pair != nil && d.pair != nil && nl.pair.intopics == d.pair.intopics {
+		nl.pair.values = d.pair.values
+		nl.pair.lastpayload = d.pair.lastpayload
+		nl.pair.lastsent = d.pair.lastsent
+	}
+
+	d.unsubscribe(ctrl)
+	d.stopStaleTimers()
+	d.stopRepublish()
+	d.stopStats()
+	d.stopCombined()
+	d.link = nl
+	// The new link has its windows and timers, so nothing is left to
+	// rebuild of an evicted device
+	d.evicted = false
+	d.subscribe(ctrl)
+	d.startStaleTimers(ctrl)
+	d.startRepublish(ctrl)
+	d.startStats(ctrl)
+	d.startCombined(ctrl)
+
+	logitem.Debug("Finished Config Change")
+
+	return d.linkStatus(), true
+}
+
+// subscribe subscribes to every topic the device is configured with
+func (d *Device) subscribe(ctrl deviceControl) {
+	for i, t := range d.topics {
+		if t.subscribed() {
+			ctrl.Subscribe(t.intopic, i)
+		}
+	}
+	if d.pair != nil {
+		for i, intopic := range d.pair.intopics {
+			ctrl.Subscribe(intopic, pairKey(i))
+		}
+	}
+	ctrl.Subscribe(resetTopic, resetKey{})
+}
+
+// unsubscribe removes the subscriptions made by subscribe
+func (d *Device) unsubscribe(ctrl deviceControl) {
+	ctrl.Unsubscribe(d.subscriptions()...)
+}
+
+// subscriptions returns the topics subscribe subscribes to, in order
+func (l *link) subscriptions() []string {
+	topics := make([]string, 0, len(l.topics)+3)
+	for _, t := range l.topics {
+		if t.subscribed() {
+			topics = append(topics, t.intopic)
+		}
+	}
+	if l.pair != nil {
+		topics = append(topics, l.pair.intopics[0], l.pair.intopics[1])
+	}
+	return append(topics, resetTopic)
+}
+
+// ProcessMessage is called upon receiving a pubsub message destined for
+// this device.
+func (d *Device) ProcessMessage(ctrl *framework.DeviceControl, msg framework.Message) {
+	d.processMessage(d.control(ctrl), msg.Topic(), msg.Key(), msg.Payload())
+}
+
+// deviceLog returns the log entry of the device, which is kept rather than
+// built for every message. The device lock must be held.
+func (d *Device) deviceLog(ctrl deviceControl) *log.Entry {
+	if d.logitem == nil {
+		d.logitem = log.WithField("deviceid", ctrl.Id())
+	}
+	return d.logitem
+}
+
+// debugging reports whether debug messages are logged, so the hot path can
+// skip formatting them
+func debugging() bool {
+	return log.GetLevel() >= log.DebugLevel
+}
+
+// processMessage implements ProcessMessage on any deviceControl, for a
+// message with the given topic, subscription key, and payload. They are
+// taken apart rather than as an interface, which would allocate for every
+// message.
+func (d *Device) processMessage(ctrl deviceControl, topic string, key interface{}, payload []byte) {
+	d.opts.pulse.beat(time.Now())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	logitem := d.deviceLog(ctrl)
+	defer d.recoverPanic(logitem, "ProcessMessage", nil)
+	if debugging() {
+		logitem.Debugf("Processing diff for topic %s", topic)
+	}
+
+	if d.paused {
+		logitem.Debug("Ignoring message while shutting down")
+		return
+	}
+
+	if _, ok := key.(resetKey); ok {
+		d.processReset(logitem, strings.TrimSpace(string(payload)))
+		return
+	}
+
+	d.processed++
+	d.opts.stats.countMessage()
+	now := d.opts.now()
+	d.lastmessage = now
+	if d.evicted {
+		d.rebuild(ctrl, logitem)
+	}
+	raw := payload
+
+	// Samples forwarded late carry the time they were taken
+	if d.timestamped {
+		var err error
+		if payload, now, err = splitTimestamp(payload, d.tsdelimiter); err != nil {
+			d.dropped++
+			logitem.Warnf("Failed to split timestamp from message (\"%v\"): %v | dropped=%d", string(raw), err, d.dropped)
+			d.publishError(ctrl, logitem, topic, raw)
+			return
+		}
+	}
+
+	if key, ok := key.(pairKey); ok {
+		if d.pair == nil {
+			// Delivered after an unlink or config change removed the pair
+			return
+		}
+		if d.feedsBack(d.pair.intopics[key], topic) {
+			logitem.Warnf("Ignoring message on the output topic %s", topic)
+			return
+		}
+		logitem = logitem.WithFields(log.Fields{
+			"topic":    d.pair.intopics[key],
+			"index":    int(key),
+			"outtopic": d.pair.outtopic,
+		})
+		value, err := parseValue(payload, d.numbers)
+		if err != nil {
+			d.dropped++
+			logitem.Warnf("Failed to convert message (\"%v\") to float64 | dropped=%d", string(payload), d.dropped)
+			d.publishError(ctrl, logitem, d.pair.intopics[key], payload)
+			return
+		}
+		if d.ignoredInput(logitem, value) || !d.finiteInput(logitem, value) {
+			return
+		}
+		d.processPair(ctrl, logitem, key, value, now)
+		return
+	}
+
+	index, ok := key.(int)
+	if !ok || index >= len(d.topics) {
+		// Delivered after an unlink or config change removed the topic
+		return
+	}
+	t := &d.topics[index]
+	if !t.wildcard && d.feedsBack(t.intopic, topic) {
+		logitem.Warnf("Ignoring message on the output topic %s", topic)
+		return
+	}
+	if t.allfields {
+		d.processFields(ctrl, t, payload, now)
+		return
+	}
+	if t.wildcard {
+		concrete, ok := matchTopic(t.intopic, topic)
+		if !ok {
+			if debugging() {
+				logitem.Debugf("Ignoring topic %s not matching %s", topic, t.intopic)
+			}
+			return
+		}
+		if t = d.match(t, concrete); t == nil {
+			if debugging() {
+				logitem.Debugf("Ignoring output topic %s matching %s", concrete, d.topics[index].intopic)
+			}
+			return
+		}
+		if t.staletimer == nil {
+			d.startStaleTimer(ctrl, index, t)
+		}
+	}
+	d.processTopic(ctrl, t, payload, now)
+	// Entries extracting other values from the same input topic share its
+	// subscription
+	for _, sibling := range t.siblings {
+		d.processTopic(ctrl, &d.topics[sibling], payload, now)
+	}
+}
+
+// processTopic processes the message payload received at now on the input
+// topic of t
+func (d *Device) processTopic(ctrl deviceControl, t *topic, payload []byte, now time.Time) {
+	// The topic's entry carries the same fields, without building them
+	// for every message
+	logitem := t.logitem
+	d.touchStaleTimer(t)
+	t.lastinput = d.opts.now()
+
+	if t.seeding {
+		t.seeding = false
+		d.seedRetained(logitem, t, payload, now)
+		return
+	}
+
+	if d.timestamped && now.Before(t.state.LastTime) {
+		logitem.Debugf("Dropping sample older than the last one | time=%v | lasttime=%v", now, t.state.LastTime)
+		return
+	}
+
+	if t.arraydiff {
+		d.processArray(ctrl, logitem, t, payload)
+		return
+	}
+
+	value, unit, err := t.parse(payload, d.numbers)
+	if err == errPayloadLength {
+		d.wronglength++
+		logitem.Warnf("Dropping binary payload of %d bytes instead of %d | wronglength=%d", len(payload), t.offset+t.encoding.width, d.wronglength)
+		d.publishError(ctrl, logitem, t.intopic, payload)
+		return
+	}
+	if _, ok := err.(*pathError); ok {
+		// Payloads keep missing the path, so it is logged once in a while
+		d.pathmisses++
+		if now := d.opts.now(); now.Sub(t.pathwarned) >= errorInterval {
+			t.pathwarned = now
+			logitem.Warnf("Dropping JSON payload (\"%v\"): %v | pathmisses=%d", string(payload), err, d.pathmisses)
+		}
+		d.publishError(ctrl, logitem, t.intopic, payload)
+		return
+	}
+	if err != nil {
+		d.dropped++
+		logitem.Warnf("Failed to convert message (\"%v\") to float64: %v | dropped=%d", string(payload), err, d.dropped)
+		d.publishError(ctrl, logitem, t.intopic, payload)
+		return
+	}
+	d.processValue(ctrl, logitem, t, value, unit, now)
+}
+
+// processValue processes the value with unit parsed from a message received
+// at now on the input topic of t
+func (d *Device) processValue(ctrl deviceControl, logitem *log.Entry, t *topic, value float64, unit string, now time.Time) {
+	// Sentinels are the raw readings, before any conversion, and say
+	// nothing about the unit
+	if d.ignoredInput(logitem, value) {
+		return
+	}
+	if len(d.unithandling) > 0 {
+		// Values in different units cannot be diffed against each other
+		if t.unitseen && unit != t.unit {
+			logitem.Warnf("Resetting state after the unit changed from \"%s\" to \"%s\"", t.unit, unit)
+			t.reset()
+		}
+		t.unit, t.unitseen = unit, true
+	}
+	value = t.convert.apply(value)
+	if !d.finiteInput(logitem, value) || !d.validInput(ctrl, logitem, t, value) {
+		return
+	}
+
+	if t.median != nil {
+		t.median.Push(value)
+		value = t.median.Median()
+	}
+	if d.smooth && !d.smoothoutput {
+		value = d.ewma(t, value)
+	}
+
+	out, ok := t.proc.Process(value, now)
+	if !ok {
+		return
+	}
+
+	// Running totals and edges are published as is, only scaled
+	if t.mode == modeSum || t.mode == modeIntegrate || t.mode == modeEdges || t.mode == modeEdgeCount {
+		d.publishResult(ctrl, logitem, t, value, math.NaN(), out*t.scale, now)
+		return
+	}
+	if t.mode == modeMinMax {
+		d.publishMinMax(ctrl, logitem, t, value, now)
+		return
+	}
+	// Sign changes are events, which no output option applies to
+	if t.mode == modeSignChange {
+		event := signRising
+		if out < 0 {
+			event = signFalling
+		}
+		d.publishTopic(ctrl, logitem, t, event)
+		return
+	}
+	d.output(ctrl, logitem, t, value, t.state.Prev, out, now)
+}
+
+// seedRetained stores the retained message of the topic as its last value
+// without publishing, since the service already processed it before the last
+// restart or resubscription. Sum mode ignores it entirely, so it is not
+// counted twice.
+func (d *Device) seedRetained(logitem *log.Entry, t *topic, payload []byte, now time.Time) {
+	if d.timestamped && now.Before(t.state.LastTime) {
+		logitem.Debugf("Ignoring retained message older than the last sample | time=%v | lasttime=%v", now, t.state.LastTime)
+		return
+	}
+
+	if t.arraydiff {
+		values, err := t.parseArray(payload)
+		if err != nil {
+			logitem.Debugf("Ignoring unparsable retained message (\"%v\"): %v", string(payload), err)
+			return
+		}
+		t.lastarray = values
+		return
+	}
+
+	value, unit, err := t.parse(payload, d.numbers)
+	if err != nil {
+		logitem.Debugf("Ignoring unparsable retained message (\"%v\"): %v", string(payload), err)
+		return
+	}
+	d.seedValue(logitem, t, value, unit, now)
+}
+
+// seedValue stores the value with unit of the retained message of the topic
+// as its last value, unless it would be dropped as an input
+func (d *Device) seedValue(logitem *log.Entry, t *topic, value float64, unit string, now time.Time) {
+	if d.ignoredInput(logitem, value) {
+		return
+	}
+	if len(d.unithandling) > 0 {
+		t.unit, t.unitseen = unit, true
+	}
+	value = t.convert.apply(value)
+	if !d.allownonfinite && isNonFinite(value) {
+		logitem.Debugf("Ignoring non-finite retained value %s", utils.FormatFloat64(value))
+		return
+	}
+	if value < t.validmin || value > t.validmax {
+		logitem.Debugf("Ignoring retained value %s outside the valid range", utils.FormatFloat64(value))
+		return
+	}
+	if t.mode == modeSum {
+		return
+	}
+
+	logitem.Debugf("Seeding from retained message | value=%s", utils.FormatFloat64(value))
+	t.state.Seed(value, now)
+}
+
+// processReset clears the stored state of the input topic named by target,
+// or of every topic if target is empty. A target that names no input topic
+// is logged and resets nothing, so a mistyped topic does not wipe the
+// accumulators of every topic.
+func (d *Device) processReset(logitem *log.Entry, target string) {
+	if len(target) == 0 {
+		d.eachTopic(func(index int, t *topic) {
+			t.reset()
+		})
+		if d.pair != nil {
+			d.pair.values = [2]float64{math.NaN(), math.NaN()}
+			d.pair.lastpayload = ""
+		}
+		logitem.Info("Reset state of all topics")
+		return
+	}
+
+	var found bool
+	d.eachTopic(func(index int, t *topic) {
+		if t.intopic == target {
+			t.reset()
+			found = true
+		}
+	})
+	if d.pair != nil {
+		for i, intopic := range d.pair.intopics {
+			if intopic == target {
+				d.pair.values[i] = math.NaN()
+				found = true
+			}
+		}
+	}
+	if !found {
+		logitem.WithField("topic", target).Warn("Not resetting any state, since the reset names no input topic")
+		return
+	}
+	logitem.WithField("topic", target).Info("Reset state of topic")
+}
+
+// processArray diffs a JSON array of numbers against the previous array
+// received on the topic and publishes the element-wise diffs as a JSON array
+func (d *Device) processArray(ctrl deviceControl, logitem *log.Entry, t *topic, payload []byte) {
+	values, err := t.parseArray(payload)
+	if err != nil {
+		d.dropped++
+		logitem.Warnf("Failed to convert message (\"%v\") to float64 array: %v | dropped=%d", string(payload), err, d.dropped)
+		d.publishError(ctrl, logitem, t.intopic, payload)
+		return
+	}
+
+	if t.lastarray == nil {
+		logitem.Debugf("Setting first array | length=%d", len(values))
+		t.lastarray = values
+		return
+	}
+	if len(values) != len(t.lastarray) {
+		logitem.Warnf("Array length changed from %d to %d, resetting the topic state", len(t.lastarray), len(values))
+		t.lastarray = values
+		return
+	}
+
+	var buf strings.Builder
+	buf.WriteByte('[')
+	for i, value := range values {
+		diff := (value - t.lastarray[i]) * t.scale
+		if t.absolute {
+			diff = math.Abs(diff)
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(d.format(diff))
+	}
+	buf.WriteByte(']')
+	t.lastarray = values
+
+	d.publishTopic(ctrl, logitem, t, buf.String())
+}
+
+// processPair stores value for one of the PairDiff topics and publishes the
+// difference once both topics have reported
+func (d *Device) processPair(ctrl deviceControl, logitem *log.Entry, key pairKey, value float64, now time.Time) {
+	d.pair.values[key] = value
+	if math.IsNaN(d.pair.values[0]) || math.IsNaN(d.pair.values[1]) {
+		logitem.Debugf("Waiting for both pair topics | %s=%s", d.pair.intopics[key], utils.FormatFloat64(value))
+		return
+	}
+
+	diff := d.pair.values[0] - d.pair.values[1]
+	logitem.Debugf("%s=%.10f | %s=%.10f | diff=%s", d.pair.intopics[0], d.pair.values[0], d.pair.intopics[1], d.pair.values[1], utils.FormatFloat64(diff))
+	if !d.finiteResult(logitem, diff) {
+		return
+	}
+	diff, ok := d.clamp(logitem, diff)
+	if !ok {
+		return
+	}
+	if payload, ok := d.encodeResult(logitem, d.pair.values[0], d.pair.values[1], diff, now, false, ""); ok {
+		d.publishPair(ctrl, logitem, string(payload))
+	}
+}
+
+// publishPair publishes payload to the PairDiff output topic and remembers it
+// like publishTopic does for the input topics
+func (d *Device) publishPair(ctrl deviceControl, logitem *log.Entry, payload string) {
+	d.pair.lastpayload = payload
+	d.pair.lastsent = d.opts.now()
+	if len(d.combined) > 0 {
+		if d.combinedinterval <= 0 {
+			d.publishCombined(ctrl)
+		}
+		return
+	}
+	d.publish(ctrl, logitem, d.pair.outtopic, payload)
+}
+
+// output applies the output smoothing, scale, and absolute value options
+// to diff and publishes it to the topic's output topic. value is the sample
+// diff was computed from, and prev the sample it was compared to, or NaN.
+func (d *Device) output(ctrl deviceControl, logitem *log.Entry, t *topic, value, prev, diff float64, now time.Time) {
+	if d.smooth && d.smoothoutput {
+		diff = d.ewma(t, diff)
+	}
+
+	if t.invert {
+		diff = -diff
+	}
+
+	diff *= t.scale
+
+	if t.absolute {
+		diff = math.Abs(diff)
+	}
+
+	d.publishResult(ctrl, logitem, t, value, prev, diff, now)
+}
+
+// outputPayload is the JSON output format. Prev is omitted when no previous
+// sample exists.
+type outputPayload struct {
+	Value json.Number `json:"value"`
+	Prev  json.Number `json:"prev,omitempty"`
+	Diff  json.Number `json:"diff"`
+	Unit  string      `json:"unit,omitempty"`
+	Time  string      `json:"ts"`
+}
+
+// publishResult publishes result to the topic's output topic in the
+// configured output format
+func (d *Device) publishResult(ctrl deviceControl, logitem *log.Entry, t *topic, value, prev, result float64, now time.Time) {
+	if !d.finiteResult(logitem, result) {
+		return
+	}
+	result, ok := d.clamp(logitem, result)
+	if !ok {
+		return
+	}
+	if payload, ok := d.encodeResult(logitem, value, prev, result, now, t.integer, t.unit); ok {
+		d.publishTopic(ctrl, logitem, t, t.payloadString(payload))
+	}
+}
+
+// isNonFinite reports whether value is NaN or infinite
+func isNonFinite(value float64) bool {
+	return math.IsNaN(value) || math.IsInf(value, 0)
+}
+
+// publishMinMax publishes the minimum and maximum of the topic to its
+// output topic with minTopicSuffix and maxTopicSuffix appended. They are
+// scaled like running totals.
+func (d *Device) publishMinMax(ctrl deviceControl, logitem *log.Entry, t *topic, value float64, now time.Time) {
+	published := false
+	for i, output := range []struct {
+		suffix string
+		result float64
+	}{
+		{minTopicSuffix, t.state.Min * t.scale},
+		{maxTopicSuffix, t.state.Max * t.scale},
+	} {
+		if !d.finiteResult(logitem, output.result) {
+			continue
+		}
+		result, ok := d.clamp(logitem, output.result)
+		if !ok {
+			continue
+		}
+		payload, ok := d.encodeResult(logitem, value, math.NaN(), result, now, t.integer, t.unit)
+		if !ok {
+			continue
+		}
+		t.lastextremes[i] = string(payload)
+		published = true
+		if len(d.combined) == 0 {
+			d.publish(ctrl, logitem, t.outtopic+output.suffix, t.lastextremes[i])
+		}
+	}
+	if !published {
+		return
+	}
+	t.lastsent = d.opts.now()
+	// Both extremes go out in one combined output
+	if len(d.combined) > 0 && d.combinedinterval <= 0 {
+		d.publishCombined(ctrl)
+	}
+}
+
+// finiteInput reports whether the input value may be processed. Non-finite
+// values are dropped unless AllowNonFinite is set.
+func (d *Device) finiteInput(logitem *log.Entry, value float64) bool {
+	if d.allownonfinite || !isNonFinite(value) {
+		return true
+	}
+	d.nonfinite++
+	logitem.Warnf("Dropping non-finite value %s | nonfinite=%d", utils.FormatFloat64(value), d.nonfinite)
+	return false
+}
+
+// ignoredInput reports whether the input value matches one of IgnoreValues
+// and should be dropped
+func (d *Device) ignoredInput(logitem *log.Entry, value float64) bool {
+	for _, ignore := range d.ignorevalues {
+		if math.Abs(value-ignore) <= d.ignoreepsilon {
+			d.ignored++
+			logitem.Debugf("Ignoring sentinel value %s | ignored=%d", utils.FormatFloat64(value), d.ignored)
+			return true
+		}
+	}
+	return false
+}
+
+// validInput reports whether the input value of t is within its valid range.
+// Values outside it are dropped and reported to errorTopic.
+func (d *Device) validInput(ctrl deviceControl, logitem *log.Entry, t *topic, value float64) bool {
+	// NaN is for finiteInput to judge
+	if !(value < t.validmin || value > t.validmax) {
+		return true
+	}
+	d.rejected++
+	logitem.Debugf("Rejecting value %s outside the valid range | rejected=%d", utils.FormatFloat64(value), d.rejected)
+	d.reportError(ctrl, logitem, t.intopic, fmt.Sprintf("%s: %s is outside the valid range [%s, %s]", t.intopic,
+		utils.FormatFloat64(value), utils.FormatFloat64(t.validmin), utils.FormatFloat64(t.validmax)))
+	return false
+}
+
+// finiteResult reports whether result may be published. Non-finite results
+// are skipped unless AllowNonFinite is set.
+func (d *Device) finiteResult(logitem *log.Entry, result float64) bool {
+	if d.allownonfinite || !isNonFinite(result) {
+		return true
+	}
+	logitem.Warnf("Skipping non-finite result %s", utils.FormatFloat64(result))
+	return false
+}
+
+// clamp limits result to the clamp range. It returns false if result is
+// outside the range and should be dropped.
+func (d *Device) clamp(logitem *log.Entry, result float64) (float64, bool) {
+	if math.IsNaN(result) || (result >= d.clampmin && result <= d.clampmax) {
+		return result, true
+	}
+	if d.clampdrop {
+		d.clamped++
+		logitem.Warnf("Dropping result %s outside of the clamp range | clamped=%d", utils.FormatFloat64(result), d.clamped)
+		return result, false
+	}
+	return math.Max(d.clampmin, math.Min(d.clampmax, result)), true
+}
+
+// encodeResult formats result in the configured output format, rounded to
+// an integer if integer is set, along with unit if UnitHandling asks for it.
+// Plain payloads are formatted into the device's buffer, so they are only
+// valid until the next call.
+func (d *Device) encodeResult(logitem *log.Entry, value, prev, result float64, now time.Time, integer bool, unit string) ([]byte, bool) {
+	if !d.jsonoutput {
+		if integer && !isNonFinite(result) {
+			d.buf = d.appendInteger(d.buf[:0], result)
+		} else {
+			d.buf = d.appendFormat(d.buf[:0], result)
+		}
+		if d.unithandling == unitPassthrough && len(unit) > 0 {
+			d.buf = append(append(d.buf, ' '), unit...)
+		}
+		return d.buf, true
+	}
+
+	formatted := d.format(result)
+	if integer && !isNonFinite(result) {
+		formatted = string(d.appendInteger(nil, result))
+	}
+	out := outputPayload{
+		Value: json.Number(d.format(value)),
+		Diff:  json.Number(formatted),
+		Time:  now.UTC().Format(time.RFC3339),
+	}
+	if d.unithandling == unitPassthrough || d.unithandling == unitJSON {
+		out.Unit = unit
+	}
+	if !math.IsNaN(prev) {
+		out.Prev = json.Number(d.format(prev))
+	}
+	payload, err := json.Marshal(out)
+	if err != nil {
+		logitem.Warnf("Failed to encode output: %v", err)
+		return nil, false
+	}
+	return payload, true
+}
+
+// payloadString returns payload as a string, reusing the last payload of the
+// topic if they are the same, so that unchanged outputs do not allocate
+func (t *topic) payloadString(payload []byte) string {
+	if string(payload) == t.lastpayload {
+		return t.lastpayload
+	}
+	return string(payload)
+}
+
+// publishTopic publishes payload to the topic's output topic and remembers
+// it for republishing. With CombinedOutput, the combined output is published
+// instead, unless it waits for CombinedInterval.
+func (d *Device) publishTopic(ctrl deviceControl, logitem *log.Entry, t *topic, payload string) {
+	// Converting the payload for Publish allocates, so the converted last
+	// payload is reused while it is unchanged
+	if t.lastboxed == nil || payload != t.lastpayload {
+		t.lastboxed = payload
+	}
+	t.lastpayload = payload
+	t.lastsent = d.opts.now()
+	if len(d.combined) > 0 {
+		if d.combinedinterval <= 0 {
+			d.publishCombined(ctrl)
+		}
+		return
+	}
+	d.publish(ctrl, logitem, t.outtopic, t.lastboxed)
+}
+
+// publish sends payload, a string, to the device's subtopic, or only logs it
+// in dry-run. With a publish queue the output is queued, and is otherwise
+// published before returning. A failed publish is retried publishRetries
+// times before the output is dropped, in the background without a queue, so
+// the device lock is not held while waiting to retry.
+func (d *Device) publish(ctrl deviceControl, logitem *log.Entry, subtopic string, payload interface{}) {
+	if d.opts.dryrun || d.dryrun {
+		logitem.Infof("Dry run, not publishing %s=%s", subtopic, payload)
+		return
+	}
+	p := pendingPublish{
+		d:            d,
+		ctrl:         ctrl,
+		logitem:      logitem,
+		subtopic:     subtopic,
+		payload:      payload,
+		qos:          d.qos,
+		retain:       d.retain,
+		reporterrors: d.publisherrors,
+	}
+	if d.opts.queue != nil {
+		d.opts.queue.push(p)
+		return
+	}
+	p.trySend()
+}
+
+// send publishes p, retrying publishRetries times if it fails. It waits
+// between the attempts, so callers holding the device lock use trySend.
+func (p *pendingPublish) send() {
+	p.retry(p.publishOnce())
+}
+
+// trySend publishes p once and leaves the retries of a failed publish to a
+// goroutine, so it never waits and may be called with the device lock held.
+// A retried output may then be published after later ones.
+func (p *pendingPublish) trySend() {
+	if err := p.publishOnce(); err != nil {
+		// The goroutine gets a copy, so p does not escape to the heap on
+		// every publish
+		retried := *p
+		go retried.retry(err)
+		return
+	}
+	p.d.notePublish(p, nil)
+}
+
+// retry retries p after the first attempt failed with err, until it is
+// published or publishRetries retries failed
+func (p *pendingPublish) retry(err error) {
+	for attempt := 0; err != nil && attempt < publishRetries; attempt++ {
+		time.Sleep(publishRetryBackoff << uint(attempt))
+		err = p.publishOnce()
+	}
+	p.d.notePublish(p, err)
+}
+
+// publishOnce publishes p with its QoS and retained flag. Every control
+// publishing to the broker takes them, and the replayer, which writes the
+// outputs to a file, has no use for them.
+func (p *pendingPublish) publishOnce() error {
+	if p.qos == 0 && !p.retain {
+		return p.ctrl.Publish(p.subtopic, p.payload)
+	}
+	if o, ok := p.ctrl.(optionPublisher); ok {
+		return o.PublishOptions(p.subtopic, p.payload, p.qos, p.retain)
+	}
+	return p.ctrl.Publish(p.subtopic, p.payload)
+}
+
+// ewma folds value into the topic's exponentially weighted moving average
+// and returns the new average. The first value seeds the average.
+func (d *Device) ewma(t *topic, value float64) float64 {
+	if math.IsNaN(t.smoothed) {
+		t.smoothed = value
+	} else {
+		t.smoothed = d.alpha*value + (1-d.alpha)*t.smoothed
+	}
+	return t.smoothed
+}
+
+// format renders value with the configured precision
+func (d *Device) format(value float64) string {
+	var buf [32]byte
+	return string(d.appendFormat(buf[:0], value))
+}
+
+// appendInteger appends result rounded to the nearest integer to dst.
+// Results outside of the int64 range, whose conversion is undefined, are
+// appended with the configured precision instead.
+func (d *Device) appendInteger(dst []byte, result float64) []byte {
+	if rounded := math.Round(result); math.Abs(rounded) < 1<<63 {
+		return strconv.AppendInt(dst, int64(rounded), 10)
+	}
+	return d.appendFormat(dst, result)
+}
+
+// appendFormat appends value with the configured precision to dst
+func (d *Device) appendFormat(dst []byte, value float64) []byte {
+	if d.shortest {
+		return strconv.AppendFloat(dst, value, 'g', -1, 64)
+	}
+	precision := d.precision
+	if !d.precisionset {
+		precision = d.opts.defaultPrecision()
+	}
+	if precision < 0 {
+		return append(dst, utils.FormatFloat64(value)...)
+	}
+	return strconv.AppendFloat(dst, value, 'f', precision, 64)
+}
@@ -0,0 +1,887 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// published is a payload the device published to topic
+type published struct {
+	topic   string
+	payload string
+}
+
+// fakeControl is a deviceControl that records the subscriptions and the
+// publishes of a device, and delivers messages to it by topic
+type fakeControl struct {
+	id     string
+	config map[string]string
+
+	// mu guards the fields below, which the timers of a device may use
+	mu sync.Mutex
+	// subs maps the subscribed topics to their keys
+	subs map[string]interface{}
+	// published are the publishes since the last call to take
+	published []published
+	// err is returned by Publish, if set
+	err error
+}
+
+// newFakeControl returns a fake control of a device linked with config
+func newFakeControl(config map[string]string) *fakeControl {
+	return &fakeControl{
+		id:     "device",
+		config: config,
+		subs:   make(map[string]interface{}),
+	}
+}
+
+// Id implements deviceControl
+func (c *fakeControl) Id() string {
+	return c.id
+}
+
+// Config implements deviceControl
+func (c *fakeControl) Config() map[string]string {
+	return c.config
+}
+
+// Subscribe implements deviceControl
+func (c *fakeControl) Subscribe(subtopic string, key interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs[subtopic] = key
+	return nil
+}
+
+// Unsubscribe implements deviceControl
+func (c *fakeControl) Unsubscribe(subtopics ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, subtopic := range subtopics {
+		delete(c.subs, subtopic)
+	}
+	return nil
+}
+
+// Publish implements deviceControl
+func (c *fakeControl) Publish(subtopic string, payload interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.published = append(c.published, published{subtopic, fmt.Sprint(payload)})
+	return nil
+}
+
+// subscriptions returns a copy of the subscriptions
+func (c *fakeControl) subscriptions() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subs := make(map[string]interface{}, len(c.subs))
+	for subtopic, key := range c.subs {
+		subs[subtopic] = key
+	}
+	return subs
+}
+
+// take returns and forgets the publishes so far
+func (c *fakeControl) take() []published {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.published
+	c.published = nil
+	return p
+}
+
+// deliver passes payload to d as a message on subtopic, with the key it
+// was subscribed with
+func (c *fakeControl) deliver(t *testing.T, d *Device, subtopic, payload string) {
+	t.Helper()
+	c.mu.Lock()
+	key, ok := c.subs[subtopic]
+	c.mu.Unlock()
+	if !ok {
+		t.Fatalf("delivering to %s, which is not subscribed", subtopic)
+	}
+	d.processMessage(c, subtopic, key, []byte(payload))
+}
+
+// testOptions returns the service options of a test, with the defaults of
+// the flags
+func testOptions() *serviceOptions {
+	return &serviceOptions{
+		defaultSuffix: defaultOutputTopicSuffix,
+		precision:     defaultPrecision,
+	}
+}
+
+// linkDevice links a new device with config, failing the test unless the
+// link succeeds. The device is unlinked when the test ends.
+func linkDevice(t *testing.T, config map[string]string) (*Device, *fakeControl) {
+	t.Helper()
+	d := newDeviceFactory(testOptions())().(*Device)
+	ctrl := newFakeControl(config)
+	if status := d.processLink(ctrl); !strings.HasPrefix(status, "Success") {
+		t.Fatalf("link failed: %s", status)
+	}
+	t.Cleanup(func() { d.processUnlink(ctrl) })
+	return d, ctrl
+}
+
+func TestLinkSubscribes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		subs   map[string]interface{}
+	}{
+		{
+			name:   "one topic",
+			config: map[string]string{configKeyInputTopics: "energy"},
+			subs:   map[string]interface{}{"energy": 0, resetTopic: resetKey{}},
+		},
+		{
+			name:   "topics are trimmed",
+			config: map[string]string{configKeyInputTopics: " energy ,  power"},
+			subs:   map[string]interface{}{"energy": 0, "power": 1, resetTopic: resetKey{}},
+		},
+		{
+			name: "pair topics",
+			config: map[string]string{
+				configKeyInputTopics: "energy",
+				configKeyPairDiff:    "inside, outside",
+			},
+			subs: map[string]interface{}{"energy": 0, "inside": pairKey(0), "outside": pairKey(1), resetTopic: resetKey{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, ctrl := linkDevice(t, test.config)
+			if subs := ctrl.subscriptions(); !reflect.DeepEqual(subs, test.subs) {
+				t.Errorf("got subscriptions %v, want %v", subs, test.subs)
+			}
+		})
+	}
+}
+
+func TestLinkOutputTopics(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		want   []published
+	}{
+		{
+			name:   "default suffix",
+			config: map[string]string{configKeyInputTopics: "a, b"},
+			want:   []published{{"a_diff", "2"}, {"b_diff", "2"}},
+		},
+		{
+			name:   "explicit output topics",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "x, y"},
+			want:   []published{{"x", "2"}, {"y", "2"}},
+		},
+		{
+			name:   "fewer output topics than input topics",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputTopics: "x"},
+			want:   []published{{"x", "2"}, {"b_diff", "2"}},
+		},
+		{
+			name:   "output suffix",
+			config: map[string]string{configKeyInputTopics: "a, b", configKeyOutputSuffix: "_delta"},
+			want:   []published{{"a_delta", "2"}, {"b_delta", "2"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, ctrl := linkDevice(t, test.config)
+			for _, subtopic := range []string{"a", "b"} {
+				ctrl.deliver(t, d, subtopic, "10")
+				ctrl.deliver(t, d, subtopic, "12")
+			}
+			if got := ctrl.take(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got publishes %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLinkRefusesInvalidConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{configKeyInputTopics: "a", configKeyMode: "bogus"},
+		{configKeyInputTopics: "a", configKeyPrecision: "-2"},
+		{configKeyInputTopics: "a", configKeyMaxValue: "not a number"},
+	} {
+		d := newDeviceFactory(testOptions())().(*Device)
+		ctrl := newFakeControl(config)
+		if status := d.processLink(ctrl); !strings.HasPrefix(status, "Error") {
+			t.Errorf("link with %v: got status %q, want an error", config, status)
+		}
+		if subs := ctrl.subscriptions(); len(subs) > 0 {
+			t.Errorf("link with %v: got subscriptions %v, want none", config, subs)
+		}
+	}
+}
+
+func TestMessagePublishesDiffs(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "energy"})
+	for _, step := range []struct {
+		payload string
+		want    []published
+	}{
+		{"10", nil},
+		{"12.5", []published{{"energy_diff", "2.5"}}},
+		{"12.5", []published{{"energy_diff", "0"}}},
+		{"7", []published{{"energy_diff", "-5.5"}}},
+	} {
+		ctrl.deliver(t, d, "energy", step.payload)
+		if got := ctrl.take(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("after %s: got publishes %v, want %v", step.payload, got, step.want)
+		}
+	}
+}
+
+func TestMessageRetriesInBackground(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "energy"})
+	ctrl.deliver(t, d, "energy", "10")
+
+	ctrl.mu.Lock()
+	ctrl.err = errors.New("not connected")
+	ctrl.mu.Unlock()
+	start := time.Now()
+	ctrl.deliver(t, d, "energy", "12")
+	if elapsed := time.Since(start); elapsed >= publishRetryBackoff {
+		t.Errorf("processing the message took %v, so it waited on the retries", elapsed)
+	}
+	ctrl.mu.Lock()
+	ctrl.err = nil
+	ctrl.mu.Unlock()
+
+	want := []published{{"energy_diff", "2"}}
+	var got []published
+	for deadline := time.Now().Add(time.Second); len(got) == 0 && time.Now().Before(deadline); {
+		time.Sleep(publishRetryBackoff / 5)
+		got = ctrl.take()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+func TestMessageReset(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "a, b"})
+	ctrl.deliver(t, d, "a", "10")
+	ctrl.deliver(t, d, "b", "10")
+	ctrl.deliver(t, d, resetTopic, "a")
+	ctrl.deliver(t, d, "a", "15")
+	ctrl.deliver(t, d, "b", "15")
+	want := []published{{"b_diff", "5"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+func TestMessageResetUnknownTopic(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "a, b"})
+	ctrl.deliver(t, d, "a", "10")
+	ctrl.deliver(t, d, "b", "10")
+	ctrl.deliver(t, d, resetTopic, "c")
+	ctrl.deliver(t, d, "a", "15")
+	ctrl.deliver(t, d, "b", "15")
+	want := []published{{"a_diff", "5"}, {"b_diff", "5"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+
+	ctrl.deliver(t, d, resetTopic, "")
+	ctrl.deliver(t, d, "a", "20")
+	ctrl.deliver(t, d, "b", "20")
+	if got := ctrl.take(); len(got) > 0 {
+		t.Errorf("got publishes %v after resetting every topic, want none", got)
+	}
+}
+
+func TestUnlinkUnsubscribes(t *testing.T) {
+	d := newDeviceFactory(testOptions())().(*Device)
+	ctrl := newFakeControl(map[string]string{configKeyInputTopics: "a, b"})
+	if status := d.processLink(ctrl); status != "Success" {
+		t.Fatalf("link failed: %s", status)
+	}
+	d.processUnlink(ctrl)
+	if subs := ctrl.subscriptions(); len(subs) > 0 {
+		t.Errorf("got subscriptions %v after unlink, want none", subs)
+	}
+	// A message still in flight is ignored
+	d.processMessage(ctrl, "a", 0, []byte("10"))
+	if got := ctrl.take(); len(got) > 0 {
+		t.Errorf("got publishes %v after unlink, want none", got)
+	}
+}
+
+func TestMessageDropsUnparsablePayloads(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "energy"})
+	ctrl.deliver(t, d, "energy", "10")
+	for i, payload := range []string{"", "abc", "12abc", "1.2.3", "{}"} {
+		ctrl.deliver(t, d, "energy", payload)
+		if got := ctrl.take(); len(got) > 0 {
+			t.Errorf("after %q: got publishes %v, want none", payload, got)
+		}
+		if d.dropped != uint64(i+1) {
+			t.Errorf("after %q: got %d dropped, want %d", payload, d.dropped, i+1)
+		}
+	}
+	// The dropped payloads leave the last value alone
+	ctrl.deliver(t, d, "energy", "13")
+	want := []published{{"energy_diff", "3"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+// TestCallbacksConcurrently runs the device callbacks from several goroutines
+// at once, which the race detector checks for unguarded state
+func TestCallbacksConcurrently(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	original := map[string]string{configKeyInputTopics: "a, b"}
+	d := newDeviceFactory(testOptions())().(*Device)
+	ctrl := newFakeControl(original)
+	if status := d.processLink(ctrl); status != "Success" {
+		t.Fatalf("link failed: %s", status)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 500; i++ {
+				fn(i)
+			}
+		}()
+	}
+	for key, subtopic := range []string{"a", "b"} {
+		key, subtopic := key, subtopic
+		run(func(i int) {
+			d.processMessage(ctrl, subtopic, key, []byte(fmt.Sprint(i)))
+		})
+	}
+	run(func(i int) {
+		changes := map[string]string{configKeyInputTopics: "a, b, c"}
+		if i%2 == 0 {
+			changes[configKeyInputTopics] = "b, a"
+		}
+		d.processConfigChange(ctrl, changes, original)
+	})
+	run(func(i int) {
+		if i%2 == 0 {
+			d.processUnlink(ctrl)
+		} else {
+			d.processLink(ctrl)
+		}
+	})
+	run(func(int) {
+		d.snapshot()
+	})
+	close(start)
+	wg.Wait()
+	d.processUnlink(ctrl)
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.ErrorLevel {
+			t.Errorf("logged error: %s", entry.Message)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	// sum is 0.1 + 0.2 in float64, which constant arithmetic would make 0.3
+	sum := math.Nextafter(0.3, 1)
+	tests := []struct {
+		format    string
+		precision string
+		value     float64
+		want      string
+	}{
+		{numberFormatShortest, "", sum, "0.30000000000000004"},
+		{numberFormatShortest, "", 2.5, "2.5"},
+		{numberFormatShortest, "", 1e21, "1e+21"},
+		{numberFormatShortest, "", 1.5e-7, "1.5e-07"},
+		{numberFormatShortest, "-1", -3, "-3"},
+		{numberFormatFixed, "", sum, "0.30000000000000004"},
+		{numberFormatFixed, "", 1e21, "1000000000000000000000"},
+		{numberFormatFixed, "", 1.5e-7, "0.00000015"},
+		{numberFormatFixed, "2", sum, "0.30"},
+		{numberFormatFixed, "0", 2.5, "2"},
+		{"", "3", -1.0 / 3, "-0.333"},
+	}
+	for _, test := range tests {
+		config := map[string]string{
+			configKeyInputTopics: "a",
+			configKeyFormat:      test.format,
+			configKeyPrecision:   test.precision,
+		}
+		l, status := configure(config)
+		if len(status) > 0 {
+			t.Errorf("%v: got status %q", config, status)
+			continue
+		}
+		d := &Device{link: *l, opts: testOptions()}
+		if got := d.format(test.value); got != test.want {
+			t.Errorf("%s with precision %q: format(%v) = %q, want %q", test.format, test.precision, test.value, got, test.want)
+		}
+	}
+}
+
+func TestFormatShortestRefusesPrecision(t *testing.T) {
+	_, status := configure(map[string]string{
+		configKeyInputTopics: "a",
+		configKeyFormat:      numberFormatShortest,
+		configKeyPrecision:   "2",
+	})
+	if !strings.HasPrefix(status, "Error: ") {
+		t.Errorf("got status %q, want an error", status)
+	}
+}
+
+func TestOutputInteger(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		from   string
+		to     string
+		want   string
+	}{
+		{"rounds up from .5", nil, "10", "12.5", "3"},
+		{"rounds down below .5", nil, "10", "12.49", "2"},
+		{"just below .5", nil, "0", "2.4999999999", "2"},
+		{"just above .5", nil, "0", "2.5000000001", "3"},
+		{"negative diffs round away from zero", nil, "10", "7.5", "-3"},
+		{"negative diffs below .5", nil, "10", "7.6", "-2"},
+		{"scale applies first", map[string]string{configKeyScale: "0.5"}, "10", "15", "3"},
+		{"scale to below .5", map[string]string{configKeyScale: "0.1"}, "10", "14", "0"},
+		{"scale then invert", map[string]string{configKeyScale: "2.5", configKeyInvert: "true"}, "10", "11", "-3"},
+		{"precision is ignored", map[string]string{configKeyPrecision: "2"}, "10", "11.25", "1"},
+		{"json output", map[string]string{configKeyOutputFormat: outputFormatJSON}, "10", "12.5", `"diff":3`},
+		{"beyond int64", map[string]string{configKeyPrecision: "0"}, "0", "1e20", "100000000000000000000"},
+		{"negative beyond int64", map[string]string{configKeyPrecision: "0"}, "1e20", "0", "-100000000000000000000"},
+		{"json beyond int64", map[string]string{configKeyPrecision: "0", configKeyOutputFormat: outputFormatJSON}, "0", "1e20", `"diff":100000000000000000000`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := map[string]string{
+				configKeyInputTopics:   "a",
+				configKeyOutputInteger: "true",
+			}
+			for key, value := range test.config {
+				config[key] = value
+			}
+			d, ctrl := linkDevice(t, config)
+			ctrl.deliver(t, d, "a", test.from)
+			ctrl.deliver(t, d, "a", test.to)
+			got := ctrl.take()
+			if len(got) != 1 || !strings.Contains(got[0].payload, test.want) {
+				t.Errorf("got publishes %v, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOutputIntegerPerTopic(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:   "a, b",
+		configKeyOutputInteger: "false, true",
+	})
+	for _, subtopic := range []string{"a", "b"} {
+		ctrl.deliver(t, d, subtopic, "10")
+		ctrl.deliver(t, d, subtopic, "12.5")
+	}
+	want := []published{{"a_diff", "2.5"}, {"b_diff", "3"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+// panicProcessor is a processor that panics on every sample
+type panicProcessor struct{}
+
+// Process implements processor.Processor
+func (panicProcessor) Process(value float64, t time.Time) (float64, bool) {
+	panic("processing failed")
+}
+
+// panicControl is a fakeControl whose subscriptions panic
+type panicControl struct {
+	*fakeControl
+}
+
+// Subscribe implements deviceControl
+func (panicControl) Subscribe(subtopic string, key interface{}) error {
+	panic("subscribing failed")
+}
+
+func TestMessageRecoversFromPanic(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{configKeyInputTopics: "a, b"})
+	ctrl.deliver(t, d, "a", "10")
+	proc := d.topics[0].proc
+	d.topics[0].proc = panicProcessor{}
+	ctrl.deliver(t, d, "a", "11")
+	if d.panics != 1 {
+		t.Errorf("got %d panics, want 1", d.panics)
+	}
+
+	// The device lock was released, and the other topics carry on
+	ctrl.deliver(t, d, "b", "10")
+	ctrl.deliver(t, d, "b", "12")
+	d.topics[0].proc = proc
+	ctrl.deliver(t, d, "a", "14")
+	want := []published{{"b_diff", "2"}, {"a_diff", "4"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+func TestLinkRecoversFromPanic(t *testing.T) {
+	d := newDeviceFactory(testOptions())().(*Device)
+	ctrl := panicControl{newFakeControl(map[string]string{configKeyInputTopics: "a"})}
+	if status := d.processLink(ctrl); !strings.HasPrefix(status, "Error") {
+		t.Errorf("got status %q, want an error", status)
+	}
+	if d.panics != 1 {
+		t.Errorf("got %d panics, want 1", d.panics)
+	}
+	// The lock was released, so the device can still be unlinked
+	d.processUnlink(ctrl)
+}
+
+func TestMessageDropsUnparsableNormalizedPayloads(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:   "a",
+		configKeyStripUnits:    "true",
+		configKeyDecimalComma:  "true",
+		configKeyPublishErrors: "true",
+	})
+	ctrl.deliver(t, d, "a", " 10,5 C\n")
+	ctrl.deliver(t, d, "a", "C")
+	ctrl.deliver(t, d, "a", "+2.3e1 C")
+	if d.dropped != 1 {
+		t.Errorf("got %d dropped, want 1", d.dropped)
+	}
+	want := []published{{errorTopic, `a: failed to parse "C"`}, {"a_diff", "12.5"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+// discardControl is a fakeControl that drops what is published, so that
+// benchmarks measure the device alone
+type discardControl struct {
+	*fakeControl
+}
+
+// Publish implements deviceControl
+func (discardControl) Publish(subtopic string, payload interface{}) error {
+	return nil
+}
+
+func BenchmarkProcessMessage(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		config map[string]string
+		// step is added to the value of every message. Steps that are not
+		// exact in binary give outputs that keep changing.
+		step float64
+	}{
+		{"Diff", map[string]string{configKeyInputTopics: "a"}, 2},
+		{"DiffChanging", map[string]string{configKeyInputTopics: "a"}, 0.001},
+		{"Rate", map[string]string{configKeyInputTopics: "a", configKeyMode: modeRate}, 2},
+		{"JSON", map[string]string{configKeyInputTopics: "a", configKeyJSONPath: "sensor.value"}, 2},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			now := time.Date(2018, 5, 25, 0, 0, 0, 0, time.UTC)
+			opts := testOptions()
+			opts.clock = func() time.Time { return now }
+			d := newDeviceFactory(opts)().(*Device)
+			ctrl := discardControl{newFakeControl(bench.config)}
+			if status := d.processLink(ctrl); status != "Success" {
+				b.Fatalf("link failed: %s", status)
+			}
+			defer d.processUnlink(ctrl)
+
+			payloads := make([][]byte, 1000)
+			for i := range payloads {
+				value := fmt.Sprint(float64(i) * bench.step)
+				if bench.config[configKeyJSONPath] != "" {
+					value = `{"sensor": {"value": ` + value + `}}`
+				}
+				payloads[i] = []byte(value)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				now = now.Add(time.Second)
+				// Wrapping around publishes one other diff every cycle
+				d.processMessage(ctrl, "a", 0, payloads[i%len(payloads)])
+			}
+		})
+	}
+}
+
+func TestMessageUnchangedOutputDoesNotAllocate(t *testing.T) {
+	now := time.Date(2018, 5, 25, 0, 0, 0, 0, time.UTC)
+	opts := testOptions()
+	opts.clock = func() time.Time { return now }
+	d := newDeviceFactory(opts)().(*Device)
+	ctrl := discardControl{newFakeControl(map[string]string{configKeyInputTopics: "a"})}
+	if status := d.processLink(ctrl); status != "Success" {
+		t.Fatalf("link failed: %s", status)
+	}
+	defer d.processUnlink(ctrl)
+
+	// A steady ramp publishes the same diff for every message after the
+	// second
+	payloads := make([][]byte, 200)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprint(2 * i))
+	}
+	d.processMessage(ctrl, "a", 0, payloads[0])
+	d.processMessage(ctrl, "a", 0, payloads[1])
+	i := 2
+	allocs := testing.AllocsPerRun(100, func() {
+		now = now.Add(time.Second)
+		d.processMessage(ctrl, "a", 0, payloads[i])
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per message, want none while the diff is unchanged", allocs)
+	}
+}
+
+func TestMessageDecodesBase64(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:   "a",
+		configKeyPayloadBase64: "true",
+	})
+	// 10 padded and 12.5 unpadded
+	ctrl.deliver(t, d, "a", "MTA=")
+	ctrl.deliver(t, d, "a", "MTIuNQ")
+	ctrl.deliver(t, d, "a", "not base64!")
+	want := []published{{"a_diff", "2.5"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) || d.dropped != 1 {
+		t.Errorf("got publishes %v and %d dropped, want %v and 1 dropped", got, d.dropped, want)
+	}
+}
+
+func TestMessageExtractRegexWithCommaQuantifier(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:  "vendor, vendor",
+		configKeyOutputTopics: "temp, humidity",
+		configKeyExtractRegex: `T=(\d{1,3}); H=([0-9]{1,3})`,
+	})
+	ctrl.deliver(t, d, "vendor", "T=20,H=40")
+	ctrl.deliver(t, d, "vendor", "T=23,H=38")
+	want := []published{{"temp", "3"}, {"humidity", "-2"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
+
+func TestCombinedOutputIncludesMinMax(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:    "a, b",
+		configKeyModes:          "minmax, diff",
+		configKeyCombinedOutput: "diffs",
+	})
+	for _, message := range []struct{ topic, payload string }{{"a", "5"}, {"a", "3"}, {"b", "1"}, {"b", "4"}} {
+		ctrl.deliver(t, d, message.topic, message.payload)
+	}
+
+	got := ctrl.take()
+	for _, p := range got {
+		if p.topic != "diffs" {
+			t.Fatalf("published to %s, want only the combined output diffs", p.topic)
+		}
+	}
+	var entries map[string]combinedEntry
+	if err := json.Unmarshal([]byte(got[len(got)-1].payload), &entries); err != nil {
+		t.Fatal(err)
+	}
+	outputs := make(map[string]string)
+	for outtopic, entry := range entries {
+		outputs[outtopic] = string(entry.Output)
+	}
+	want := map[string]string{"a_diff_min": "3", "a_diff_max": "5", "b_diff": "3"}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Errorf("got combined outputs %v, want %v", outputs, want)
+	}
+}
+
+func TestCombinedOutputIncludesPairDiff(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyPairDiff:       "supply, return",
+		configKeyPairOutput:     "drop",
+		configKeyCombinedOutput: "diffs",
+	})
+	for _, message := range []struct{ topic, payload string }{{"supply", "60"}, {"return", "45"}} {
+		ctrl.deliver(t, d, message.topic, message.payload)
+	}
+
+	got := ctrl.take()
+	if len(got) != 1 || got[0].topic != "diffs" {
+		t.Fatalf("got publishes %v, want one to the combined output diffs", got)
+	}
+	var entries map[string]combinedEntry
+	if err := json.Unmarshal([]byte(got[0].payload), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if output := string(entries["drop"].Output); output != "15" {
+		t.Errorf("got combined outputs %v, want drop to be 15", entries)
+	}
+}
+
+func TestRepublishIncludesMinMaxAndPairDiff(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics: "a",
+		configKeyModes:       "minmax",
+		configKeyPairDiff:    "x, y",
+		configKeyRepublish:   "20ms",
+	})
+	for _, message := range []struct{ topic, payload string }{{"a", "5"}, {"x", "3"}, {"y", "1"}} {
+		ctrl.deliver(t, d, message.topic, message.payload)
+	}
+	ctrl.take()
+
+	want := map[string]string{"a_diff_min": "5", "a_diff_max": "5", "x_minus_y": "2"}
+	got := make(map[string]string)
+	for deadline := time.Now().Add(time.Second); len(got) < len(want) && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		for _, p := range ctrl.take() {
+			got[p.topic] = p.payload
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got republished %v, want %v", got, want)
+	}
+}
+
+func TestEvictIdleRebuildsWindow(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:  "a",
+		configKeyWindow:       "3",
+		configKeyStaleTimeout: "1h",
+		configKeyRepublish:    "1h",
+		configKeyPublishStats: "true",
+	})
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		ctrl.deliver(t, d, "a", payload)
+	}
+	want := []published{{"a_diff", "3"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got publishes %v before evicting, want %v", got, want)
+	}
+
+	d.evictIdle(time.Now().Add(2*time.Hour), time.Hour)
+	d.mu.Lock()
+	if !d.evicted || d.topics[0].state.Window != nil {
+		t.Error("the window was not evicted")
+	}
+	if d.topics[0].staletimer != nil {
+		t.Error("the stale timer of the evicted device is still running")
+	}
+	if d.stoprepublish == nil || d.stopstats == nil {
+		t.Error("republishing or the statistics of the evicted device were stopped")
+	}
+	d.mu.Unlock()
+
+	// The rebuilt window starts from the last value, 4, and takes a full
+	// window to publish again
+	for _, payload := range []string{"5", "6", "7"} {
+		ctrl.deliver(t, d, "a", payload)
+	}
+	want = []published{{"a_diff", "3"}}
+	if got := ctrl.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v after rebuilding, want %v", got, want)
+	}
+	d.mu.Lock()
+	if d.topics[0].staletimer == nil {
+		t.Error("the stale timer of the rebuilt device was not restarted")
+	}
+	d.mu.Unlock()
+}
+
+func TestEvictIdleKeepsRepublishing(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics: "a",
+		configKeyRepublish:   "20ms",
+	})
+	ctrl.deliver(t, d, "a", "1")
+	ctrl.deliver(t, d, "a", "3")
+	d.evictIdle(time.Now().Add(2*time.Hour), time.Hour)
+	d.mu.Lock()
+	evicted := d.evicted
+	d.mu.Unlock()
+	if !evicted {
+		t.Fatal("the device was not evicted")
+	}
+	ctrl.take()
+
+	var got []published
+	for deadline := time.Now().Add(time.Second); len(got) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		got = ctrl.take()
+	}
+	if want := (published{"a_diff", "2"}); len(got) == 0 || got[0] != want {
+		t.Errorf("got republished %v after evicting, want %v", got, want)
+	}
+}
+
+func TestStaleTimerFiringDuringMessage(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:  "a",
+		configKeyStaleTimeout: "1h",
+	})
+	// The timer fires while a message holds the device lock and restarts
+	// it, so the callback runs right after the message
+	d.mu.Lock()
+	topic := &d.topics[0]
+	timer := topic.staletimer
+	d.mu.Unlock()
+	ctrl.deliver(t, d, "a", "10")
+	d.mu.Lock()
+	d.processStale(ctrl, 0, topic, timer)
+	d.mu.Unlock()
+	if got := ctrl.take(); len(got) > 0 {
+		t.Errorf("got publishes %v after a fresh message, want none", got)
+	}
+}
+
+func TestStaleTimerPublishesMarker(t *testing.T) {
+	d, ctrl := linkDevice(t, map[string]string{
+		configKeyInputTopics:  "a",
+		configKeyStaleTimeout: "20ms",
+	})
+	ctrl.deliver(t, d, "a", "10")
+	want := []published{{"a_diff" + statusTopicSuffix, defaultStaleMarker}}
+	var got []published
+	for deadline := time.Now().Add(time.Second); len(got) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		got = ctrl.take()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got publishes %v, want %v", got, want)
+	}
+}
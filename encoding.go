@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+// errPayloadLength is returned for binary payloads whose length does not
+// match the encoding and offset of the topic
+var errPayloadLength = errors.New("payload has the wrong length")
+
+// payloadEncoding decodes the raw binary payloads of a topic, which hold a
+// single value of width bytes
+type payloadEncoding struct {
+	width  int
+	decode func(b []byte) float64
+}
+
+// payloadEncodings are the PayloadEncoding values
+var payloadEncodings = map[string]payloadEncoding{
+	"int8":      {1, func(b []byte) float64 { return float64(int8(b[0])) }},
+	"uint8":     {1, func(b []byte) float64 { return float64(b[0]) }},
+	"int16be":   {2, func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) }},
+	"int16le":   {2, func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) }},
+	"uint16be":  {2, func(b []byte) float64 { return float64(binary.BigEndian.Uint16(b)) }},
+	"uint16le":  {2, func(b []byte) float64 { return float64(binary.LittleEndian.Uint16(b)) }},
+	"int32be":   {4, func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) }},
+	"int32le":   {4, func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) }},
+	"uint32be":  {4, func(b []byte) float64 { return float64(binary.BigEndian.Uint32(b)) }},
+	"uint32le":  {4, func(b []byte) float64 { return float64(binary.LittleEndian.Uint32(b)) }},
+	"int64be":   {8, func(b []byte) float64 { return float64(int64(binary.BigEndian.Uint64(b))) }},
+	"int64le":   {8, func(b []byte) float64 { return float64(int64(binary.LittleEndian.Uint64(b))) }},
+	"uint64be":  {8, func(b []byte) float64 { return float64(binary.BigEndian.Uint64(b)) }},
+	"uint64le":  {8, func(b []byte) float64 { return float64(binary.LittleEndian.Uint64(b)) }},
+	"float32be": {4, func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }},
+	"float32le": {4, func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }},
+	"float64be": {8, func(b []byte) float64 { return math.Float64frombits(binary.BigEndian.Uint64(b)) }},
+	"float64le": {8, func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }},
+}
+
+// payloadEncodingNames returns the sorted names of the payload encodings
+func payloadEncodingNames() []string {
+	names := make([]string, 0, len(payloadEncodings))
+	for name := range payloadEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parsePayloadEncoding looks up the PayloadEncoding value, or returns nil
+// if it is unknown
+func parsePayloadEncoding(value string) *payloadEncoding {
+	if e, ok := payloadEncodings[strings.ToLower(value)]; ok {
+		return &e
+	}
+	return nil
+}
+
+// decodeBinary decodes the value of the binary payload, which holds it
+// after offset bytes of header
+func (e *payloadEncoding) decodeBinary(payload []byte, offset int) (float64, error) {
+	if len(payload) != offset+e.width {
+		return 0, errPayloadLength
+	}
+	return e.decode(payload[offset:]), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMaxJSONFields bounds the fields a JsonAllFields topic tracks,
+	// which each hold the state of a topic
+	defaultMaxJSONFields = 32
+	// fieldSeparator joins the input topic and the key of a field in the
+	// output topic of the field
+	fieldSeparator = "_"
+	// fieldNameSeparator joins them in the name of the field, which no
+	// concrete topic can be named like
+	fieldNameSeparator = "#"
+)
+
+// field returns the topic of the key of the JSON payloads of the
+// JsonAllFields topic tmpl, creating it on first use with the configuration
+// of tmpl. Keys beyond the limits of the device, and keys that cannot form
+// an output topic, are ignored.
+func (l *link) field(tmpl *topic, key string) *topic {
+	if t, ok := tmpl.matches[key]; ok {
+		return t
+	}
+	if len(key) == 0 || strings.ContainsAny(key, "+#") {
+		return nil
+	}
+	if len(tmpl.matches) >= l.maxfields {
+		if !tmpl.limitwarned {
+			tmpl.limitwarned = true
+			tmpl.logitem.Warnf("Ignoring field %s and any further fields beyond the limit of %d fields", key, l.maxfields)
+		}
+		return nil
+	}
+	if l.maxtopics > 0 && l.topicCount() >= l.maxtopics {
+		if !tmpl.limitwarned {
+			tmpl.limitwarned = true
+			tmpl.logitem.Warnf("Ignoring field %s and any further fields beyond the limit of %d topics", key, l.maxtopics)
+		}
+		return nil
+	}
+	outtopic := l.outputprefix + tmpl.intopic + fieldSeparator + key + l.outputsuffix
+	for _, t := range l.topics {
+		if t.intopic == outtopic {
+			tmpl.logitem.Warnf("Ignoring field %s, whose output topic %s is an input topic", key, outtopic)
+			return nil
+		}
+	}
+	for _, output := range l.outputs {
+		if output == outtopic {
+			tmpl.logitem.Warnf("Ignoring field %s, whose output topic %s is already published to", key, outtopic)
+			return nil
+		}
+	}
+
+	t := l.instantiate(tmpl, tmpl.intopic, outtopic, log.Fields{"field": key})
+	t.allfields = false
+	t.field = key
+	tmpl.matches[key] = t
+	return t
+}
+
+// processFields processes every numeric field of the JSON or CBOR object payload
+// received at now on the JsonAllFields topic tmpl as a topic of its own.
+// Fields missing from the payload keep their state until they return.
+func (d *Device) processFields(ctrl deviceControl, tmpl *topic, payload []byte, now time.Time) {
+	logitem := tmpl.logitem
+	doc := payload
+	if tmpl.base64 {
+		var err error
+		if doc, err = decodeBase64(payload); err != nil {
+			d.dropped++
+			logitem.Warnf("Failed to convert message (\"%v\") to a JSON object: %v | dropped=%d", string(payload), err, d.dropped)
+			d.publishError(ctrl, logitem, tmpl.intopic, payload)
+			return
+		}
+	}
+	fields, err := decodeFields(doc, tmpl.cbor)
+	if err != nil || fields == nil {
+		d.dropped++
+		logitem.Warnf("Failed to convert message (\"%v\") to an object | dropped=%d", string(payload), d.dropped)
+		d.publishError(ctrl, logitem, tmpl.intopic, payload)
+		return
+	}
+
+	// Sorted keys claim the fields up to the limit in the same order
+	// every time
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seeding := tmpl.seeding
+	tmpl.seeding = false
+	booleans := tmpl.mode == modeEdges || tmpl.mode == modeEdgeCount
+	found := false
+	for _, key := range keys {
+		value, ok := fields[key].(float64)
+		if b, isbool := fields[key].(bool); isbool && booleans {
+			value, ok = 0, true
+			if b {
+				value = 1
+			}
+		}
+		if !ok {
+			continue
+		}
+		found = true
+		t := d.field(tmpl, key)
+		if t == nil {
+			continue
+		}
+		if t.staletimer == nil {
+			d.startStaleTimer(ctrl, t.index, t)
+		}
+		d.touchStaleTimer(t)
+		t.lastinput = d.opts.now()
+		if seeding {
+			d.seedValue(t.logitem, t, value, "", now)
+			continue
+		}
+		if d.timestamped && now.Before(t.state.LastTime) {
+			t.logitem.Debugf("Dropping sample older than the last one | time=%v | lasttime=%v", now, t.state.LastTime)
+			continue
+		}
+		d.processValue(ctrl, t.logitem, t, value, "", now)
+	}
+
+	if !found && !seeding {
+		d.pathmisses++
+		if now := d.opts.now(); now.Sub(tmpl.pathwarned) >= errorInterval {
+			tmpl.pathwarned = now
+			logitem.Warnf("Dropping payload without numeric fields (\"%v\") | pathmisses=%d", string(payload), d.pathmisses)
+		}
+	}
+}
+
+// decodeFields decodes the object payload of a JsonAllFields topic, from
+// CBOR if cbor is set or else from JSON. A payload that is not an object
+// returns nil.
+func decodeFields(payload []byte, cbor bool) (map[string]interface{}, error) {
+	if !cbor {
+		var fields map[string]interface{}
+		err := json.Unmarshal(payload, &fields)
+		return fields, err
+	}
+	doc, err := decodeCBOR(payload)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := doc.(map[string]interface{})
+	return fields, nil
+}
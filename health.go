@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// httpShutdownTimeout bounds how long in-flight HTTP requests may take
+	// to finish when the service shuts down
+	httpShutdownTimeout = 5 * time.Second
+)
+
+// health tracks the liveness and readiness of the service for orchestrators
+type health struct {
+	// disconnects counts the times the MQTT connection was lost. It is
+	// accessed atomically, so it must stay 64-bit aligned.
+	disconnects uint64
+	// connected and ready are accessed atomically, 1 meaning true
+	connected int32
+	ready     int32
+	// lost is when the connection was lost, guarded by mu
+	mu   sync.Mutex
+	lost time.Time
+}
+
+// setConnected records whether the MQTT connection is up. Losing the
+// connection is counted, and regaining it is logged with the downtime.
+func (h *health) setConnected(connected bool) {
+	was := atomic.SwapInt32(&h.connected, boolToInt32(connected)) == 1
+	if was == connected {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !connected {
+		atomic.AddUint64(&h.disconnects, 1)
+		h.lost = time.Now()
+		return
+	}
+	if !h.lost.IsZero() {
+		log.Infof("Reconnected to MQTT after %v", time.Since(h.lost).Round(time.Millisecond))
+		h.lost = time.Time{}
+	}
+}
+
+// disconnectCount returns the number of times the MQTT connection was lost
+func (h *health) disconnectCount() uint64 {
+	return atomic.LoadUint64(&h.disconnects)
+}
+
+// setReady records whether the service finished starting up
+func (h *health) setReady(ready bool) {
+	atomic.StoreInt32(&h.ready, boolToInt32(ready))
+}
+
+// isConnected reports whether the MQTT connection is up
+func (h *health) isConnected() bool {
+	return atomic.LoadInt32(&h.connected) == 1
+}
+
+// isReady reports whether the service finished starting up
+func (h *health) isReady() bool {
+	return atomic.LoadInt32(&h.ready) == 1
+}
+
+// register adds the /healthz and /readyz endpoints to mux
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, h.isConnected())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, h.isReady())
+	})
+}
+
+// writeStatus responds 200 if ok, and 503 otherwise
+func writeStatus(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// httpServers serves groups of HTTP endpoints, sharing a listener between
+// groups configured with the same address
+type httpServers struct {
+	addrs   []string
+	muxes   map[string]*http.ServeMux
+	names   map[string][]string
+	servers []*http.Server
+}
+
+// handle has register add the endpoints called name to the server on addr.
+// An empty addr disables the endpoints.
+func (s *httpServers) handle(addr, name string, register func(mux *http.ServeMux)) {
+	if len(addr) == 0 {
+		return
+	}
+	if s.muxes == nil {
+		s.muxes = make(map[string]*http.ServeMux)
+		s.names = make(map[string][]string)
+	}
+	if s.muxes[addr] == nil {
+		s.muxes[addr] = http.NewServeMux()
+		s.addrs = append(s.addrs, addr)
+	}
+	register(s.muxes[addr])
+	s.names[addr] = append(s.names[addr], name)
+}
+
+// start serves every address in the background
+func (s *httpServers) start() {
+	for _, addr := range s.addrs {
+		name := strings.Join(s.names[addr], " and ")
+		s.servers = append(s.servers, startHTTPServer(name, addr, s.muxes[addr]))
+	}
+}
+
+// stop gracefully shuts down the servers started by start
+func (s *httpServers) stop() {
+	for _, srv := range s.servers {
+		stopHTTPServer(srv)
+	}
+}
+
+// startHTTPServer serves handler on addr in the background
+func startHTTPServer(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Failed to serve %s on %s: %v", name, addr, err)
+		}
+	}()
+	log.Infof("Serving %s on %s", name, addr)
+	return srv
+}
+
+// stopHTTPServer gracefully shuts down srv
+func stopHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn("Failed to shut down HTTP server: ", err)
+	}
+}
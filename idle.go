@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/openchirp/math-diff-service/internal/processor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxIdleCheckInterval bounds how long a device may stay idle beyond
+	// the eviction period before its state is evicted
+	maxIdleCheckInterval = time.Minute
+)
+
+// evictIdle evicts the state of the devices that received no message for
+// after, checking regularly until stop is closed
+func evictIdle(opts *serviceOptions, after time.Duration, stop <-chan struct{}) {
+	interval := after
+	if interval > maxIdleCheckInterval {
+		interval = maxIdleCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			opts.devices.evictIdle(now, after)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// evictIdle evicts the state of every linked device that received no
+// message for after as of now
+func (r *deviceRegistry) evictIdle(now time.Time, after time.Duration) {
+	r.mu.Lock()
+	devices := make([]*Device, 0, len(r.devices))
+	for d := range r.devices {
+		devices = append(devices, d)
+	}
+	r.mu.Unlock()
+
+	// Devices are locked without holding the registry lock, since
+	// ProcessLink registers while holding the device lock
+	for _, d := range devices {
+		d.evictIdle(now, after)
+	}
+}
+
+// evictIdle drops the sample windows and median filters of the device, and
+// stops its stale timers, if it received no message for after as of now.
+// The last values are kept, so the diffs stay correct, and the windows are
+// rebuilt on the next message. A device is not evicted before its stale
+// markers are due, so that they are still published. Republishing and the
+// statistics and combined output tickers keep running, since they are meant
+// to publish while no input arrives.
+func (d *Device) evictIdle(now time.Time, after time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	idle := now.Sub(d.lastmessage)
+	if d.paused || d.evicted || idle < after || idle < d.staletimeout {
+		return
+	}
+
+	d.eachTopic(func(index int, t *topic) {
+		t.state.Window = nil
+		t.state.Samples = nil
+		t.median = nil
+	})
+	d.stopStaleTimers()
+	d.evicted = true
+	d.evictions++
+	atomic.AddUint64(&d.opts.stats.evictions, 1)
+	log.WithField("deviceid", d.id).Debugf("Evicted state after %v idle", idle)
+}
+
+// rebuild recreates the windows and median filters dropped by evictIdle,
+// with the last value of each topic as their first sample, and restarts the
+// stale timers it stopped. The device lock must be held.
+func (d *Device) rebuild(ctrl deviceControl, logitem *log.Entry) {
+	d.eachTopic(func(index int, t *topic) {
+		if d.window > 0 && t.state.Window == nil {
+			t.state.Window = processor.NewRing(d.window)
+			if !math.IsNaN(t.state.Last) {
+				t.state.Window.Push(t.state.Last)
+			}
+		}
+		if d.medianwindow > 0 && t.median == nil {
+			t.median = processor.NewRing(d.medianwindow)
+		}
+	})
+	d.startStaleTimers(ctrl)
+	d.evicted = false
+	logitem.Debug("Rebuilt evicted state")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Inline options annotate an InputTopics entry with the settings of its
+// topic, so a single key can carry them all:
+//
+//	entry   = topic [ ">" output ] [ "|" option { "," option } ]
+//	option  = name "=" value
+//
+// such as temp>temp_rate|mode=rate,scale=0.1. A backslash takes the next
+// character literally, so \>, \|, \, and \= can appear in topics and values,
+// and \\ stands for a backslash. Entries without > or | are plain topics
+// and are left as they are.
+
+const (
+	inlineOutput  = '>'
+	inlineOptions = '|'
+	inlineEscape  = '\\'
+)
+
+// inlineOptionKeys maps the names of inline options to the per-topic list
+// keys they set the entry of
+var inlineOptionKeys = map[string]string{
+	"out":          configKeyOutputTopics,
+	"mode":         configKeyModes,
+	"scale":        configKeyScale,
+	"convert":      configKeyConvert,
+	"initial":      configKeyInitialValues,
+	"maxvalue":     configKeyMaxValue,
+	"counterbits":  configKeyCounterBits,
+	"absolute":     configKeyAbsolute,
+	"invert":       configKeyInvert,
+	"integer":      configKeyOutputInteger,
+	"arraydiff":    configKeyArrayDiff,
+	"jsonfield":    configKeyJSONField,
+	"validmin":     configKeyValidMin,
+	"validmax":     configKeyValidMax,
+	"extractregex": configKeyExtractRegex,
+	"encoding":     configKeyEncoding,
+	"offset":       configKeyPayloadOffset,
+	"base64":       configKeyPayloadBase64,
+	"jsonpath":     configKeyJSONPath,
+	"allfields":    configKeyJSONAllFields,
+	"format":       configKeyPayloadFormat,
+}
+
+// sharedListKeys are the per-topic list keys whose only entry applies to
+// every topic
+var sharedListKeys = map[string]bool{
+	configKeyScale:         true,
+	configKeyConvert:       true,
+	configKeyCounterBits:   true,
+	configKeyAbsolute:      true,
+	configKeyInvert:        true,
+	configKeyOutputInteger: true,
+	configKeyArrayDiff:     true,
+	configKeyJSONField:     true,
+	configKeyValidMin:      true,
+	configKeyValidMax:      true,
+	configKeyExtractRegex:  true,
+	configKeyEncoding:      true,
+	configKeyPayloadOffset: true,
+	configKeyPayloadBase64: true,
+	configKeyJSONPath:      true,
+	configKeyJSONAllFields: true,
+	configKeyPayloadFormat: true,
+}
+
+// inlineEntry is an InputTopics entry split into its parts
+type inlineEntry struct {
+	topic  string
+	output string
+	// names are the option names in the order given, and values maps
+	// them to their values
+	names  []string
+	values map[string]string
+}
+
+// isInline reports whether the InputTopics entry carries inline options
+func isInline(entry string) bool {
+	return strings.IndexByte(entry, inlineOutput) >= 0 || strings.IndexByte(entry, inlineOptions) >= 0
+}
+
+// isInlineOption reports whether the list entry is an option of the inline
+// entry before it, which the list separators split off
+func isInlineOption(entry string) bool {
+	i := strings.IndexByte(entry, '=')
+	if i <= 0 {
+		return false
+	}
+	_, ok := inlineOptionKeys[strings.TrimSpace(entry[:i])]
+	return ok
+}
+
+// parseInlineEntry splits an InputTopics entry into its topic, output, and
+// options
+func parseInlineEntry(entry string) (*inlineEntry, error) {
+	e := &inlineEntry{values: make(map[string]string)}
+	var part strings.Builder
+	// section is the part being read: the topic, the output, or an option
+	section := byte(0)
+	name := ""
+	end := func() error {
+		text := strings.TrimSpace(part.String())
+		part.Reset()
+		switch section {
+		case 0:
+			e.topic = text
+		case inlineOutput:
+			if len(text) == 0 {
+				return fmt.Errorf("the output after %c is empty", inlineOutput)
+			}
+			e.output = text
+		default:
+			if len(name) == 0 {
+				return fmt.Errorf("option %q is not of the form name=value", text)
+			}
+			if _, ok := inlineOptionKeys[name]; !ok {
+				return fmt.Errorf("unknown option %q", name)
+			}
+			if _, ok := e.values[name]; ok {
+				return fmt.Errorf("option %q is given more than once", name)
+			}
+			if len(text) == 0 {
+				return fmt.Errorf("option %q has no value", name)
+			}
+			e.names = append(e.names, name)
+			e.values[name] = text
+			name = ""
+		}
+		return nil
+	}
+
+	for i := 0; i < len(entry); i++ {
+		c := entry[i]
+		switch {
+		case c == inlineEscape:
+			if i+1 == len(entry) {
+				return nil, fmt.Errorf("it ends in a lone %c", inlineEscape)
+			}
+			i++
+			part.WriteByte(entry[i])
+		case c == inlineOutput && section == 0:
+			if err := end(); err != nil {
+				return nil, err
+			}
+			section = inlineOutput
+		case c == inlineOptions && section != inlineOptions:
+			if err := end(); err != nil {
+				return nil, err
+			}
+			section = inlineOptions
+		case c == '=' && section == inlineOptions && len(name) == 0:
+			name = strings.TrimSpace(part.String())
+			part.Reset()
+			if len(name) == 0 {
+				return nil, fmt.Errorf("an option has no name")
+			}
+		case c == ',' && section == inlineOptions:
+			if err := end(); err != nil {
+				return nil, err
+			}
+		case c == inlineOutput || c == inlineOptions:
+			return nil, fmt.Errorf("unexpected %c, which must be escaped as %c%c", c, inlineEscape, c)
+		default:
+			part.WriteByte(c)
+		}
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	if len(e.topic) == 0 {
+		return nil, fmt.Errorf("the topic is empty")
+	}
+	if _, ok := e.values["out"]; ok && len(e.output) > 0 {
+		return nil, fmt.Errorf("the output is given both after %c and as an option", inlineOutput)
+	}
+	return e, nil
+}
+
+// applyInlineOptions replaces the InputTopics entries of lists that carry
+// inline options with their topics, setting the entries of the options in
+// the per-topic lists. The error to report is returned, or else an empty
+// string.
+func applyInlineOptions(lists map[string][]string) string {
+	entries := lists[configKeyInputTopics]
+	var parsed []*inlineEntry
+	var topics []string
+	inline := false
+	for i := 0; i < len(entries); i++ {
+		if !isInline(entries[i]) {
+			topics = append(topics, entries[i])
+			parsed = append(parsed, nil)
+			continue
+		}
+		// Rejoin the options the list separators split off
+		entry := entries[i]
+		for i+1 < len(entries) && !isInline(entries[i+1]) && isInlineOption(entries[i+1]) {
+			i++
+			entry += "," + entries[i]
+		}
+		e, err := parseInlineEntry(entry)
+		if err != nil {
+			return fmt.Sprintf("Error: %s entry %d %q is invalid: %v", configKeyInputTopics, len(topics)+1, entry, err)
+		}
+		topics = append(topics, e.topic)
+		parsed = append(parsed, e)
+		inline = true
+	}
+	if !inline {
+		return ""
+	}
+
+	lists[configKeyInputTopics] = topics
+	for i, e := range parsed {
+		if e == nil {
+			continue
+		}
+		if len(e.output) > 0 {
+			setTopicEntry(lists, configKeyOutputTopics, i, len(topics), e.output)
+		}
+		for _, name := range e.names {
+			setTopicEntry(lists, inlineOptionKeys[name], i, len(topics), e.values[name])
+		}
+	}
+	return ""
+}
+
+// setTopicEntry sets the entry of topic i of n in the per-topic list key.
+// A shared entry is first copied to every topic, so it still applies to
+// the others.
+func setTopicEntry(lists map[string][]string, key string, i, n int, value string) {
+	list := lists[key]
+	if len(list) == 1 && sharedListKeys[key] {
+		shared := list[0]
+		list = make([]string, n)
+		for j := range list {
+			list[j] = shared
+		}
+	}
+	for len(list) < n {
+		list = append(list, "")
+	}
+	list[i] = value
+	lists[key] = list
+}
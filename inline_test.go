@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInlineEntry(t *testing.T) {
+	tests := []struct {
+		entry  string
+		topic  string
+		output string
+		names  []string
+		values map[string]string
+	}{
+		{entry: "temp>temp_rate", topic: "temp", output: "temp_rate"},
+		{entry: " temp > temp_rate ", topic: "temp", output: "temp_rate"},
+		{entry: "temp|mode=rate", topic: "temp", names: []string{"mode"}, values: map[string]string{"mode": "rate"}},
+		{
+			entry:  "temp>temp_rate|mode=rate,scale=0.1",
+			topic:  "temp",
+			output: "temp_rate",
+			names:  []string{"mode", "scale"},
+			values: map[string]string{"mode": "rate", "scale": "0.1"},
+		},
+		{
+			entry:  "temp| scale = 0.1 , mode = rate ",
+			topic:  "temp",
+			names:  []string{"scale", "mode"},
+			values: map[string]string{"scale": "0.1", "mode": "rate"},
+		},
+		{entry: "temp|out=temp_rate", topic: "temp", names: []string{"out"}, values: map[string]string{"out": "temp_rate"}},
+		{entry: `a\>b>c\|d`, topic: "a>b", output: "c|d"},
+		{
+			entry:  `temp|extractregex=t=(\d+)\,(\d+)`,
+			topic:  "temp",
+			names:  []string{"extractregex"},
+			values: map[string]string{"extractregex": `t=(d+),(d+)`},
+		},
+		{
+			entry:  `temp|extractregex=t=(\\d+)\,(\\d+)`,
+			topic:  "temp",
+			names:  []string{"extractregex"},
+			values: map[string]string{"extractregex": `t=(\d+),(\d+)`},
+		},
+		{entry: `a\\b>c`, topic: `a\b`, output: "c"},
+	}
+	for _, test := range tests {
+		e, err := parseInlineEntry(test.entry)
+		if err != nil {
+			t.Errorf("parseInlineEntry(%q): %v", test.entry, err)
+			continue
+		}
+		if test.values == nil {
+			test.values = map[string]string{}
+		}
+		if e.topic != test.topic || e.output != test.output || !reflect.DeepEqual(e.names, test.names) || !reflect.DeepEqual(e.values, test.values) {
+			t.Errorf("parseInlineEntry(%q) = %+v, want topic %q, output %q, options %v %v", test.entry, *e, test.topic, test.output, test.names, test.values)
+		}
+	}
+}
+
+func TestParseInlineEntryInvalid(t *testing.T) {
+	for _, entry := range []string{
+		">out",
+		"|mode=rate",
+		"temp>",
+		"temp> |mode=rate",
+		"temp|mode",
+		"temp|=rate",
+		"temp|mode=",
+		"temp|bogus=1",
+		"temp|mode=rate,mode=diff",
+		"temp>out|out=other",
+		"temp>out>other",
+		"temp|mode=rate|scale=2",
+		"temp|mode=rate>out",
+		`temp\`,
+	} {
+		if e, err := parseInlineEntry(entry); err == nil {
+			t.Errorf("parseInlineEntry(%q) = %+v, want an error", entry, *e)
+		}
+	}
+}
+
+func TestConfigureInlineOptions(t *testing.T) {
+	l, status := configure(map[string]string{
+		configKeyInputTopics: "temp>temp_rate|mode=rate,scale=0.1, power, energy|integer=true",
+		configKeyScale:       "2",
+	})
+	if len(status) > 0 {
+		t.Fatalf("got status %q", status)
+	}
+	type want struct {
+		intopic, outtopic, mode string
+		scale                   float64
+		integer                 bool
+	}
+	var got []want
+	for _, t := range l.topics {
+		got = append(got, want{t.intopic, t.outtopic, t.mode, t.scale, t.integer})
+	}
+	wants := []want{
+		{"temp", "temp_rate", modeRate, 0.1, false},
+		{"power", "power_diff", modeDiff, 2, false},
+		{"energy", "energy_diff", modeDiff, 2, true},
+	}
+	if !reflect.DeepEqual(got, wants) {
+		t.Errorf("got topics %+v, want %+v", got, wants)
+	}
+}
+
+func TestConfigureInlineOptionsInvalid(t *testing.T) {
+	for _, entry := range []string{
+		"temp|bogus=1",
+		"temp|mode=bogus",
+		"temp|scale=abc",
+		"temp>",
+	} {
+		_, status := configure(map[string]string{configKeyInputTopics: entry})
+		if !strings.HasPrefix(status, "Error: ") {
+			t.Errorf("%q: got status %q, want an error", entry, status)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Avg publishes the mean of the samples in the window. A partially filled
+// window averages whatever samples it has.
+type Avg struct {
+	*State
+	Options
+}
+
+// NewAvg creates a processor publishing the mean of the window of state,
+// which must have one
+func NewAvg(state *State, opts Options) *Avg {
+	return &Avg{State: state, Options: opts}
+}
+
+// Process implements Processor
+func (p *Avg) Process(value float64, t time.Time) (float64, bool) {
+	p.Window.Push(value)
+	p.Last = value
+	p.LastTime = t
+	if p.debugging() {
+		p.debugf("newvalue=%s | samples=%d | avg=%s", format(value), p.Window.Len(), format(p.Window.Mean()))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return p.Window.Mean(), true
+}
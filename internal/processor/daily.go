@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Daily publishes the difference of the samples to a baseline taken at the
+// start of each day, such as the consumption since midnight of a meter. The
+// baseline is kept in Sum and the start of its day in Period.
+type Daily struct {
+	*State
+	Options
+	// Reset is the time of day the baseline is taken at, as an offset from
+	// midnight, in Location
+	Reset    time.Duration
+	Location *time.Location
+}
+
+// NewDaily creates a processor publishing the difference to a baseline
+// taken reset after midnight in loc every day
+func NewDaily(state *State, opts Options, reset time.Duration, loc *time.Location) *Daily {
+	return &Daily{State: state, Options: opts, Reset: reset, Location: loc}
+}
+
+// start returns the latest daily reset time at or before t. The reset is
+// computed on the wall clock, so days spanning a DST change stay aligned.
+func (p *Daily) start(t time.Time) time.Time {
+	local := t.In(p.Location)
+	hour, min := int(p.Reset/time.Hour), int(p.Reset%time.Hour/time.Minute)
+	start := time.Date(local.Year(), local.Month(), local.Day(), hour, min, 0, 0, p.Location)
+	if start.After(t) {
+		start = time.Date(local.Year(), local.Month(), local.Day()-1, hour, min, 0, 0, p.Location)
+	}
+	return start
+}
+
+// Process implements Processor
+func (p *Daily) Process(value float64, t time.Time) (float64, bool) {
+	// The first sample of a new day takes the baseline. The last sample of
+	// the day before is closer to the reset time, so it is preferred.
+	if start := p.start(t); p.Period.Before(start) {
+		baseline := value
+		if !math.IsNaN(p.Last) && !p.LastTime.Before(p.start(start.Add(-time.Nanosecond))) {
+			baseline = p.Last
+		}
+		if p.debugging() {
+			p.debugf("Setting baseline | period=%v | baseline=%s", start, format(baseline))
+		}
+		p.Sum = baseline
+		p.Period = start
+	}
+
+	out := value - p.Sum
+	if p.debugging() {
+		p.debugf("baseline=%.10f | newvalue=%.10f | result=%s", p.Sum, value, format(out))
+	}
+	p.Last = value
+	p.LastTime = t
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = p.Sum
+	return out, true
+}
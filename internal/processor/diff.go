@@ -0,0 +1,220 @@
+package processor
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Diff publishes the difference between consecutive samples. Variants
+// handle counters, rates, and second differences.
+type Diff struct {
+	*State
+	Options
+	// Counter treats a decrease that does not wrap as a counter reset, and
+	// ResetZero publishes 0 instead of the new value after one
+	Counter   bool
+	ResetZero bool
+	// Second publishes the difference between consecutive differences
+	Second bool
+	// Rate divides the difference by the time elapsed in units of Rate, or
+	// is 0 for a plain difference
+	Rate time.Duration
+	// windowed diffs against the oldest sample of the window
+	windowed bool
+}
+
+// NewDiff creates a processor publishing the difference between consecutive
+// samples, or across the window of the state if it has one
+func NewDiff(state *State, opts Options) *Diff {
+	return &Diff{State: state, Options: opts, windowed: state.Window != nil}
+}
+
+// NewCounter creates a processor publishing the increase of a counter,
+// which may wrap at MaxValue or reset to a lower value
+func NewCounter(state *State, opts Options, resetzero bool) *Diff {
+	return &Diff{State: state, Options: opts, Counter: true, ResetZero: resetzero}
+}
+
+// NewRate creates a processor publishing the difference between consecutive
+// samples per unit of time
+func NewRate(state *State, opts Options, unit time.Duration) *Diff {
+	return &Diff{State: state, Options: opts, Rate: unit}
+}
+
+// NewDiff2 creates a processor publishing the difference between
+// consecutive differences
+func NewDiff2(state *State, opts Options) *Diff {
+	return &Diff{State: state, Options: opts, Second: true}
+}
+
+// counterDelta returns the change from last to value of a counter of the
+// given number of bits, computed in uint64 space so that wraps come out
+// right. A change of more than half the counter range is taken to be a step
+// backwards rather than a wrap, and comes out negative. Both values must be
+// within the counter range.
+func counterDelta(last, value float64, bits int) float64 {
+	mask := ^uint64(0) >> uint(64-bits)
+	l, v := uint64(last), uint64(value)
+	if delta := (v - l) & mask; delta <= mask/2+1 {
+		return float64(delta)
+	}
+	return -float64((l - v) & mask)
+}
+
+// Process implements Processor
+func (p *Diff) Process(value float64, t time.Time) (float64, bool) {
+	if p.windowed {
+		return p.processWindow(value, t)
+	}
+
+	if p.CounterBits > 0 && (value < 0 || value >= math.Ldexp(1, p.CounterBits) || value != math.Trunc(value)) {
+		p.warnf("Ignoring value outside the %d-bit counter range | newvalue=%s", p.CounterBits, format(value))
+		return 0, false
+	}
+
+	// First value is only stored, so that we don't get spurious spikes.
+	// A rate or second difference can never be computed from a single sample.
+	prev := p.Last
+	if math.IsNaN(p.Last) {
+		if !p.PublishFirst || p.Rate > 0 || p.Second {
+			if p.debugging() {
+				p.debugf("Setting first value | newvalue=%s", format(value))
+			}
+			p.Last = value
+			p.LastTime = t
+			return 0, false
+		}
+		// Diff the first value against zero, as the original service did
+		p.Last = 0
+	}
+
+	diff := value - p.Last
+
+	switch {
+	case p.CounterBits > 0:
+		diff = counterDelta(p.Last, value, p.CounterBits)
+	case p.MaxValue > 0 && value < p.Last:
+		// A counter that went down has wrapped around its maximum value
+		diff = (p.MaxValue - p.Last) + value
+	}
+	if p.Counter && diff < 0 {
+		// A counter that went down without wrapping has been reset
+		if p.debugging() {
+			p.debugf("Counter reset | lastvalue=%s | newvalue=%s", format(p.Last), format(value))
+		}
+		diff = value
+		if p.ResetZero {
+			diff = 0
+		}
+	}
+
+	// An implausible jump is ignored, unless it persists and is a new level
+	if p.MaxJump > 0 && !math.IsNaN(prev) && math.Abs(diff) > p.MaxJump {
+		p.Outliers++
+		if p.Outliers < p.MaxJumpResync {
+			p.warnf("Rejecting outlier | lastvalue=%s | newvalue=%s | outliers=%d", format(p.Last), format(value), p.Outliers)
+			return 0, false
+		}
+		p.warnf("Resyncing after %d consecutive outliers | lastvalue=%s | newvalue=%s", p.Outliers, format(p.Last), format(value))
+		p.Outliers = 0
+		p.Last = value
+		p.LastTime = t
+		p.LastDiff = math.NaN()
+		return 0, false
+	}
+	p.Outliers = 0
+
+	// Keep the last value, so that small drifts accumulate across the band
+	if math.Abs(diff) < p.MinDiff {
+		if p.debugging() {
+			p.debugf("Diff within dead-band | lastvalue=%s | newvalue=%s", format(p.Last), format(value))
+		}
+		return 0, false
+	}
+
+	// The second sample only provides the first difference
+	if p.Second {
+		if math.IsNaN(p.LastDiff) {
+			if p.debugging() {
+				p.debugf("Setting first difference | diff=%s", format(diff))
+			}
+			p.LastDiff = diff
+			p.Last = value
+			p.LastTime = t
+			return 0, false
+		}
+		diff, p.LastDiff = diff-p.LastDiff, diff
+	}
+
+	if p.Rate > 0 && !t.After(p.LastTime) {
+		// Keep the previous sample, so the next rate spans both messages
+		if p.debugging() {
+			p.debugf("Skipping rate with no elapsed time | newvalue=%s", format(value))
+		}
+		return 0, false
+	}
+
+	// Diffs held back by the rate limit accumulate, so the published diff
+	// spans every sample since the last publish
+	since := p.LastTime
+	if p.MinInterval > 0 {
+		if p.PendingSince.IsZero() {
+			p.PendingSince = p.LastTime
+		}
+		p.Pending += diff
+		if p.throttled(p.State, t) {
+			if p.debugging() {
+				p.debugf("Holding back diff | newvalue=%s | pending=%s", format(value), format(p.Pending))
+			}
+			p.Last = value
+			p.LastTime = t
+			return 0, false
+		}
+		diff, since = p.Pending, p.PendingSince
+		p.Pending, p.PendingSince = 0, time.Time{}
+	}
+
+	if p.Rate > 0 {
+		diff = diff / (float64(t.Sub(since)) / float64(p.Rate))
+	}
+
+	if p.debugging() {
+		p.debugf("lastvalue=%.10f | newvalue=%.10f | diff=%s", p.Last, value, format(diff))
+	}
+
+	p.Prev = prev
+	p.Last = value
+	p.LastTime = t
+	return diff, true
+}
+
+// processWindow diffs value against the oldest sample in the window
+func (p *Diff) processWindow(value float64, t time.Time) (float64, bool) {
+	if p.Window.Len() == 0 || (!p.Window.Full() && !p.WindowPartial) {
+		if p.debugging() {
+			p.debugf("Filling window | newvalue=%s | samples=%d", format(value), p.Window.Len()+1)
+		}
+		p.Window.Push(value)
+		p.LastTime = t
+		return 0, false
+	}
+	oldest := p.Window.Oldest()
+	diff := value - oldest
+	if p.debugging() {
+		p.debugf("oldestvalue=%.10f | newvalue=%.10f | diff=%s", oldest, value, format(diff))
+	}
+	p.Window.Push(value)
+	p.Last = value
+	p.LastTime = t
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = oldest
+	return diff, true
+}
+
+// format formats value for log messages
+func format(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
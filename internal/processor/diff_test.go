@@ -0,0 +1,218 @@
+package processor
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// step is a sample fed to a processor and the output it is expected to
+// produce, if any
+type step struct {
+	value   float64
+	out     float64
+	publish bool
+}
+
+// epoch is the time of the first sample of a test
+var epoch = time.Date(2018, 5, 25, 0, 0, 0, 0, time.UTC)
+
+// runSteps feeds the steps to p a second apart and checks the outputs
+func runSteps(t *testing.T, p Processor, steps []step) {
+	t.Helper()
+	for i, s := range steps {
+		out, publish := p.Process(s.value, epoch.Add(time.Duration(i)*time.Second))
+		if publish != s.publish || (publish && out != s.out) {
+			t.Errorf("sample %d (%v): got %v, %t, want %v, %t", i, s.value, out, publish, s.out, s.publish)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		counter bool
+		steps   []step
+	}{
+		{
+			name:  "first sample is only stored",
+			steps: []step{{value: 10}, {value: 12, out: 2, publish: true}},
+		},
+		{
+			name:  "first sample diffs against zero with PublishFirst",
+			opts:  Options{PublishFirst: true},
+			steps: []step{{value: 10, out: 10, publish: true}, {value: 12, out: 2, publish: true}},
+		},
+		{
+			name:  "negative diffs",
+			steps: []step{{value: 10}, {value: 7, out: -3, publish: true}, {value: -5, out: -12, publish: true}},
+		},
+		{
+			name:  "large values",
+			steps: []step{{value: 1e15}, {value: 1e15 + 3, out: 3, publish: true}, {value: -1e15, out: -2e15 - 3, publish: true}},
+		},
+		{
+			name:  "counter wraps at MaxValue",
+			opts:  Options{MaxValue: 4294967296},
+			steps: []step{{value: 4294967290}, {value: 5, out: 11, publish: true}, {value: 8, out: 3, publish: true}},
+		},
+		{
+			name:  "counter wraps from just below MaxValue to 0",
+			opts:  Options{MaxValue: 100},
+			steps: []step{{value: 99}, {value: 0, out: 1, publish: true}},
+		},
+		{
+			name:  "counter wraps from exactly MaxValue",
+			opts:  Options{MaxValue: 100},
+			steps: []step{{value: 100}, {value: 5, out: 5, publish: true}},
+		},
+		{
+			name:  "gauge without MaxValue goes negative",
+			steps: []step{{value: 50}, {value: 0, out: -50, publish: true}},
+		},
+		{
+			name:    "counter reset to 0",
+			counter: true,
+			steps:   []step{{value: 50}, {value: 0, out: 0, publish: true}, {value: 3, out: 3, publish: true}},
+		},
+		{
+			name:    "counter reset publishes the new value",
+			counter: true,
+			steps:   []step{{value: 100}, {value: 110, out: 10, publish: true}, {value: 4, out: 4, publish: true}},
+		},
+		{
+			name:  "MaxJump rejects an outlier",
+			opts:  Options{MaxJump: 10, MaxJumpResync: 3},
+			steps: []step{{value: 10}, {value: 100}, {value: 12, out: 2, publish: true}},
+		},
+		{
+			name: "MaxJump resyncs after repeated outliers",
+			opts: Options{MaxJump: 10, MaxJumpResync: 3},
+			steps: []step{
+				{value: 10}, {value: 100}, {value: 101}, {value: 102},
+				{value: 105, out: 3, publish: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := NewState(0)
+			var p Processor = NewDiff(state, test.opts)
+			if test.counter {
+				p = NewCounter(state, test.opts, false)
+			}
+			runSteps(t, p, test.steps)
+		})
+	}
+}
+
+func TestDiffFirstSampleKeepsState(t *testing.T) {
+	state := NewState(0)
+	p := NewDiff(state, Options{})
+	if _, publish := p.Process(42, epoch); publish {
+		t.Fatal("first sample published")
+	}
+	if state.Last != 42 || !state.LastTime.Equal(epoch) {
+		t.Errorf("got last %v at %v, want 42 at %v", state.Last, state.LastTime, epoch)
+	}
+	if !math.IsNaN(state.Prev) {
+		t.Errorf("got prev %v before any output, want NaN", state.Prev)
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		bits        int
+		last, value float64
+		want        float64
+	}{
+		{8, 10, 15, 5},
+		{8, 250, 4, 10},
+		{8, 255, 0, 1},
+		// Up to half the range is a forward step, wrap or not
+		{8, 0, 128, 128},
+		{8, 200, 72, 128},
+		// Beyond half the range is a step backwards
+		{8, 0, 129, -127},
+		{8, 15, 10, -5},
+		{16, 65535, 0, 1},
+		{16, 65000, 500, 1036},
+		{16, 0, 32768, 32768},
+		{16, 0, 32769, -32767},
+		{32, 4294967295, 1, 2},
+		{64, 0, 1 << 53, 1 << 53},
+	}
+	for _, test := range tests {
+		if got := counterDelta(test.last, test.value, test.bits); got != test.want {
+			t.Errorf("counterDelta(%v, %v, %d) = %v, want %v", test.last, test.value, test.bits, got, test.want)
+		}
+	}
+}
+
+func TestCounterBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter bool
+		steps   []step
+	}{
+		{
+			name:  "wraps at the counter width",
+			steps: []step{{value: 65530}, {value: 4, out: 10, publish: true}},
+		},
+		{
+			name:  "values outside the range are ignored",
+			steps: []step{{value: 10}, {value: 65536}, {value: -1}, {value: 1.5}, {value: 12, out: 2, publish: true}},
+		},
+		{
+			name:  "a step backwards is negative",
+			steps: []step{{value: 10}, {value: 4, out: -6, publish: true}},
+		},
+		{
+			name:    "a step backwards is a reset in counter mode",
+			counter: true,
+			steps:   []step{{value: 30000}, {value: 4, out: 4, publish: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := NewState(0)
+			opts := Options{CounterBits: 16}
+			var p Processor = NewDiff(state, opts)
+			if test.counter {
+				p = NewCounter(state, opts, false)
+			}
+			runSteps(t, p, test.steps)
+		})
+	}
+}
+
+func TestRateIrregularIntervals(t *testing.T) {
+	samples := []struct {
+		after   time.Duration
+		value   float64
+		out     float64
+		publish bool
+	}{
+		{0, 0, 0, false},
+		{2 * time.Second, 10, 300, true},
+		{2500 * time.Millisecond, 15, 120, true},
+		{10 * time.Second, 15, 0, true},
+		{100 * time.Millisecond, 16, 600, true},
+		// No time elapsed, so the next rate spans both samples
+		{0, 18, 0, false},
+		{900 * time.Millisecond, 20, 4 / 0.9 * 60, true},
+	}
+	for _, unit := range []time.Duration{time.Minute, time.Second, 15 * time.Minute} {
+		p := NewRate(NewState(0), Options{}, unit)
+		now := epoch
+		for i, s := range samples {
+			now = now.Add(s.after)
+			out, publish := p.Process(s.value, now)
+			want := s.out * float64(unit) / float64(time.Minute)
+			if publish != s.publish || (publish && math.Abs(out-want) > 1e-9*math.Abs(want)) {
+				t.Errorf("per %v, sample %d: got %v, %t, want %v, %t", unit, i, out, publish, want, s.publish)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Edges detects the transitions of a binary signal, where any sample other
+// than zero is on. It publishes 1 on each Rising or Falling edge, or with
+// Count the number of such edges so far, kept in Sum.
+type Edges struct {
+	*State
+	Options
+	Rising  bool
+	Falling bool
+	Count   bool
+}
+
+// NewEdges creates a processor publishing 1 on each selected edge
+func NewEdges(state *State, opts Options, rising, falling bool) *Edges {
+	return &Edges{State: state, Options: opts, Rising: rising, Falling: falling}
+}
+
+// NewEdgeCount creates a processor publishing the number of selected edges
+func NewEdgeCount(state *State, opts Options, rising, falling bool) *Edges {
+	return &Edges{State: state, Options: opts, Rising: rising, Falling: falling, Count: true}
+}
+
+// Process implements Processor
+func (p *Edges) Process(value float64, t time.Time) (float64, bool) {
+	last := p.Last
+	p.Last = value
+	p.LastTime = t
+	if math.IsNaN(last) {
+		if p.debugging() {
+			p.debugf("Setting first value | newvalue=%s", format(value))
+		}
+		return 0, false
+	}
+
+	on, wason := value != 0, last != 0
+	if on == wason || (on && !p.Rising) || (!on && !p.Falling) {
+		return 0, false
+	}
+	out := 1.0
+	if p.Count {
+		p.Sum++
+		out = p.Sum
+	}
+	if p.debugging() {
+		p.debugf("Edge | lastvalue=%.10f | newvalue=%.10f | count=%s", last, value, format(p.Sum))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return out, true
+}
@@ -0,0 +1,337 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Expr is a compiled arithmetic expression over the variables value, the
+// current sample, last, the previous sample, dt, the seconds between them,
+// and index, the index of the input topic. It supports numbers, the
+// operators + - * / % ^, parentheses, and the functions abs, sqrt, round,
+// floor, ceil, min, and max.
+type Expr struct {
+	eval func(v *exprVars) float64
+	// usesLast is set if the expression needs a previous sample
+	usesLast bool
+}
+
+// exprVars are the variables an expression is evaluated with
+type exprVars struct {
+	value, last, dt, index float64
+}
+
+// exprFuncs are the functions an expression may call, by their arity
+var exprFuncs = map[string]interface{}{
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"round": math.Round,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"min":   math.Min,
+	"max":   math.Max,
+}
+
+// CompileExpression parses src into an Expr
+func CompileExpression(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	p.next()
+	eval, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, p.errorf("unexpected %q", p.tok)
+	}
+	return &Expr{eval: eval, usesLast: p.usesLast}, nil
+}
+
+// Eval evaluates the expression
+func (e *Expr) Eval(value, last, dt float64, index int) float64 {
+	return e.eval(&exprVars{value: value, last: last, dt: dt, index: float64(index)})
+}
+
+// exprParser is a recursive descent parser that compiles the expression
+// into closures as it goes
+type exprParser struct {
+	src string
+	// pos is the offset of the next token, and tok and tokpos the current
+	// token and its offset. tok is empty at the end of src.
+	pos      int
+	tok      string
+	tokpos   int
+	usesLast bool
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), p.tokpos+1)
+}
+
+// next advances to the next token
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	p.tokpos = p.pos
+	if p.pos == len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	start := p.pos
+	switch c := p.src[p.pos]; {
+	case isDigit(c) || c == '.':
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		// An exponent, which may be signed
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+	case isLetter(c):
+		for p.pos < len(p.src) && (isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+// parseSum parses terms joined by + and -
+func (p *exprParser) parseSum() (func(*exprVars) float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "+" || p.tok == "-" {
+		op := p.tok
+		p.next()
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(v *exprVars) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v *exprVars) float64 { return l(v) - right(v) }
+		}
+	}
+	return left, nil
+}
+
+// parseProduct parses factors joined by *, /, and %
+func (p *exprParser) parseProduct() (func(*exprVars) float64, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "*" || p.tok == "/" || p.tok == "%" {
+		op := p.tok
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case "*":
+			left = func(v *exprVars) float64 { return l(v) * right(v) }
+		case "/":
+			left = func(v *exprVars) float64 { return l(v) / right(v) }
+		default:
+			left = func(v *exprVars) float64 { return math.Mod(l(v), right(v)) }
+		}
+	}
+	return left, nil
+}
+
+// parseUnary parses a signed power. The sign binds looser than ^, so -2^2
+// is -4.
+func (p *exprParser) parseUnary() (func(*exprVars) float64, error) {
+	if p.tok == "-" || p.tok == "+" {
+		op := p.tok
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "-" {
+			return func(v *exprVars) float64 { return -operand(v) }, nil
+		}
+		return operand, nil
+	}
+	return p.parsePower()
+}
+
+// parsePower parses a primary raised to an optional, right associative power
+func (p *exprParser) parsePower() (func(*exprVars) float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "^" {
+		return base, nil
+	}
+	p.next()
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v *exprVars) float64 { return math.Pow(base(v), exp(v)) }, nil
+}
+
+// parsePrimary parses a number, variable, function call, or parenthesized
+// expression
+func (p *exprParser) parsePrimary() (func(*exprVars) float64, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end of expression")
+	case tok == "(":
+		p.next()
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return inner, nil
+	case isDigit(tok[0]) || tok[0] == '.':
+		number, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok)
+		}
+		p.next()
+		return func(*exprVars) float64 { return number }, nil
+	case isLetter(tok[0]):
+		pos := p.tokpos
+		p.next()
+		if p.tok == "(" {
+			return p.parseCall(tok, pos)
+		}
+		return p.variable(tok, pos)
+	}
+	return nil, p.errorf("unexpected %q", tok)
+}
+
+// variable resolves the variable name found at pos
+func (p *exprParser) variable(name string, pos int) (func(*exprVars) float64, error) {
+	switch name {
+	case "value":
+		return func(v *exprVars) float64 { return v.value }, nil
+	case "last":
+		p.usesLast = true
+		return func(v *exprVars) float64 { return v.last }, nil
+	case "dt":
+		p.usesLast = true
+		return func(v *exprVars) float64 { return v.dt }, nil
+	case "index":
+		return func(v *exprVars) float64 { return v.index }, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q at position %d", name, pos+1)
+}
+
+// parseCall parses the arguments of a call to the function name found at pos
+func (p *exprParser) parseCall(name string, pos int) (func(*exprVars) float64, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name, pos+1)
+	}
+	p.next()
+	var args []func(*exprVars) float64
+	for p.tok != ")" {
+		if len(args) > 0 {
+			if p.tok != "," {
+				return nil, p.errorf("expected , or )")
+			}
+			p.next()
+		}
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+
+	switch fn := fn.(type) {
+	case func(float64) float64:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s at position %d takes 1 argument", name, pos+1)
+		}
+		a := args[0]
+		return func(v *exprVars) float64 { return fn(a(v)) }, nil
+	case func(float64, float64) float64:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s at position %d takes 2 arguments", name, pos+1)
+		}
+		a, b := args[0], args[1]
+		return func(v *exprVars) float64 { return fn(a(v), b(v)) }, nil
+	}
+	return nil, fmt.Errorf("unknown function %q at position %d", name, pos+1)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+// Expression publishes an expression evaluated for every sample
+type Expression struct {
+	*State
+	Options
+	expr  *Expr
+	index int
+}
+
+// NewExpression creates a processor publishing expr for the samples of the
+// input topic at index. Expressions using last or dt only publish from the
+// second sample on.
+func NewExpression(state *State, opts Options, expr *Expr, index int) *Expression {
+	return &Expression{State: state, Options: opts, expr: expr, index: index}
+}
+
+// Process implements Processor
+func (p *Expression) Process(value float64, t time.Time) (float64, bool) {
+	last := p.Last
+	if math.IsNaN(last) && p.expr.usesLast {
+		if p.debugging() {
+			p.debugf("Setting first value | newvalue=%s", format(value))
+		}
+		p.Last = value
+		p.LastTime = t
+		return 0, false
+	}
+
+	dt := math.NaN()
+	if !p.LastTime.IsZero() {
+		dt = t.Sub(p.LastTime).Seconds()
+	}
+	out := p.expr.Eval(value, last, dt, p.index)
+	if p.debugging() {
+		p.debugf("lastvalue=%.10f | newvalue=%.10f | result=%s", last, value, format(out))
+	}
+
+	p.Prev = last
+	p.Last = value
+	p.LastTime = t
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	return out, true
+}
@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileExpression(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		// Precedence and associativity
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"-2^2", -4},
+		{"(-2)^2", 4},
+		{"2^3^2", 512},
+		{"(2^3)^2", 64},
+		{"2^-1", 0.5},
+		{"2 * -3", -6},
+		{"--2", 2},
+		{"+2", 2},
+		{"1e3 + 2.5E-1", 1000.25},
+		{".5 * 4", 2},
+		// Variables, evaluated with value 10, last 4, dt 2, and index 3
+		{"value - last", 6},
+		{"(value - last) / dt", 3},
+		{"index", 3},
+		// Functions
+		{"abs(-2)", 2},
+		{"sqrt(16)", 4},
+		{"round(2.5)", 3},
+		{"floor(-1.5)", -2},
+		{"ceil(1.2)", 2},
+		{"min(3, value)", 3},
+		{"max(3, value)", 10},
+		{"max(abs(-20), value) * 2", 40},
+	}
+	for _, test := range tests {
+		expr, err := CompileExpression(test.src)
+		if err != nil {
+			t.Errorf("%q: got error %v", test.src, err)
+			continue
+		}
+		if got := expr.Eval(10, 4, 2, 3); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "unexpected end of expression at position 1"},
+		{"1 +", "unexpected end of expression at position 4"},
+		{"1 2", `unexpected "2" at position 3`},
+		{"1 # 2", `unexpected "#" at position 3`},
+		{"1..2", `invalid number "1..2" at position 1`},
+		{"(1 + 2", "expected ) at position 7"},
+		{"abs(1", "expected , or ) at position 6"},
+		{"abs(1,)", `unexpected ")" at position 7`},
+		{"2 * bar", `unknown variable "bar" at position 5`},
+		{"1 + foo(1)", `unknown function "foo" at position 5`},
+		{"abs(1, 2)", "abs at position 1 takes 1 argument"},
+		{"sqrt()", "sqrt at position 1 takes 1 argument"},
+		{"min(1)", "min at position 1 takes 2 arguments"},
+		{"1 + max(1, 2, 3)", "max at position 5 takes 2 arguments"},
+	}
+	for _, test := range tests {
+		expr, err := CompileExpression(test.src)
+		if err == nil {
+			t.Errorf("%q: got %v, want error %q", test.src, expr, test.want)
+			continue
+		}
+		if err.Error() != test.want {
+			t.Errorf("%q: got error %q, want %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestExpression(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		steps []step
+	}{
+		{
+			name:  "first sample is only stored when using last",
+			src:   "value - last",
+			steps: []step{{value: 10}, {value: 12, out: 2, publish: true}, {value: 9, out: -3, publish: true}},
+		},
+		{
+			name:  "first sample is only stored when using dt",
+			src:   "value / dt",
+			steps: []step{{value: 10}, {value: 12, out: 12, publish: true}},
+		},
+		{
+			name:  "first sample is published without last or dt",
+			src:   "value * 2 + index",
+			steps: []step{{value: 10, out: 21, publish: true}, {value: 12, out: 25, publish: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := CompileExpression(test.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runSteps(t, NewExpression(NewState(0), Options{}, expr, 1), test.steps)
+		})
+	}
+}
+
+// BenchmarkExpression compares evaluating an expression per sample with the
+// built-in diff it replaces
+func BenchmarkExpression(b *testing.B) {
+	expr, err := CompileExpression("(value - last) * 0.5 + 3")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name string
+		p    Processor
+	}{
+		{"Diff", NewDiff(NewState(0), Options{})},
+		{"Expression", NewExpression(NewState(0), Options{}, expr, 0)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			now := epoch
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				now = now.Add(time.Second)
+				bench.p.Process(float64(i%100), now)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Integrate publishes the running integral of the samples over time, using
+// the trapezoid rule between consecutive samples. The total is kept in Sum.
+type Integrate struct {
+	*State
+	Options
+	// Unit is the time unit the integral is expressed in
+	Unit time.Duration
+}
+
+// NewIntegrate creates a processor publishing the integral of the samples,
+// with time measured in unit
+func NewIntegrate(state *State, opts Options, unit time.Duration) *Integrate {
+	return &Integrate{State: state, Options: opts, Unit: unit}
+}
+
+// Process implements Processor
+func (p *Integrate) Process(value float64, t time.Time) (float64, bool) {
+	if math.IsNaN(p.Last) {
+		if p.debugging() {
+			p.debugf("Setting first value | newvalue=%s", format(value))
+		}
+		p.Last = value
+		p.LastTime = t
+		if !p.PublishFirst {
+			return 0, false
+		}
+		p.Prev = math.NaN()
+		return p.Sum, true
+	}
+
+	dt := float64(t.Sub(p.LastTime)) / float64(p.Unit)
+	if dt > 0 {
+		p.Sum += (p.Last + value) / 2 * dt
+	}
+	if p.debugging() {
+		p.debugf("lastvalue=%.10f | newvalue=%.10f | dt=%s | sum=%s", p.Last, value, format(dt), format(p.Sum))
+	}
+	p.Last = value
+	p.LastTime = t
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return p.Sum, true
+}
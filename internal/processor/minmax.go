@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// MinMax tracks the minimum and maximum of the samples in State.Min and
+// State.Max. It covers the samples of the last Duration, up to MaxSamples,
+// if set, else those of the window if the state has one, else every sample
+// since the state was reset.
+type MinMax struct {
+	*State
+	Options
+	// Duration is the length of the time window, or 0 if unused
+	Duration time.Duration
+}
+
+// NewMinMax creates a processor tracking the minimum and maximum of the
+// samples over the last duration, or the window of state if 0
+func NewMinMax(state *State, opts Options, duration time.Duration) *MinMax {
+	return &MinMax{State: state, Options: opts, Duration: duration}
+}
+
+// Process implements Processor. It returns the maximum, and the minimum is
+// left in State.Min.
+func (p *MinMax) Process(value float64, t time.Time) (float64, bool) {
+	p.Last = value
+	p.LastTime = t
+	switch {
+	case p.Duration > 0:
+		p.pushSample(value, t, p.Duration, p.MaxSamples)
+		p.Min, p.Max = value, value
+		for _, sample := range p.Samples {
+			p.Min = math.Min(p.Min, sample.Value)
+			p.Max = math.Max(p.Max, sample.Value)
+		}
+	case p.Window != nil:
+		p.Window.Push(value)
+		p.Min, p.Max = p.Window.Min(), p.Window.Max()
+	default:
+		if math.IsNaN(p.Min) || value < p.Min {
+			p.Min = value
+		}
+		if math.IsNaN(p.Max) || value > p.Max {
+			p.Max = value
+		}
+	}
+	if p.debugging() {
+		p.debugf("newvalue=%s | min=%s | max=%s", format(value), format(p.Min), format(p.Max))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return p.Max, true
+}
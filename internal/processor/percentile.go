@@ -0,0 +1,36 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Percentile publishes the Pth percentile of the samples in the window. A
+// partially filled window uses whatever samples it has.
+type Percentile struct {
+	*State
+	Options
+	P float64
+}
+
+// NewPercentile creates a processor publishing the pth percentile of the
+// window of state, which must have one
+func NewPercentile(state *State, opts Options, p float64) *Percentile {
+	return &Percentile{State: state, Options: opts, P: p}
+}
+
+// Process implements Processor
+func (p *Percentile) Process(value float64, t time.Time) (float64, bool) {
+	p.Window.Push(value)
+	p.Last = value
+	p.LastTime = t
+	percentile := p.Window.Percentile(p.P)
+	if p.debugging() {
+		p.debugf("newvalue=%s | samples=%d | percentile=%s", format(value), p.Window.Len(), format(percentile))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return percentile, true
+}
@@ -0,0 +1,84 @@
+// Package processor computes the values published for an input topic from
+// its samples, independently of how the samples arrive or are published.
+package processor
+
+import (
+	"time"
+)
+
+// Processor turns the samples of an input topic into outputs
+type Processor interface {
+	// Process takes value, sampled at t, and returns the output and whether
+	// it should be published
+	Process(value float64, t time.Time) (out float64, publish bool)
+}
+
+// Logger receives the messages processors log about their decisions.
+// A *logrus.Entry satisfies it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// Options configure the processors of a topic
+type Options struct {
+	// PublishFirst diffs the first sample against zero instead of only
+	// storing it
+	PublishFirst bool
+	// MaxValue is the value at which a counter wraps, or 0 if it never wraps
+	MaxValue float64
+	// CounterBits is the width of a counter that wraps within 8, 16, 32, or
+	// 64 bits, or 0 if unused. It replaces MaxValue.
+	CounterBits int
+	// MaxJump is the largest plausible change between samples, or 0 if
+	// unlimited. After MaxJumpResync consecutive outliers the new level is
+	// accepted.
+	MaxJump       float64
+	MaxJumpResync int
+	// MinDiff is the dead-band that a change must reach to be published
+	MinDiff float64
+	// MinInterval is the least time between outputs
+	MinInterval time.Duration
+	// WindowPartial diffs against the earliest sample until the window fills
+	WindowPartial bool
+	// MaxSamples bounds the samples a time window holds, or 0 if unbounded
+	MaxSamples int
+	// Log receives the decisions, or is nil to discard them
+	Log Logger
+	// Debugging reports whether Log takes debug messages, or is nil if it
+	// always does. Debug messages are not formatted unless it does.
+	Debugging func() bool
+}
+
+// debugging reports whether debug messages are logged, so callers can skip
+// formatting them
+func (o *Options) debugging() bool {
+	return o.Log != nil && (o.Debugging == nil || o.Debugging())
+}
+
+// debugf logs to Log, if set
+func (o *Options) debugf(format string, args ...interface{}) {
+	if o.Log != nil {
+		o.Log.Debugf(format, args...)
+	}
+}
+
+// warnf logs to Log, if set
+func (o *Options) warnf(format string, args ...interface{}) {
+	if o.Log != nil {
+		o.Log.Warnf(format, args...)
+	}
+}
+
+// throttled reports whether an output at t comes within MinInterval of the
+// previous output. Otherwise t is recorded as the time of the last output.
+func (o *Options) throttled(s *State, t time.Time) bool {
+	if o.MinInterval <= 0 {
+		return false
+	}
+	if !s.LastPublish.IsZero() && t.Sub(s.LastPublish) < o.MinInterval {
+		return true
+	}
+	s.LastPublish = t
+	return false
+}
@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"math"
+	"sort"
+)
+
+// Ring is a fixed size buffer that holds the most recent samples of a topic.
+// It is allocated once at link time, so pushing never allocates.
+type Ring struct {
+	values []float64
+	start  int
+	count  int
+	// sorted is scratch space for Median
+	sorted []float64
+}
+
+// NewRing creates an empty ring holding at most size samples
+func NewRing(size int) *Ring {
+	return &Ring{values: make([]float64, size)}
+}
+
+// Push appends value, overwriting the oldest sample when the ring is full
+func (r *Ring) Push(value float64) {
+	if r.count < len(r.values) {
+		r.values[(r.start+r.count)%len(r.values)] = value
+		r.count++
+		return
+	}
+	r.values[r.start] = value
+	r.start = (r.start + 1) % len(r.values)
+}
+
+// Oldest returns the oldest sample in the ring. The ring must not be empty.
+func (r *Ring) Oldest() float64 {
+	return r.values[r.start]
+}
+
+// Len returns the number of samples held
+func (r *Ring) Len() int {
+	return r.count
+}
+
+// Size returns the number of samples the ring can hold
+func (r *Ring) Size() int {
+	return len(r.values)
+}
+
+// Full reports whether the ring holds as many samples as it can
+func (r *Ring) Full() bool {
+	return r.count == len(r.values)
+}
+
+// Mean returns the arithmetic mean of the samples held.
+// The ring must not be empty.
+func (r *Ring) Mean() float64 {
+	// Until the ring wraps the samples are at the front, and once it
+	// is full every slot holds a sample, so order does not matter
+	var sum float64
+	for _, value := range r.values[:r.count] {
+		sum += value
+	}
+	return sum / float64(r.count)
+}
+
+// Min returns the smallest of the samples held. The ring must not be empty.
+func (r *Ring) Min() float64 {
+	min := r.values[0]
+	for _, value := range r.values[1:r.count] {
+		min = math.Min(min, value)
+	}
+	return min
+}
+
+// Max returns the largest of the samples held. The ring must not be empty.
+func (r *Ring) Max() float64 {
+	max := r.values[0]
+	for _, value := range r.values[1:r.count] {
+		max = math.Max(max, value)
+	}
+	return max
+}
+
+// Median returns the median of the samples held, or the mean of the middle
+// two of an even number of samples. The ring must not be empty.
+func (r *Ring) Median() float64 {
+	return r.Percentile(50)
+}
+
+// Percentile returns the pth percentile of the samples held, interpolating
+// linearly between the closest ranks, so the 0th is the smallest sample and
+// the 100th the largest. The ring must not be empty.
+func (r *Ring) Percentile(p float64) float64 {
+	if r.sorted == nil {
+		r.sorted = make([]float64, len(r.values))
+	}
+	sorted := r.sorted[:copy(r.sorted, r.values[:r.count])]
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
+
+// StdDev returns the sample standard deviation of the samples held. The
+// ring must hold at least two samples.
+func (r *Ring) StdDev() float64 {
+	// Two passes over the samples avoid the cancellation of summing
+	// squares, and cost no more than Mean
+	mean := r.Mean()
+	var sum float64
+	for _, value := range r.values[:r.count] {
+		sum += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(sum / float64(r.count-1))
+}
+
+// Reset empties the ring
+func (r *Ring) Reset() {
+	r.start = 0
+	r.count = 0
+}
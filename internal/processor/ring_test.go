@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// fillRing returns a full ring of size random samples
+func fillRing(size int) *Ring {
+	r := NewRing(size)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < size; i++ {
+		r.Push(rng.Float64() * 100)
+	}
+	return r
+}
+
+func BenchmarkRing(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("Push/%d", size), func(b *testing.B) {
+			r := fillRing(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Push(float64(i))
+			}
+		})
+		b.Run(fmt.Sprintf("Mean/%d", size), func(b *testing.B) {
+			r := fillRing(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Push(float64(i))
+				r.Mean()
+			}
+		})
+		b.Run(fmt.Sprintf("Percentile/%d", size), func(b *testing.B) {
+			r := fillRing(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Push(float64(i))
+				r.Percentile(95)
+			}
+		})
+	}
+}
+
+func TestRingPercentile(t *testing.T) {
+	// Matches statistics.quantiles(data, method="inclusive") in Python
+	r := NewRing(10)
+	for _, value := range []float64{7, 1, 10, 3, 5, 2, 9, 4, 8, 6} {
+		r.Push(value)
+	}
+	for _, test := range []struct{ p, want float64 }{
+		{0, 1}, {25, 3.25}, {50, 5.5}, {75, 7.75}, {90, 9.1}, {100, 10},
+	} {
+		if got := r.Percentile(test.p); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("Percentile(%v) = %v, want %v", test.p, got, test.want)
+		}
+	}
+}
+
+// percentile is the Hyndman and Fan type 7 estimate of the pth percentile
+// of values, which is what Ring.Percentile implements
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	h := (float64(len(sorted))-1)*p/100 + 1
+	below := math.Floor(h)
+	if int(below) >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[int(below)-1] + (h-below)*(sorted[int(below)]-sorted[int(below)-1])
+}
+
+func TestRingPercentileReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 2, 5, 64} {
+		r := NewRing(size)
+		var pushed []float64
+		// Overfill the ring so it wraps around
+		for i := 0; i < size*3/2+1; i++ {
+			value := math.Round(rng.NormFloat64()*1000) / 10
+			r.Push(value)
+			pushed = append(pushed, value)
+		}
+		window := pushed[len(pushed)-r.Len():]
+		for _, p := range []float64{0.1, 1, 25, 33.3, 50, 95, 99.9, 100} {
+			want := percentile(window, p)
+			if got := r.Percentile(p); math.Abs(got-want) > 1e-9 {
+				t.Errorf("size %d: Percentile(%v) = %v, want %v", size, p, got, want)
+			}
+		}
+	}
+}
+
+// stddev computes the sample standard deviation of values with enough
+// precision to serve as a reference
+func stddev(values []float64) float64 {
+	const prec = 512
+	sum := new(big.Float).SetPrec(prec)
+	for _, value := range values {
+		sum.Add(sum, big.NewFloat(value))
+	}
+	n := new(big.Float).SetPrec(prec).SetInt64(int64(len(values)))
+	mean := new(big.Float).SetPrec(prec).Quo(sum, n)
+	squares := new(big.Float).SetPrec(prec)
+	for _, value := range values {
+		d := new(big.Float).SetPrec(prec).Sub(big.NewFloat(value), mean)
+		squares.Add(squares, d.Mul(d, d))
+	}
+	squares.Quo(squares, n.Sub(n, big.NewFloat(1)))
+	variance, _ := squares.Float64()
+	return math.Sqrt(variance)
+}
+
+func TestRingStdDevLargeOffset(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, offset := range []float64{0, 1e6, 1e9, 1e12} {
+		r := NewRing(100)
+		var values []float64
+		for i := 0; i < 100; i++ {
+			value := offset + rng.Float64()*10
+			r.Push(value)
+			values = append(values, value)
+		}
+		want := stddev(values)
+		if got := r.StdDev(); math.Abs(got-want) > 1e-6*want {
+			t.Errorf("offset %g: StdDev() = %v, want %v", offset, got, want)
+		}
+	}
+}
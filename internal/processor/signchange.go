@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// SignChange publishes the new sign of the diff whenever it differs from the
+// sign of the previous diff, as 1 when rising and -1 when falling. Diffs
+// within DeadBand of zero are ignored, and the next diff is taken from the
+// same sample in Prev, so slow drifts still register. The current sign is
+// kept in LastDiff.
+type SignChange struct {
+	*State
+	Options
+	DeadBand float64
+}
+
+// NewSignChange creates a processor publishing the changes in sign of the
+// diff, ignoring diffs within deadband of zero
+func NewSignChange(state *State, opts Options, deadband float64) *SignChange {
+	return &SignChange{State: state, Options: opts, DeadBand: deadband}
+}
+
+// Process implements Processor
+func (p *SignChange) Process(value float64, t time.Time) (float64, bool) {
+	// Prev holds the sample diffs are taken from, which is left unset by
+	// seeding and restoring
+	ref := p.Prev
+	if math.IsNaN(ref) {
+		ref = p.Last
+	}
+	p.Last = value
+	p.LastTime = t
+	if math.IsNaN(ref) {
+		if p.debugging() {
+			p.debugf("Setting first value | newvalue=%s", format(value))
+		}
+		p.Prev = value
+		return 0, false
+	}
+
+	diff := value - ref
+	if math.Abs(diff) <= p.DeadBand {
+		if p.debugging() {
+			p.debugf("Ignoring diff within the dead band | refvalue=%.10f | newvalue=%.10f", ref, value)
+		}
+		p.Prev = ref
+		return 0, false
+	}
+	p.Prev = value
+
+	sign := math.Copysign(1, diff)
+	previous := p.LastDiff
+	p.LastDiff = sign
+	if math.IsNaN(previous) || sign == previous {
+		if p.debugging() {
+			p.debugf("lastsign=%s | sign=%s", format(previous), format(sign))
+		}
+		return 0, false
+	}
+	if p.debugging() {
+		p.debugf("Sign changed | lastsign=%s | sign=%s", format(previous), format(sign))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	return sign, true
+}
@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Slope publishes the least squares slope of the samples of the last
+// Duration, up to MaxSamples, per Unit of time
+type Slope struct {
+	*State
+	Options
+	Duration time.Duration
+	Unit     time.Duration
+}
+
+// NewSlope creates a processor publishing the slope of the samples over the
+// last duration, per unit of time
+func NewSlope(state *State, opts Options, duration, unit time.Duration) *Slope {
+	return &Slope{State: state, Options: opts, Duration: duration, Unit: unit}
+}
+
+// Process implements Processor
+func (p *Slope) Process(value float64, t time.Time) (float64, bool) {
+	p.Last = value
+	p.LastTime = t
+	p.pushSample(value, t, p.Duration, p.MaxSamples)
+
+	// Times are taken relative to the oldest sample, which keeps the sums
+	// small enough to stay accurate
+	origin := p.Samples[0].Time
+	n := float64(len(p.Samples))
+	var sumx, sumy float64
+	for _, sample := range p.Samples {
+		sumx += float64(sample.Time.Sub(origin)) / float64(p.Unit)
+		sumy += sample.Value
+	}
+	meanx, meany := sumx/n, sumy/n
+	var sxx, sxy float64
+	for _, sample := range p.Samples {
+		dx := float64(sample.Time.Sub(origin))/float64(p.Unit) - meanx
+		sxx += dx * dx
+		sxy += dx * (sample.Value - meany)
+	}
+	if sxx == 0 {
+		if p.debugging() {
+			p.debugf("Waiting for samples at different times | newvalue=%s | samples=%d", format(value), len(p.Samples))
+		}
+		return 0, false
+	}
+	slope := sxy / sxx
+	if p.debugging() {
+		p.debugf("newvalue=%s | samples=%d | slope=%s", format(value), len(p.Samples), format(slope))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return slope, true
+}
@@ -0,0 +1,106 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// State is the running state of an input topic. Processors update it, and
+// the service persists, reports, and resets it.
+type State struct {
+	// Last is the last sample, taken at LastTime, or NaN until the first
+	Last     float64
+	LastTime time.Time
+	// Prev is the sample the last output was computed from, or NaN if it
+	// was not computed from an earlier sample
+	Prev float64
+	// LastDiff is the previous first difference of a second difference, or
+	// the current sign of a sign change
+	LastDiff float64
+	// Sum accumulates the samples of a sum or integral, or holds the
+	// baseline of a daily delta
+	Sum float64
+	// Period is the start of the day the daily delta baseline was taken
+	// for, or zero until the first
+	Period time.Time
+	// Window holds the most recent samples, or is nil if unused
+	Window *Ring
+	// Samples holds the samples of a time window, oldest first
+	Samples []Sample
+	// Min and Max are the extremes of a min/max, or NaN until the first
+	// sample
+	Min float64
+	Max float64
+	// LastPublish is when the last output was let through MinInterval
+	LastPublish time.Time
+	// Pending accumulates the diffs held back by MinInterval since
+	// PendingSince, the time of the sample they start from
+	Pending      float64
+	PendingSince time.Time
+	// Outliers is the number of consecutive samples rejected by MaxJump
+	Outliers int
+}
+
+// Sample is a sample and the time it was taken at
+type Sample struct {
+	Value float64
+	Time  time.Time
+}
+
+// NewState creates an empty state with a window of the given number of
+// samples, or none if window is 0
+func NewState(window int) *State {
+	s := new(State)
+	if window > 0 {
+		s.Window = NewRing(window)
+	}
+	s.Reset()
+	return s
+}
+
+// Reset clears the state, so the topic starts over as if just linked
+func (s *State) Reset() {
+	s.Last = math.NaN()
+	s.LastTime = time.Time{}
+	s.Prev = math.NaN()
+	s.LastDiff = math.NaN()
+	s.Sum = 0
+	s.Period = time.Time{}
+	if s.Window != nil {
+		s.Window.Reset()
+	}
+	s.Samples = s.Samples[:0]
+	s.Min = math.NaN()
+	s.Max = math.NaN()
+	s.LastPublish = time.Time{}
+	s.Pending = 0
+	s.PendingSince = time.Time{}
+	s.Outliers = 0
+}
+
+// Seed stores value, sampled at t, as the last sample without producing an
+// output
+func (s *State) Seed(value float64, t time.Time) {
+	s.Last = value
+	s.LastTime = t
+	if s.Window != nil {
+		s.Window.Reset()
+		s.Window.Push(value)
+	}
+}
+
+// pushSample appends value, sampled at t, to Samples, and drops the samples
+// older than duration before t, as well as the oldest beyond max samples if
+// max is positive. The sample at t is always kept.
+func (s *State) pushSample(value float64, t time.Time, duration time.Duration, max int) {
+	s.Samples = append(s.Samples, Sample{Value: value, Time: t})
+	expired := 0
+	for expired < len(s.Samples)-1 && t.Sub(s.Samples[expired].Time) > duration {
+		expired++
+	}
+	if max > 0 && len(s.Samples)-expired > max {
+		expired = len(s.Samples) - max
+	}
+	// Shift down rather than reslice, so the backing array is reused
+	s.Samples = s.Samples[:copy(s.Samples, s.Samples[expired:])]
+}
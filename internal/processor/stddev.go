@@ -0,0 +1,42 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// StdDev publishes the sample standard deviation of the samples in the
+// window. A partially filled window uses whatever samples it has, once it
+// has two.
+type StdDev struct {
+	*State
+	Options
+}
+
+// NewStdDev creates a processor publishing the standard deviation of the
+// window of state, which must have one
+func NewStdDev(state *State, opts Options) *StdDev {
+	return &StdDev{State: state, Options: opts}
+}
+
+// Process implements Processor
+func (p *StdDev) Process(value float64, t time.Time) (float64, bool) {
+	p.Window.Push(value)
+	p.Last = value
+	p.LastTime = t
+	if p.Window.Len() < 2 {
+		if p.debugging() {
+			p.debugf("Setting first value | newvalue=%s", format(value))
+		}
+		return 0, false
+	}
+	stddev := p.Window.StdDev()
+	if p.debugging() {
+		p.debugf("newvalue=%s | samples=%d | stddev=%s", format(value), p.Window.Len(), format(stddev))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return stddev, true
+}
@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"math"
+	"time"
+)
+
+// Sum publishes the running total of the samples. The total starts from zero
+// at link time, so every sample counts.
+type Sum struct {
+	*State
+	Options
+}
+
+// NewSum creates a processor publishing the running total of the samples
+func NewSum(state *State, opts Options) *Sum {
+	return &Sum{State: state, Options: opts}
+}
+
+// Process implements Processor
+func (p *Sum) Process(value float64, t time.Time) (float64, bool) {
+	p.Sum += value
+	p.Last = value
+	p.LastTime = t
+	if p.debugging() {
+		p.debugf("newvalue=%s | sum=%s", format(value), format(p.Sum))
+	}
+	if p.throttled(p.State, t) {
+		return 0, false
+	}
+	p.Prev = math.NaN()
+	return p.Sum, true
+}
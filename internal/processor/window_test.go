@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// BenchmarkWindow measures the processors recomputing over the window on
+// every message
+func BenchmarkWindow(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		for _, bench := range []struct {
+			name string
+			new  func(*State) Processor
+		}{
+			{"Avg", func(s *State) Processor { return NewAvg(s, Options{}) }},
+			{"StdDev", func(s *State) Processor { return NewStdDev(s, Options{}) }},
+			{"Percentile", func(s *State) Processor { return NewPercentile(s, Options{}, 95) }},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bench.name, size), func(b *testing.B) {
+				p := bench.new(NewState(size))
+				now := epoch
+				for i := 0; i < size; i++ {
+					now = now.Add(time.Second)
+					p.Process(float64(i%37), now)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					now = now.Add(time.Second)
+					p.Process(float64(i%37), now)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonStep is a step of the path to the value in JSON payloads, either the
+// key of an object or, if index is not negative, the index of an array
+type jsonStep struct {
+	key   string
+	index int
+}
+
+// pathError is returned for JSON payloads that decode but hold no number at
+// the path of the topic
+type pathError struct {
+	message string
+}
+
+func (e *pathError) Error() string {
+	return e.message
+}
+
+// fieldPath returns the path of the JsonField value field, whose elements
+// are the keys of nested objects separated by dots
+func fieldPath(field string) ([]jsonStep, error) {
+	var path []jsonStep
+	for _, key := range strings.Split(field, ".") {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("has an empty path element")
+		}
+		path = append(path, jsonStep{key: key, index: -1})
+	}
+	return path, nil
+}
+
+// parseJSONPath parses the JsonPath value, such as data.sensors[2].value,
+// whose object keys are separated by dots and array indices are given in
+// brackets
+func parseJSONPath(value string) ([]jsonStep, error) {
+	var path []jsonStep
+	for i := 0; i < len(value); {
+		switch {
+		case value[i] == '[':
+			end := strings.IndexByte(value[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("has an unterminated [ at %d", i+1)
+			}
+			index, err := strconv.Atoi(value[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("has an invalid array index %q", value[i+1:i+end])
+			}
+			path = append(path, jsonStep{index: index})
+			i += end + 1
+		case len(path) > 0 && value[i] != '.':
+			return nil, fmt.Errorf("has %q where . or [ is expected at %d", value[i], i+1)
+		case len(path) > 0:
+			i++
+			fallthrough
+		default:
+			end := strings.IndexAny(value[i:], ".[]")
+			if end < 0 {
+				end = len(value) - i
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("has an empty key at %d", i+1)
+			}
+			path = append(path, jsonStep{key: value[i : i+end], index: -1})
+			i += end
+		}
+	}
+	return path, nil
+}
+
+// formatJSONPath renders the path the way JsonPath is written
+func formatJSONPath(path []jsonStep) string {
+	var buf bytes.Buffer
+	for i, step := range path {
+		if step.index >= 0 {
+			fmt.Fprintf(&buf, "[%d]", step.index)
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte('.')
+		}
+		buf.WriteString(step.key)
+	}
+	return buf.String()
+}
+
+// parseJSONField decodes payload as JSON and returns the number found by
+// following path through the nested objects and arrays. If booleans is
+// set, true and false are taken as 1 and 0. A payload holding no number
+// at the path returns a *pathError.
+func parseJSONField(payload []byte, path []jsonStep, booleans bool) (float64, error) {
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return 0, err
+	}
+	return resolvePath(doc, path, booleans)
+}
+
+// resolvePath returns the number found by following path through the
+// decoded payload doc, like parseJSONField. An empty path takes doc itself
+// as the number.
+func resolvePath(doc interface{}, path []jsonStep, booleans bool) (float64, error) {
+	for i, step := range path {
+		if step.index >= 0 {
+			array, ok := doc.([]interface{})
+			if !ok {
+				return 0, &pathError{fmt.Sprintf("parent of %s is not an array", formatJSONPath(path[:i+1]))}
+			}
+			if step.index >= len(array) {
+				return 0, &pathError{fmt.Sprintf("%s is out of range of %d elements", formatJSONPath(path[:i+1]), len(array))}
+			}
+			doc = array[step.index]
+			continue
+		}
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return 0, &pathError{fmt.Sprintf("parent of field %s is not an object", formatJSONPath(path[:i+1]))}
+		}
+		if doc, ok = obj[step.key]; !ok {
+			return 0, &pathError{fmt.Sprintf("field %s not found", formatJSONPath(path[:i+1]))}
+		}
+	}
+	if b, ok := doc.(bool); ok && booleans {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	value, ok := doc.(float64)
+	if !ok && len(path) == 0 {
+		return 0, &pathError{"payload is not a number"}
+	}
+	if !ok {
+		return 0, &pathError{fmt.Sprintf("field %s is not a number", formatJSONPath(path))}
+	}
+	return value, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// listSeparators separate the entries of most list values
+	listSeparators = ",;"
+	// convertSeparators separate the entries of Convert, whose linear
+	// conversions contain commas themselves
+	convertSeparators = ";"
+	// regexSeparators separate the entries of ExtractRegex, whose
+	// expressions may contain commas, as in the quantifier {1,3}
+	regexSeparators = ";"
+)
+
+// parseList splits value into its entries, which are separated by any of
+// the bytes in separators or by line breaks, and trims the whitespace around
+// each entry. An empty entry between two separators is kept, so it can stand
+// for a default, but blank lines are not entries. An entry in double quotes
+// is taken as is, separators and whitespace included, with \" and \\
+// standing for a quote and a backslash. A blank value has no entries.
+func parseList(value, separators string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var entries []string
+	var entry strings.Builder
+	// started is set once the entry has content, and quoted if that
+	// content was quoted
+	started, quoted := false, false
+	next := func() {
+		if quoted {
+			entries = append(entries, entry.String())
+		} else {
+			entries = append(entries, strings.TrimSpace(entry.String()))
+		}
+		entry.Reset()
+		started, quoted = false, false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(separators, c) >= 0:
+			next()
+		case c == '\n':
+			// Line breaks only end entries that have content, so a list
+			// may break lines after its separators and skip lines
+			if started {
+				next()
+			}
+		case quoted:
+			if !isListSpace(c) {
+				return nil, fmt.Errorf("unexpected %q after the quoted entry \"%s\"", c, entry.String())
+			}
+		case c == '"' && !started:
+			// Drop the whitespace before the quote
+			entry.Reset()
+			end := i + 1
+			for ; end < len(value) && value[end] != '"'; end++ {
+				if value[end] == '\\' && end+1 < len(value) && (value[end+1] == '"' || value[end+1] == '\\') {
+					end++
+				}
+				entry.WriteByte(value[end])
+			}
+			if end == len(value) {
+				return nil, fmt.Errorf("unterminated quote in entry %d", len(entries)+1)
+			}
+			i = end
+			started, quoted = true, true
+		default:
+			entry.WriteByte(c)
+			if !isListSpace(c) {
+				started = true
+			}
+		}
+	}
+	next()
+	return entries, nil
+}
+
+// isListSpace reports whether c is whitespace around a list entry, other
+// than a line break
+func isListSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
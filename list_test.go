@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		value      string
+		separators string
+		want       []string
+	}{
+		{"", listSeparators, nil},
+		{"  \n ", listSeparators, nil},
+		{"a", listSeparators, []string{"a"}},
+		{"a,b;c", listSeparators, []string{"a", "b", "c"}},
+		{" a , b ", listSeparators, []string{"a", "b"}},
+		{"a b, c", listSeparators, []string{"a b", "c"}},
+		{"a\nb\nc", listSeparators, []string{"a", "b", "c"}},
+		{"a\r\nb\r\n", listSeparators, []string{"a", "b"}},
+		{"a,\nb,\nc", listSeparators, []string{"a", "b", "c"}},
+		{"a\n\n\nb", listSeparators, []string{"a", "b"}},
+		// Empty entries between separators stand for the default
+		{"a,,b", listSeparators, []string{"a", "", "b"}},
+		{"a, ,b", listSeparators, []string{"a", "", "b"}},
+		{",a", listSeparators, []string{"", "a"}},
+		{"a,", listSeparators, []string{"a", ""}},
+		{`"a,b", c`, listSeparators, []string{"a,b", "c"}},
+		{`" a ", b`, listSeparators, []string{" a ", "b"}},
+		{`"a\"b", "c\\d"`, listSeparators, []string{`a"b`, `c\d`}},
+		{`"a\nb"`, listSeparators, []string{`a\nb`}},
+		{`""`, listSeparators, []string{""}},
+		{`  "a"  ;b`, listSeparators, []string{"a", "b"}},
+		{"a\"b", listSeparators, []string{`a"b`}},
+		{"linear:1.8,32; linear:2,0", convertSeparators, []string{"linear:1.8,32", "linear:2,0"}},
+		{"linear:1.8,32\nlinear:2,0", convertSeparators, []string{"linear:1.8,32", "linear:2,0"}},
+	}
+	for _, test := range tests {
+		got, err := parseList(test.value, test.separators)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseList(%q, %q) = %q, %v, want %q", test.value, test.separators, got, err, test.want)
+		}
+	}
+}
+
+func TestParseListMalformedQuotes(t *testing.T) {
+	for _, value := range []string{
+		`"a`,
+		`a, "b`,
+		`"a\"`,
+		`"a" b`,
+		`"a"b, c`,
+	} {
+		if got, err := parseList(value, listSeparators); err == nil {
+			t.Errorf("parseList(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+func TestConfigureReportsListErrors(t *testing.T) {
+	_, status := configure(map[string]string{configKeyInputTopics: `a, "b`})
+	if !strings.HasPrefix(status, "Error: ") || !strings.Contains(status, configKeyInputTopics) {
+		t.Errorf("got status %q, want an error naming %s", status, configKeyInputTopics)
+	}
+}
@@ -5,17 +5,16 @@
 package main
 
 import (
-	"math"
+	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/openchirp/framework/rest"
 
 	"github.com/openchirp/framework"
-	"github.com/openchirp/framework/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -25,16 +24,92 @@ const (
 )
 
 const (
-	configKeyInputTopics  = "InputTopics"
-	configKeyOutputTopics = "OutputTopics"
+	configKeyInputTopics    = "InputTopics"
+	configKeyOutputTopics   = "OutputTopics"
+	configKeyPublishFirst   = "PublishFirstSample"
+	configKeyMode           = "Mode"
+	configKeyModes          = "Modes"
+	configKeyRateUnit       = "RateUnit"
+	configKeyPrecision      = "Precision"
+	configKeyFormat         = "Format"
+	configKeyMaxValue       = "MaxValue"
+	configKeyCounterReset   = "CounterReset"
+	configKeyAbsolute       = "Absolute"
+	configKeyInvert         = "Invert"
+	configKeyOutputInteger  = "OutputInteger"
+	configKeyMinDiff        = "MinDiff"
+	configKeyMaxJump        = "MaxJump"
+	configKeyMaxJumpResync  = "MaxJumpResync"
+	configKeyScale          = "Scale"
+	configKeyClampMin       = "ClampMin"
+	configKeyClampMax       = "ClampMax"
+	configKeyClampMode      = "ClampMode"
+	configKeySmooth         = "Smooth"
+	configKeySmoothAlpha    = "SmoothAlpha"
+	configKeySmoothTarget   = "SmoothTarget"
+	configKeyWindow         = "Window"
+	configKeyWindowFill     = "WindowFill"
+	configKeyPairDiff       = "PairDiff"
+	configKeyPairOutput     = "PairOutputTopic"
+	configKeyJSONField      = "JsonField"
+	configKeyArrayDiff      = "ArrayDiff"
+	configKeyTimestamped    = "TimestampedPayload"
+	configKeyTimestampDelim = "TimestampDelimiter"
+	configKeySeedRetained   = "SeedFromRetained"
+	configKeyInitialValues  = "InitialValues"
+	configKeyMinInterval    = "MinInterval"
+	configKeyStaleTimeout   = "StaleTimeout"
+	configKeyStaleMarker    = "StaleMarker"
+	configKeyRepublish      = "Republish"
+	configKeyOutputPrefix   = "OutputPrefix"
+	configKeyOutputSuffix   = "OutputSuffix"
+	configKeyOutputFormat   = "OutputFormat"
+	configKeyAllowNonFinite = "AllowNonFinite"
+	configKeyDryRun         = "DryRun"
+	configKeyPublishStats   = "PublishStats"
+	configKeyStatsInterval  = "StatsInterval"
+	configKeyPublishErrors  = "PublishErrors"
+	configKeyStripUnits     = "StripUnits"
+	configKeyDecimalComma   = "DecimalComma"
+	configKeyExpression     = "Expression"
+	configKeyTimeUnit       = "TimeUnit"
+	configKeyResetTime      = "ResetTime"
+	configKeyTimezone       = "Timezone"
+	configKeyRatePer        = "RatePer"
+	configKeyDeadBand       = "DeadBand"
+	configKeyMaxPoints      = "MaxPoints"
+	configKeyMedianWindow   = "MedianWindow"
+	configKeyEdgeType       = "EdgeType"
+	configKeyPercentile     = "Percentile"
+	configKeyParseBase      = "ParseBase"
+	configKeyCounterBits    = "CounterBits"
+	configKeyUnitHandling   = "UnitHandling"
+	configKeyConvert        = "Convert"
+	configKeyQoS            = "QoS"
+	configKeyRetain         = "Retain"
+	configKeyConfigJSON     = "ConfigJSON"
+	configKeyIgnoreValues   = "IgnoreValues"
+	configKeyIgnoreEpsilon  = "IgnoreEpsilon"
+	configKeyValidMin       = "ValidMin"
+	configKeyValidMax       = "ValidMax"
+	configKeyExtractRegex   = "ExtractRegex"
+	configKeyEncoding       = "PayloadEncoding"
+	configKeyPayloadOffset  = "PayloadOffset"
+	configKeyPayloadBase64  = "PayloadBase64"
+	configKeyJSONPath       = "JsonPath"
+	configKeyJSONAllFields  = "JsonAllFields"
+	configKeyJSONMaxFields  = "JsonMaxFields"
+	configKeyPayloadFormat  = "PayloadFormat"
+	configKeyCombinedOutput = "CombinedOutput"
+	configKeyCombinedPeriod = "CombinedInterval"
 )
 
 var configParams = []rest.ServiceConfigParameter{
 	rest.ServiceConfigParameter{
 		Name:        configKeyInputTopics,
-		Description: "Comma separated list of input topics to apply the diff to",
+		Description: "Comma separated list of input topics to apply the diff to, which may use + wildcards",
 		Example:     "frequency, temp",
-		Required:    true,
+		Required:    false,
 	},
 	rest.ServiceConfigParameter{
 		Name:        configKeyOutputTopics,
@@ -42,126 +117,656 @@ var configParams = []rest.ServiceConfigParameter{
 		Example:     "frequency_diff, temp_diff",
 		Required:    false,
 	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPublishFirst,
+		Description: "Publish the first sample after linking as a diff against zero",
+		Example:     "false",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMode,
+		Description: "Default processing mode for all topics: diff, rate, counter, sum, diff2, avg, integrate, daily, stddev, minmax, signchange, slope, edges, edgecount, or percentile",
+		Example:     "diff",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyModes,
+		Description: "Comma separated list of processing modes per input topic, overriding Mode for non-empty entries",
+		Example:     "counter, rate",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyRateUnit,
+		Description: "Time unit of the rate and slope mode output: second, minute, or hour",
+		Example:     "minute",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPrecision,
+		Description: "Number of decimal places published, or -1 for the shortest representation",
+		Example:     "2",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyFormat,
+		Description: "Number format of fixed, which honors Precision, or shortest, which publishes the shortest representation with an exponent for very large or small values",
+		Example:     "shortest",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMaxValue,
+		Description: "Comma separated list of values at which each input counter wraps to zero",
+		Example:     "4294967296, ",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyCounterReset,
+		Description: "What counter mode publishes after a reset: value or zero",
+		Example:     "value",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyAbsolute,
+		Description: "Publish the magnitude of the diff, for all topics or as a comma separated list per topic",
+		Example:     "true, false",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyInvert,
+		Description: "Publish the previous minus the current value, for all topics or as a comma separated list per topic",
+		Example:     "true, false",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyOutputInteger,
+		Description: "Publish the scaled value rounded to the nearest integer, for all topics or as a comma separated list per topic",
+		Example:     "true, false",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMinDiff,
+		Description: "Smallest change that is published; smaller changes accumulate until they reach it",
+		Example:     "0.05",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMaxJump,
+		Description: "Largest plausible change between samples; larger changes are rejected as outliers",
+		Example:     "50",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMaxJumpResync,
+		Description: "Number of consecutive outliers after which the new value is accepted without publishing, which defaults to 3",
+		Example:     "5",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyScale,
+		Description: "Factor applied to the published value, for all topics or as a comma separated list per topic",
+		Example:     "0.5, 1",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyClampMin,
+		Description: "Lowest result published, with lower results handled according to ClampMode",
+		Example:     "-100",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyClampMax,
+		Description: "Highest result published, with higher results handled according to ClampMode",
+		Example:     "100",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyClampMode,
+		Description: "clip publishes results outside of ClampMin and ClampMax as the nearest bound, and drop does not publish them",
+		Example:     "drop",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeySmooth,
+		Description: "Smoothing filter to apply: none or ewma (exponentially weighted moving average)",
+		Example:     "ewma",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeySmoothAlpha,
+		Description: "Weight of the newest sample in the ewma filter, in the range (0,1]",
+		Example:     "0.2",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeySmoothTarget,
+		Description: "Whether smoothing applies to the input values or the output diffs: input or output",
+		Example:     "output",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyWindow,
+		Description: "Number of samples to diff across, or to average over in avg mode",
+		Example:     "10",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyWindowFill,
+		Description: "Behavior until the window fills: wait (publish nothing) or partial (diff against the earliest sample)",
+		Example:     "wait",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPairDiff,
+		Description: "Two comma separated topics whose latest values are subtracted (first minus second)",
+		Example:     "supply_temp, return_temp",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPairOutput,
+		Description: "Output topic of the PairDiff difference, defaulting to <first>_minus_<second>",
+		Example:     "temp_drop",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyJSONField,
+		Description: "Dotted path of the number in JSON payloads, for all topics or as a comma separated list per topic",
+		Example:     "sensors.temp",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyArrayDiff,
+		Description: "Diff JSON arrays of numbers element by element, for all topics or as a comma separated list per topic",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyTimestamped,
+		Description: "Payloads carry their sample time in epoch seconds after the delimiter, as in 23.5@1653480000",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyTimestampDelim,
+		Description: "Delimiter between the value and the timestamp in timestamped payloads",
+		Example:     "@",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeySeedRetained,
+		Description: "Use the retained message of each input topic to seed its last value instead of diffing it",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyInitialValues,
+		Description: "Comma separated list of the known current values of the input topics, so their first message produces a diff. Empty entries seed nothing",
+		Example:     "1200, 0,",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMinInterval,
+		Description: "Least time between publishes of each output topic, with the diffs in between accumulated into the next publish",
+		Example:     "1s",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyStaleTimeout,
+		Description: "Time an input topic may go without a message before StaleMarker is published to its output topic with a _status suffix",
+		Example:     "10m",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyStaleMarker,
+		Description: "Payload published when an input topic goes stale, which defaults to stale",
+		Example:     "offline",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyRepublish,
+		Description: "Interval the last output of each topic is published again at when no new output was published",
+		Example:     "5m",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyOutputPrefix,
+		Description: "Prefix of the output topics not given in OutputTopics",
+		Example:     "derived/",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyOutputSuffix,
+		Description: "Suffix of the output topics not given in OutputTopics, which defaults to _diff or the service's --default-suffix",
+		Example:     "_rate",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyOutputFormat,
+		Description: "Publish the plain result or a JSON object with the value, previous value, result, and time",
+		Example:     "json",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyAllowNonFinite,
+		Description: "Process NaN and infinite inputs and publish non-finite results instead of dropping them",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyDryRun,
+		Description: "Log the outputs instead of publishing them",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPublishStats,
+		Description: "Periodically publish message counts and the last values of each input topic as JSON to diff_stats",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyStatsInterval,
+		Description: "Interval PublishStats publishes at, which defaults to 1m",
+		Example:     "5m",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPublishErrors,
+		Description: "Publish the input topic and payload of messages that are not numbers or outside the valid range to diff_error, at most once a minute per topic",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyStripUnits,
+		Description: "Ignore a trailing unit in plain text payloads, such as the C of 23.5 C",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyDecimalComma,
+		Description: "Accept a comma as the decimal separator in plain text payloads, such as 1,5",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyExpression,
+		Description: "Formula published for each message instead of a Mode, using the variables value, last, dt, and index",
+		Example:     "(value - last) * 0.5 + 3",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyTimeUnit,
+		Description: "Time unit the integrate mode integrates over: second, minute, or hour",
+		Example:     "hour",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyResetTime,
+		Description: "Time of day the daily mode baseline is taken at, as HH:MM",
+		Example:     "00:00",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyTimezone,
+		Description: "IANA time zone of ResetTime, defaulting to the service's local time",
+		Example:     "America/New_York",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyRatePer,
+		Description: "Duration the rate and slope mode output is per, such as 15m, in place of RateUnit",
+		Example:     "1h",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyDeadBand,
+		Description: "Largest diff around zero the signchange mode ignores",
+		Example:     "0.5",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMaxPoints,
+		Description: "Most samples a Window duration holds, dropping the oldest beyond it",
+		Example:     "1000",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMedianWindow,
+		Description: "Replace each input with the median of the latest inputs, an odd number from 3 to 25, to remove single sample spikes",
+		Example:     "5",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyEdgeType,
+		Description: "Edges the edges and edgecount modes detect: rising, falling, or both",
+		Example:     "both",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPercentile,
+		Description: "Percentile of the Window the percentile mode publishes, greater than 0 and at most 100",
+		Example:     "95",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyParseBase,
+		Description: "10 parses plain text payloads as decimal numbers, and auto also accepts integers prefixed with 0x or 0b",
+		Example:     "auto",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyCounterBits,
+		Description: "Width in bits at which each input counter wraps: 8, 16, 32, or 64, for all topics or as a comma separated list per topic",
+		Example:     "16",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyUnitHandling,
+		Description: "What to do with a trailing unit in plain text payloads: strip it, passthrough to append it to the output, or json to only add it to JSON output",
+		Example:     "passthrough",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyConvert,
+		Description: "Conversion applied to the inputs before any other processing, for all topics or as a semicolon separated list per topic: a built in conversion like f2c or psi2kpa, or linear:scale,offset",
+		Example:     "f2c; linear:0.1,-40",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyQoS,
+		Description: "MQTT QoS of the published outputs: 0, 1, or 2, which defaults to the service's default QoS",
+		Example:     "1",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyRetain,
+		Description: "Set to true to publish the outputs as retained messages, which defaults to the service's default",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyConfigJSON,
+		Description: "JSON array of objects configuring one input topic each, in place of InputTopics, OutputTopics, Modes, Scale, and the other per-topic lists",
+		Example:     `[{"in":"temp","out":"temp_rate","mode":"rate","scale":0.1}]`,
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyIgnoreValues,
+		Description: "Comma separated list of sentinel values, such as a disconnected probe reading, whose messages are dropped without updating the state",
+		Example:     "-9999,65535",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyIgnoreEpsilon,
+		Description: "Largest difference from an IgnoreValues entry at which an input still counts as that value",
+		Example:     "0.001",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyValidMin,
+		Description: "Comma separated list of the smallest valid input of each topic, below which readings are rejected, or a single value for all topics",
+		Example:     "0",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyValidMax,
+		Description: "Comma separated list of the largest valid input of each topic, above which readings are rejected, or a single value for all topics",
+		Example:     "100",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyExtractRegex,
+		Description: "Comma separated list of regular expressions whose first capture group is parsed as the value of each topic, or a single one for all topics",
+		Example:     "T=([-0-9.]+)",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyEncoding,
+		Description: "Comma separated list of the binary encodings of the payloads of each topic, such as float32be or int16le, or a single one for all topics",
+		Example:     "float32be",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPayloadOffset,
+		Description: "Comma separated list of the number of header bytes before the value in the binary payloads of each topic, or a single one for all topics",
+		Example:     "2",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPayloadBase64,
+		Description: "Comma separated list of whether the payloads of each topic are base64 encoded, or a single value for all topics",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyJSONPath,
+		Description: "Comma separated list of the paths of the numeric value in JSON payloads of each topic, with dotted keys and array indices in brackets, or a single one for all topics",
+		Example:     "data.sensors[2].value",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyJSONAllFields,
+		Description: "Comma separated list of whether every numeric field of the JSON payloads of each topic is diffed on its own, or a single value for all topics",
+		Example:     "true",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyJSONMaxFields,
+		Description: "Most fields each JsonAllFields topic tracks, beyond which new fields are ignored",
+		Example:     "32",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyPayloadFormat,
+		Description: "Comma separated list of the formats of the payloads of each topic, text for plain and JSON payloads or cbor for CBOR payloads, or a single one for all topics",
+		Example:     "cbor",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyCombinedOutput,
+		Description: "Device topic that the last output of every topic is published to as a single JSON object, instead of their own output topics",
+		Example:     "diffs",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyCombinedPeriod,
+		Description: "Interval CombinedOutput publishes at, instead of whenever a topic produces an output",
+		Example:     "1m",
+		Required:    false,
+	},
 }
 
-const (
-	defaultOutputTopicSuffix = "_diff"
-)
+// run is the main function that gets called once form main()
+func run(ctx *cli.Context) error {
+	started := time.Now()
 
-const (
-	// Set this value to true to have the service publish a service status of
-	// "Running" each time it receives a device update event
-	runningStatus = true
-)
+	/* Fill in unset flags from the config file */
+	cfgfile, err := loadConfigFile(ctx)
+	if err != nil {
+		log.Error("Failed to load config file: ", err)
+		return cli.NewExitError(nil, 1)
+	}
 
-// Device holds the device specific last values and target topics for the difference.
-type Device struct {
-	outtopics  []string
-	lastvalues []float64
-}
+	/* Set logging level (verbosity) and format */
+	if err := configureLogging(ctx); err != nil {
+		log.Error(err)
+		return cli.NewExitError(nil, 1)
+	}
 
-// NewDevice is called by the framework when a new device has been linked.
-func NewDevice() framework.Device {
-	d := new(Device)
-	return framework.Device(d)
-}
+	if addr := ctx.String("pprof-addr"); len(addr) > 0 {
+		log.Infof("Starting Math Diff Service with pprof on %s", addr)
+	} else {
+		log.Info("Starting Math Diff Service")
+	}
 
-// ProcessLink is called once, during the initial setup of a
-// device, and is provided the service config for the linking device.
-func (d *Device) ProcessLink(ctrl *framework.DeviceControl) string {
-	logitem := log.WithField("deviceid", ctrl.Id())
-	logitem.Debug("Linking with config:", ctrl.Config())
-
-	// Allows space in comma seperated list
-	inputTopicsString := strings.Replace(ctrl.Config()[configKeyInputTopics], " ", "", -1)
-	outputTopicsString := strings.Replace(ctrl.Config()[configKeyOutputTopics], " ", "", -1)
-	inputTopics := strings.Split(inputTopicsString, ",")
-	outputTopics := strings.Split(outputTopicsString, ",")
-
-	d.outtopics = make([]string, len(inputTopics))
-	d.lastvalues = make([]float64, len(inputTopics))
-
-	for i, intopic := range inputTopics {
-		var outtopic string
-		if i < len(outputTopics) && (len(outputTopics[i]) > 0) {
-			outtopic = outputTopics[i]
-		} else {
-			// if no putput topic specified, simply append a _diff to the topic
-			outtopic = intopic + defaultOutputTopicSuffix
+	/* Load persisted device state before any device links */
+	var store *stateStore
+	switch ctx.String("state-backend") {
+	case "file":
+		if path := ctx.String("state-file"); len(path) > 0 {
+			store = newStateStore(&fileBackend{path: path})
 		}
-		d.outtopics[i] = outtopic
-		d.lastvalues[i] = math.NaN()
-		ctrl.Subscribe(intopic, i)
+	case "redis":
+		if len(ctx.String("redis-uri")) == 0 {
+			log.Error("The redis state backend requires --redis-uri")
+			return cli.NewExitError(nil, 1)
+		}
+		store = newStateStore(newRedisBackend(ctx.String("redis-uri")))
+	default:
+		log.Errorf("Unknown state backend \"%s\"", ctx.String("state-backend"))
+		return cli.NewExitError(nil, 1)
 	}
 
-	logitem.Debug("Finished Linking")
+	/* Serve HTTP endpoints before connecting, so probes see us starting */
+	var status health
+	var servers httpServers
+	servers.handle(ctx.String("health-addr"), "health endpoints", status.register)
+	servers.handle(ctx.String("pprof-addr"), "pprof", registerPprof)
+	servers.start()
+	defer servers.stop()
 
-	// This message is sent to the service status for the linking device
-	return "Success"
-}
+	/* Load the MQTT TLS certificates before the client connects */
+	tlsconfig, err := mqttTLSConfig(ctx)
+	if err != nil {
+		log.Error("Invalid MQTT TLS options: ", err)
+		return cli.NewExitError(nil, 1)
+	}
 
-// ProcessUnlink is called once, when the service has been unlinked from
-// the device.
-func (d *Device) ProcessUnlink(ctrl *framework.DeviceControl) {
-	logitem := log.WithField("deviceid", ctrl.Id())
-	logitem.Debug("Unlinked:")
-}
+	mqttopts, err := parseMQTTClientOptions(ctx)
+	if err != nil {
+		log.Error("Invalid MQTT client options: ", err)
+		return cli.NewExitError(nil, 1)
+	}
+	log.Info("MQTT ", mqttopts)
 
-// ProcessConfigChange is ignored in this case.
-func (d *Device) ProcessConfigChange(ctrl *framework.DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
-	logitem := log.WithField("deviceid", ctrl.Id())
+	if ctx.Duration("idle-evict-after") < 0 {
+		log.Error("The idle eviction period must not be negative")
+		return cli.NewExitError(nil, 1)
+	}
 
-	logitem.Debug("Ignoring Config Change:", cchanges)
-	return "", false
-}
+	if ctx.Duration("status-interval") < 0 {
+		log.Error("The status interval must not be negative")
+		return cli.NewExitError(nil, 1)
+	}
 
-// ProcessMessage is called upon receiving a pubsub message destined for
-// this device.
-func (d *Device) ProcessMessage(ctrl *framework.DeviceControl, msg framework.Message) {
-	logitem := log.WithField("deviceid", ctrl.Id())
-	logitem.Debugf("Processing diff for topic %s", msg.Topic())
+	if ctx.Duration("status-pulse-interval") < 0 {
+		log.Error("The status pulse interval must not be negative")
+		return cli.NewExitError(nil, 1)
+	}
 
-	index := msg.Key().(int)
-	value, err := strconv.ParseFloat(string(msg.Payload()), 64)
-	if err != nil {
-		logitem.Warnf("Failed to convert message (\"%v\") to float64", string(msg.Payload()))
-		return
+	if ctx.Duration("shutdown-timeout") < 0 {
+		log.Error("The shutdown timeout must not be negative")
+		return cli.NewExitError(nil, 1)
 	}
 
-	// First value is only stored, so that we don't get spurious spikes
-	if math.IsNaN(d.lastvalues[index]) {
-		logitem.Debugf("Setting first value | newvalue=%s", utils.FormatFloat64(value))
-		d.lastvalues[index] = value
-		return
+	if ctx.Bool("standalone") && len(ctx.String("devices-file")) == 0 {
+		log.Error("Standalone mode requires --devices-file")
+		return cli.NewExitError(nil, 1)
 	}
 
-	diff := value - d.lastvalues[index]
-	d.lastvalues[index] = value
+	if len(strings.TrimSpace(ctx.String("default-suffix"))) == 0 {
+		log.Error("The default output topic suffix must not be empty")
+		return cli.NewExitError(nil, 1)
+	}
 
-	logitem.Debugf("lastvalue=%.10f | newvalue=%.10f | diff=%s", d.lastvalues[index], value, utils.FormatFloat64(diff))
+	if ctx.Int("max-topics-per-device") < 0 || ctx.Int("max-devices") < 0 {
+		log.Error("The topic and device limits must not be negative")
+		return cli.NewExitError(nil, 1)
+	}
 
-	ctrl.Publish(d.outtopics[index], utils.FormatFloat64(diff))
-}
+	if ctx.Duration("probe-interval") < 0 {
+		log.Error("The probe interval must not be negative")
+		return cli.NewExitError(nil, 1)
+	}
 
-// run is the main function that gets called once form main()
-func run(ctx *cli.Context) error {
-	/* Set logging level (verbosity) */
-	log.SetLevel(log.Level(uint32(ctx.Int("log-level"))))
+	if ctx.Int("startup-retries") < 0 || ctx.Duration("startup-backoff") <= 0 {
+		log.Error("The startup retries must not be negative, and the startup backoff must be positive")
+		return cli.NewExitError(nil, 1)
+	}
 
-	log.Info("Starting Math Diff Service")
+	if ctx.Int("publish-queue") < 0 || ctx.Int("publish-workers") < 1 {
+		log.Error("The publish queue size must not be negative, and there must be at least one publish worker")
+		return cli.NewExitError(nil, 1)
+	}
+	if err := parsePublishQueuePolicy(ctx.String("publish-queue-policy")); err != nil {
+		log.Error(err)
+		return cli.NewExitError(nil, 1)
+	}
 
-	/* Start framework service client */
-	c, err := framework.StartServiceClientManaged(
-		ctx.String("framework-server"),
-		ctx.String("mqtt-server"),
-		ctx.String("service-id"),
-		ctx.String("service-token"),
-		"Unexpected disconnect!",
-		NewDevice)
-	if err != nil {
-		log.Error("Failed to StartServiceClient: ", err)
+	if qos := ctx.Int("default-qos"); qos < 0 || qos > 2 {
+		log.Error("The default QoS must be 0, 1, or 2")
+		return cli.NewExitError(nil, 1)
+	}
+
+	opts := &serviceOptions{
+		store:         store,
+		dryrun:        ctx.Bool("dry-run"),
+		defaultSuffix: strings.TrimSpace(ctx.String("default-suffix")),
+		qos:           byte(ctx.Int("default-qos")),
+		retain:        ctx.Bool("default-retain"),
+		maxTopics:     ctx.Int("max-topics-per-device"),
+		maxDevices:    ctx.Int("max-devices"),
+	}
+	if err := opts.reload(ctx); err != nil {
+		log.Error(err)
 		return cli.NewExitError(nil, 1)
 	}
+	if size := ctx.Int("publish-queue"); size > 0 {
+		opts.queue = newPublishQueue(size, ctx.Int("publish-workers"), ctx.String("publish-queue-policy"))
+		log.Infof("Publishing through a queue of %d outputs with %d workers, %s when full", size, ctx.Int("publish-workers"), ctx.String("publish-queue-policy"))
+	}
+
+	/* Start framework service client, or link the local devices directly,
+	   retrying while the framework or broker is not up yet */
+	var c serviceClient
+	retries, backoff, forever := ctx.Int("startup-retries"), ctx.Duration("startup-backoff"), ctx.Bool("wait-for-broker")
+	if ctx.Bool("standalone") {
+		err := retryStartup("start standalone", retries, backoff, forever, func() error {
+			sc, err := startStandalone(ctx.String("mqtt-server"), mqttopts, tlsconfig, ctx.String("devices-file"), opts, &status)
+			if err == nil {
+				c = sc
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Failed to start standalone: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+	} else {
+		/* The device topics go over the service's own connection, which
+		   takes the MQTT TLS and client options the framework client does
+		   not */
+		err := retryStartup("connect to the MQTT server", retries, backoff, forever, func() error {
+			conn, err := dialMQTT(ctx.String("mqtt-server"), ctx.String("service-id"), ctx.String("service-token"), mqttopts, tlsconfig, nil)
+			if err == nil {
+				opts.conn = conn
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Failed to connect to the MQTT server: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+		defer opts.conn.close()
+
+		err = retryStartup("start the service client", retries, backoff, forever, func() error {
+			fc, err := framework.StartServiceClientManaged(
+				ctx.String("framework-server"),
+				ctx.String("mqtt-server"),
+				ctx.String("service-id"),
+				ctx.String("service-token"),
+				"Unexpected disconnect!",
+				newDeviceFactory(opts))
+			if err == nil {
+				c = fc
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Failed to StartServiceClient: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+		status.setConnected(true)
+	}
 	defer c.StopClient()
 	log.Info("Started service")
 
@@ -173,27 +778,115 @@ func run(ctx *cli.Context) error {
 	log.Info("Published Service Status")
 
 	/* Updating device config parameters */
-	if err := c.UpdateConfigParameters(configParams); err != nil {
-		log.Error("Failed to update service config parameters: ", err)
-		return cli.NewExitError(nil, 1)
+	if fc, ok := c.(*framework.ServiceClient); ok {
+		if err := fc.UpdateConfigParameters(configParams); err != nil {
+			log.Error("Failed to update service config parameters: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+		log.Info("Updated Service Config Parameters")
+	}
+
+	/* Periodically save device state */
+	stopSaving := make(chan struct{})
+	if store != nil {
+		go store.run(stopSaving)
 	}
-	log.Info("Updated Service Config Parameters")
 
 	/* Setup signal channel */
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	/* Post service status indicating I started */
 	if err := c.SetStatus("Started"); err != nil {
 		log.Error("Failed to publish service status: ", err)
 		return cli.NewExitError(nil, 1)
 	}
+	status.setReady(true)
 	log.Info("Published Service Status")
 
-	/* Wait on a signal */
+	/* Tell systemd the service is ready and keep its watchdog fed */
+	if err := sdNotify(sdReady); err != nil {
+		log.Warn("Failed to notify systemd: ", err)
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
+		stopWatchdog := make(chan struct{})
+		defer close(stopWatchdog)
+		go sdRunWatchdog(interval, stopWatchdog)
+	}
+
+	/* Evict the state of idle devices */
+	stopEvicting := make(chan struct{})
+	if after := ctx.Duration("idle-evict-after"); after > 0 {
+		go evictIdle(opts, after, stopEvicting)
+	}
+
+	/* Probe the framework client's connection, which reports no
+	   disconnects itself */
+	stopProbing := make(chan struct{})
+	if interval := ctx.Duration("probe-interval"); interval > 0 && !ctx.Bool("standalone") {
+		if pc, ok := c.(probeClient); ok {
+			topic := ctx.String("probe-topic")
+			if len(topic) == 0 {
+				topic = defaultProbeTopic(ctx.String("service-id"))
+			}
+			probe := &connectionProbe{client: pc, topic: topic, status: &status}
+			go probe.run(interval, stopProbing)
+		} else {
+			log.Warn("The service client cannot subscribe to a probe topic, disconnects will not be detected")
+		}
+	}
+
+	/* Periodically update the service status with the service statistics */
+	stopStatus := make(chan struct{})
+	if interval := ctx.Duration("status-interval"); interval > 0 {
+		go reportStatus(c, opts, &status, started, interval, stopStatus)
+	}
+
+	/* Refresh the service status as messages are processed */
+	if ctx.Bool("status-pulse") {
+		opts.pulse.start(c, ctx.Duration("status-pulse-interval"))
+	}
+
+	/* Wait on a signal, reloading the runtime settings on SIGHUP */
 	sig := <-signals
+	for sig == syscall.SIGHUP {
+		log.Info("Received signal ", sig)
+		reloadSettings(ctx, cfgfile, opts)
+		sig = <-signals
+	}
 	log.Info("Received signal ", sig)
 	log.Warning("Shutting down")
+	status.setReady(false)
+	if err := sdNotify(sdStopping); err != nil {
+		log.Warn("Failed to notify systemd: ", err)
+	}
+	close(stopStatus)
+	close(stopProbing)
+	close(stopEvicting)
+	opts.pulse.stop()
+
+	/* Pause the devices, publish what is queued, and save their state one
+	   last time */
+	close(stopSaving)
+	timeout := ctx.Duration("shutdown-timeout")
+	finished := waitTimeout(timeout, func() {
+		opts.devices.pause(ctx.String("shutdown-marker"))
+		log.Info("Paused devices")
+		if opts.queue != nil {
+			opts.queue.close()
+			log.Info("Drained publish queue")
+		}
+		if store != nil {
+			if err := store.save(); err != nil {
+				log.Error("Failed to save device state: ", err)
+			} else {
+				log.Info("Saved device state")
+			}
+		}
+	})
+	if !finished {
+		log.Warnf("Gave up pausing devices and saving their state after %v", timeout)
+	}
 
 	/* Post service's global status */
 	if err := c.SetStatus("Shutting down"); err != nil {
@@ -204,6 +897,49 @@ func run(ctx *cli.Context) error {
 	return nil
 }
 
+// serviceClient is the connection the devices are linked through, which is
+// either a framework service client or a standalone client
+type serviceClient interface {
+	SetStatus(msgs ...interface{}) error
+	StopClient()
+}
+
+// configureLogging sets the logging level and format from the flags
+func configureLogging(ctx *cli.Context) error {
+	log.SetLevel(log.Level(uint32(ctx.Int("log-level"))))
+
+	switch ctx.String("log-format") {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format \"%s\"", ctx.String("log-format"))
+	}
+	return nil
+}
+
+// reloadSettings rereads the config file and applies the changed runtime
+// adjustable settings. Invalid settings are logged and leave the running
+// settings unchanged.
+func reloadSettings(ctx *cli.Context, cfgfile *configFile, opts *serviceOptions) {
+	changed, err := cfgfile.reload(ctx)
+	if err != nil {
+		log.Error("Failed to reload config file: ", err)
+	}
+	if len(changed) == 0 {
+		log.Info("No runtime settings changed")
+		return
+	}
+	if err := configureLogging(ctx); err != nil {
+		log.Error(err)
+	}
+	if err := opts.reload(ctx); err != nil {
+		log.Error(err)
+	}
+	log.Info("Reloaded ", strings.Join(changed, ", "))
+}
+
 func main() {
 	/* Parse arguments and environmental variable */
 	app := cli.NewApp()
@@ -212,7 +948,13 @@ func main() {
 	app.Copyright = "See https://github.com/openchirp/math-diff-service for copyright information"
 	app.Version = version
 	app.Action = run
+	app.Commands = []cli.Command{checkCommand, validateCommand, replayCommand}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML file to read the other options from, which flags and environment variables override",
+			EnvVar: "CONFIG_FILE",
+		},
 		cli.StringFlag{
 			Name:   "framework-server",
 			Usage:  "OpenChirp framework server's URI",
@@ -225,6 +967,42 @@ func main() {
 			Value:  "tls://localhost:1883",
 			EnvVar: "MQTT_SERVER",
 		},
+		cli.StringFlag{
+			Name:   "mqtt-ca",
+			Usage:  "PEM file of the CA certificates to verify the MQTT server with",
+			EnvVar: "MQTT_CA",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-cert",
+			Usage:  "PEM file of the client certificate for the MQTT connection",
+			EnvVar: "MQTT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-key",
+			Usage:  "PEM file of the client key for the MQTT connection",
+			EnvVar: "MQTT_KEY",
+		},
+		cli.BoolFlag{
+			Name:   "mqtt-insecure-skip-verify",
+			Usage:  "Do not verify the MQTT server certificate",
+			EnvVar: "MQTT_INSECURE_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-client-id",
+			Usage:  "MQTT client ID of the service's connection, which defaults to one derived from the process id",
+			EnvVar: "MQTT_CLIENT_ID",
+		},
+		cli.DurationFlag{
+			Name:   "mqtt-keepalive",
+			Value:  defaultMQTTKeepAlive,
+			Usage:  "MQTT keepalive interval of the service's connection, in whole seconds",
+			EnvVar: "MQTT_KEEPALIVE",
+		},
+		cli.BoolTFlag{
+			Name:   "mqtt-clean-session",
+			Usage:  "Start a clean MQTT session on each connect, or set to false to resume the broker's session",
+			EnvVar: "MQTT_CLEAN_SESSION",
+		},
 		cli.StringFlag{
 			Name:   "service-id",
 			Usage:  "OpenChirp service id",
@@ -241,6 +1019,169 @@ func main() {
 			Usage:  "debug=5, info=4, warning=3, error=2, fatal=1, panic=0",
 			EnvVar: "LOG_LEVEL",
 		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "text or json",
+			EnvVar: "LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "state-file",
+			Usage:  "File to persist per-device diff state across restarts (disabled if empty)",
+			EnvVar: "STATE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "state-backend",
+			Usage:  "Where to persist device state: file (uses --state-file) or redis (uses --redis-uri)",
+			Value:  "file",
+			EnvVar: "STATE_BACKEND",
+		},
+		cli.StringFlag{
+			Name:   "redis-uri",
+			Usage:  "Redis server URI for the redis state backend (e.g. redis://localhost:6379/0)",
+			EnvVar: "REDIS_URI",
+		},
+		cli.StringFlag{
+			Name:   "default-suffix",
+			Value:  defaultOutputTopicSuffix,
+			Usage:  "Suffix of the output topics of devices that set neither OutputTopics nor OutputSuffix",
+			EnvVar: "DEFAULT_SUFFIX",
+		},
+		cli.IntFlag{
+			Name:   "default-precision",
+			Value:  defaultPrecision,
+			Usage:  "Number of decimal places published by devices that set no Precision, or -1 for the shortest representation",
+			EnvVar: "DEFAULT_PRECISION",
+		},
+		cli.DurationFlag{
+			Name:   "default-republish",
+			Usage:  "Interval devices that set no Republish publish their last output again at, or 0 to disable",
+			EnvVar: "DEFAULT_REPUBLISH",
+		},
+		cli.IntFlag{
+			Name:   "default-qos",
+			Usage:  "MQTT QoS of the outputs of devices that set no QoS: 0, 1, or 2",
+			EnvVar: "DEFAULT_QOS",
+		},
+		cli.BoolFlag{
+			Name:   "default-retain",
+			Usage:  "Publish the outputs of devices that set no Retain as retained messages",
+			EnvVar: "DEFAULT_RETAIN",
+		},
+		cli.IntFlag{
+			Name:   "max-topics-per-device",
+			Value:  defaultMaxTopicsPerDevice,
+			Usage:  "Most input topics a device may have, including the topics matched by wildcards, or 0 for no limit",
+			EnvVar: "MAX_TOPICS_PER_DEVICE",
+		},
+		cli.IntFlag{
+			Name:   "max-devices",
+			Usage:  "Most devices that may be linked at once, or 0 for no limit",
+			EnvVar: "MAX_DEVICES",
+		},
+		cli.DurationFlag{
+			Name:   "probe-interval",
+			Value:  defaultProbeInterval,
+			Usage:  "Interval to probe the framework client's MQTT connection at by echoing a message through the broker, or 0 to not probe it",
+			EnvVar: "PROBE_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "probe-topic",
+			Usage:  "Topic the connection probe publishes to and subscribes to, which defaults to openchirp/service/<service-id>/probe",
+			EnvVar: "PROBE_TOPIC",
+		},
+		cli.IntFlag{
+			Name:   "startup-retries",
+			Value:  defaultStartupRetries,
+			Usage:  "Times to retry starting the service client, or connecting in standalone mode, before giving up",
+			EnvVar: "STARTUP_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "startup-backoff",
+			Value:  defaultStartupBackoff,
+			Usage:  "Wait before the first startup retry, which doubles for each retry after it up to a minute",
+			EnvVar: "STARTUP_BACKOFF",
+		},
+		cli.BoolFlag{
+			Name:   "wait-for-broker",
+			Usage:  "Retry starting the service client forever rather than up to the startup retries",
+			EnvVar: "WAIT_FOR_BROKER",
+		},
+		cli.IntFlag{
+			Name:   "publish-queue",
+			Usage:  "Most outputs waiting to be published by the publish workers, or 0 to publish while processing each message",
+			EnvVar: "PUBLISH_QUEUE",
+		},
+		cli.IntFlag{
+			Name:   "publish-workers",
+			Value:  defaultPublishWorkers,
+			Usage:  "Number of workers publishing from the publish queue",
+			EnvVar: "PUBLISH_WORKERS",
+		},
+		cli.StringFlag{
+			Name:   "publish-queue-policy",
+			Value:  publishQueueBlock,
+			Usage:  "What to do when the publish queue is full: drop-oldest, drop-newest, or block",
+			EnvVar: "PUBLISH_QUEUE_POLICY",
+		},
+		cli.DurationFlag{
+			Name:   "idle-evict-after",
+			Usage:  "Time a device may go without a message before its sample windows are evicted, or 0 to never evict them",
+			EnvVar: "IDLE_EVICT_AFTER",
+		},
+		cli.DurationFlag{
+			Name:   "status-interval",
+			Value:  defaultStatusInterval,
+			Usage:  "Interval the service status is updated with the device count, message rate, and uptime at, or 0 to disable",
+			EnvVar: "STATUS_INTERVAL",
+		},
+		cli.BoolFlag{
+			Name:   "status-pulse",
+			Usage:  "Publish a service status of Running as devices process messages",
+			EnvVar: "STATUS_PULSE",
+		},
+		cli.DurationFlag{
+			Name:   "status-pulse-interval",
+			Value:  defaultStatusPulseInterval,
+			Usage:  "Least time between the Running statuses of --status-pulse",
+			EnvVar: "STATUS_PULSE_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "shutdown-marker",
+			Usage:  "Marker published to the status topic of every output topic on shutdown, or empty to publish none",
+			EnvVar: "SHUTDOWN_MARKER",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  defaultShutdownTimeout,
+			Usage:  "Time to wait on publishing shutdown markers and saving state before exiting, or 0 to wait indefinitely",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "standalone",
+			Usage:  "Link the devices of --devices-file directly over the MQTT server, without a framework server",
+			EnvVar: "STANDALONE",
+		},
+		cli.StringFlag{
+			Name:   "devices-file",
+			Usage:  "JSON file mapping device names to their link config in standalone mode",
+			EnvVar: "DEVICES_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Log the outputs of all devices instead of publishing them",
+			EnvVar: "DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "pprof-addr",
+			Usage:  "Private address to serve the net/http/pprof endpoints on (e.g. localhost:6060)",
+			EnvVar: "PPROF_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "health-addr",
+			Usage:  "Address to serve the /healthz and /readyz endpoints on (e.g. :8080)",
+			EnvVar: "HEALTH_ADDR",
+		},
 	}
 
 	/* Launch the application */
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/urfave/cli"
+)
+
+const (
+	// defaultMQTTKeepAlive is the MQTT keepalive interval when not set
+	defaultMQTTKeepAlive = 30 * time.Second
+)
+
+// mqttClientOptions are the MQTT client ID, keepalive interval, and clean
+// session flag of the service's own connection to the broker
+type mqttClientOptions struct {
+	// clientID is the MQTT client ID, or empty for one derived from the pid
+	clientID     string
+	keepAlive    time.Duration
+	cleanSession bool
+}
+
+// parseMQTTClientOptions checks the MQTT client flags
+func parseMQTTClientOptions(ctx *cli.Context) (mqttClientOptions, error) {
+	o := mqttClientOptions{
+		clientID:     ctx.String("mqtt-client-id"),
+		keepAlive:    ctx.Duration("mqtt-keepalive"),
+		cleanSession: ctx.BoolT("mqtt-clean-session"),
+	}
+	if o.keepAlive < 0 {
+		return o, errors.New("the MQTT keepalive must not be negative")
+	}
+	if o.keepAlive%time.Second != 0 {
+		return o, errors.New("the MQTT keepalive must be a whole number of seconds")
+	}
+	return o, nil
+}
+
+// effectiveClientID returns the client ID the connection uses
+func (o mqttClientOptions) effectiveClientID() string {
+	if len(o.clientID) > 0 {
+		return o.clientID
+	}
+	return fmt.Sprintf("math-diff-service-%d", os.Getpid())
+}
+
+// apply sets the options on the options of a paho client
+func (o mqttClientOptions) apply(clientopts *mqtt.ClientOptions) {
+	clientopts.SetClientID(o.effectiveClientID())
+	clientopts.SetKeepAlive(o.keepAlive)
+	clientopts.SetCleanSession(o.cleanSession)
+}
+
+// String describes the options for the startup log
+func (o mqttClientOptions) String() string {
+	return fmt.Sprintf("client ID %s, keepalive %v, clean session %t", o.effectiveClientID(), o.keepAlive, o.cleanSession)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// clientContext returns a context with the MQTT client flags set to flags
+func clientContext(t *testing.T, flags map[string]string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("mqtt-client-id", "", "")
+	set.Duration("mqtt-keepalive", defaultMQTTKeepAlive, "")
+	set.Bool("mqtt-clean-session", true, "")
+	for name, value := range flags {
+		if err := set.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestParseMQTTClientOptions(t *testing.T) {
+	tests := []struct {
+		flags map[string]string
+		fails bool
+		// log is a part of the options as logged
+		log string
+	}{
+		{flags: nil, log: "keepalive 30s, clean session true"},
+		{
+			flags: map[string]string{"mqtt-client-id": "diff", "mqtt-keepalive": "10s", "mqtt-clean-session": "false"},
+			log:   "client ID diff, keepalive 10s, clean session false",
+		},
+		{flags: map[string]string{"mqtt-keepalive": "-1s"}, fails: true},
+		{flags: map[string]string{"mqtt-keepalive": "1500ms"}, fails: true},
+	}
+	for _, test := range tests {
+		o, err := parseMQTTClientOptions(clientContext(t, test.flags))
+		if test.fails {
+			if err == nil {
+				t.Errorf("with %v: got %v, want an error", test.flags, o)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("with %v: got error %v", test.flags, err)
+			continue
+		}
+		if !strings.Contains(o.String(), test.log) {
+			t.Errorf("with %v: got %q, want it to contain %q", test.flags, o, test.log)
+		}
+	}
+}
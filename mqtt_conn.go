@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/openchirp/framework"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// mqttSubscribeQoS is the QoS of the subscriptions of an mqttConn
+	mqttSubscribeQoS = 0
+	// mqttDisconnectQuiesce is how long an mqttConn waits on in-flight work
+	// when disconnecting, in milliseconds
+	mqttDisconnectQuiesce = 250
+	// mqttPublishTimeout bounds how long a publish waits on the broker,
+	// which a publish with a QoS above 0 does until the client reconnects
+	// while the connection is down
+	mqttPublishTimeout = 2 * time.Second
+)
+
+// mqttConn is an MQTT connection the devices subscribe and publish through
+// directly. It is the connection of the standalone client, and under the
+// framework the service's own connection for the device topics, since the
+// framework client dials the broker with options of its own choosing.
+type mqttConn struct {
+	client mqtt.Client
+	// publishTimeout is how long a publish may wait before it fails
+	publishTimeout time.Duration
+
+	mu sync.Mutex
+	// subs maps every subscribed topic filter to the devices subscribed to
+	// it, along with the control and key they subscribed with
+	subs map[string]map[*Device]mqttSub
+}
+
+// mqttSub is the subscription of a device to a topic filter of an mqttConn
+type mqttSub struct {
+	ctrl deviceControl
+	key  interface{}
+}
+
+// dialMQTT connects to the MQTT broker with the client options mqttopts and
+// the credentials username and password, unless username is empty. A nil
+// tlsconfig dials tls:// brokers with the defaults. Lost connections are
+// reconnected, and reflected in status unless it is nil.
+func dialMQTT(broker, username, password string, mqttopts mqttClientOptions, tlsconfig *tls.Config, status *health) (*mqttConn, error) {
+	c := &mqttConn{
+		publishTimeout: mqttPublishTimeout,
+		subs:           make(map[string]map[*Device]mqttSub),
+	}
+
+	clientopts := mqtt.NewClientOptions()
+	clientopts.AddBroker(broker)
+	mqttopts.apply(clientopts)
+	if len(username) > 0 {
+		clientopts.SetUsername(username)
+		clientopts.SetPassword(password)
+	}
+	if tlsconfig != nil {
+		clientopts.SetTLSConfig(tlsconfig)
+	}
+	clientopts.SetAutoReconnect(true)
+	clientopts.SetOnConnectHandler(func(client mqtt.Client) {
+		if status != nil {
+			status.setConnected(true)
+		}
+		c.resubscribe()
+	})
+	clientopts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		if status != nil {
+			status.setConnected(false)
+		}
+		log.Warn("Lost connection to the MQTT broker: ", err)
+	})
+	c.client = mqtt.NewClient(clientopts)
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return c, nil
+}
+
+// close disconnects from the broker
+func (c *mqttConn) close() {
+	c.client.Disconnect(mqttDisconnectQuiesce)
+}
+
+// resubscribe subscribes to every topic filter again after the client
+// (re)connected, since the broker does not keep them for a clean session
+func (c *mqttConn) resubscribe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for filter := range c.subs {
+		c.subscribeFilter(filter)
+	}
+}
+
+// subscribeFilter subscribes the client to filter. Messages are handed to
+// every device subscribed to the filter. The connection lock must be held.
+func (c *mqttConn) subscribeFilter(filter string) {
+	token := c.client.Subscribe(filter, mqttSubscribeQoS, func(client mqtt.Client, msg mqtt.Message) {
+		c.dispatch(filter, msg)
+	})
+	// Devices subscribe while holding their lock, which message handlers
+	// may be waiting on, so the acknowledgement is not waited on here
+	go func() {
+		if token.WaitTimeout(time.Minute) && token.Error() != nil {
+			log.Errorf("Failed to subscribe to %s: %v", filter, token.Error())
+		}
+	}()
+}
+
+// dispatch hands msg, received for filter, to every device subscribed to it
+func (c *mqttConn) dispatch(filter string, msg mqtt.Message) {
+	c.mu.Lock()
+	subs := make(map[*Device]mqttSub, len(c.subs[filter]))
+	for d, sub := range c.subs[filter] {
+		subs[d] = sub
+	}
+	c.mu.Unlock()
+
+	for d, sub := range subs {
+		d.processMessage(sub.ctrl, msg.Topic(), sub.key, msg.Payload())
+	}
+}
+
+// subscribe subscribes d, linked through ctrl, to the topic filter with key
+func (c *mqttConn) subscribe(d *Device, ctrl deviceControl, filter string, key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[filter] == nil {
+		c.subs[filter] = make(map[*Device]mqttSub)
+		c.subscribeFilter(filter)
+	}
+	c.subs[filter][d] = mqttSub{ctrl: ctrl, key: key}
+}
+
+// unsubscribe removes the subscriptions of d to the topic filters. The
+// client stays subscribed while other devices use a filter.
+func (c *mqttConn) unsubscribe(d *Device, filters ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, filter := range filters {
+		subs, ok := c.subs[filter]
+		if !ok {
+			continue
+		}
+		delete(subs, d)
+		if len(subs) == 0 {
+			delete(c.subs, filter)
+			c.client.Unsubscribe(filter)
+		}
+	}
+}
+
+// publish publishes payload to topic with the given QoS and retained flag.
+// It fails if the broker does not acknowledge it within the publish
+// timeout, so that a lost connection does not hold up the caller, which
+// may hold the device lock, and the failure is retried and counted.
+func (c *mqttConn) publish(topic string, payload interface{}, qos byte, retain bool) error {
+	token := c.client.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(c.publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s after %v", topic, c.publishTimeout)
+	}
+	return token.Error()
+}
+
+// deviceTopic returns the topic the subtopics of the framework device id are
+// below
+func deviceTopic(id string) string {
+	return fmt.Sprintf("openchirp/device/%s", id)
+}
+
+// frameworkControl is the deviceControl of a device linked by the framework
+// client whose topics are carried by the service's own MQTT connection. The
+// framework's DeviceControl still provides the device id and config.
+type frameworkControl struct {
+	ctrl   *framework.DeviceControl
+	conn   *mqttConn
+	device *Device
+}
+
+// control returns the deviceControl of the device for the framework's ctrl,
+// which carries the device topics over the service's own MQTT connection if
+// it has one
+func (d *Device) control(ctrl *framework.DeviceControl) deviceControl {
+	if d.opts.conn == nil {
+		return ctrl
+	}
+	return &frameworkControl{ctrl: ctrl, conn: d.opts.conn, device: d}
+}
+
+// Id implements deviceControl
+func (c *frameworkControl) Id() string {
+	return c.ctrl.Id()
+}
+
+// Config implements deviceControl
+func (c *frameworkControl) Config() map[string]string {
+	return c.ctrl.Config()
+}
+
+// topic returns the full topic of the device's subtopic
+func (c *frameworkControl) topic(subtopic string) string {
+	return deviceTopic(c.ctrl.Id()) + "/" + subtopic
+}
+
+// Subscribe subscribes the device to its subtopic
+func (c *frameworkControl) Subscribe(subtopic string, key interface{}) error {
+	c.conn.subscribe(c.device, c, c.topic(subtopic), key)
+	return nil
+}
+
+// Unsubscribe removes the device's subscriptions to its subtopics
+func (c *frameworkControl) Unsubscribe(subtopics ...string) error {
+	topics := make([]string, len(subtopics))
+	for i, subtopic := range subtopics {
+		topics[i] = c.topic(subtopic)
+	}
+	c.conn.unsubscribe(c.device, topics...)
+	return nil
+}
+
+// Publish publishes payload to the device's subtopic
+func (c *frameworkControl) Publish(subtopic string, payload interface{}) error {
+	return c.PublishOptions(subtopic, payload, 0, false)
+}
+
+// PublishOptions publishes payload to the device's subtopic with the given
+// QoS and retained flag
+func (c *frameworkControl) PublishOptions(subtopic string, payload interface{}, qos byte, retain bool) error {
+	return c.conn.publish(c.topic(subtopic), payload, qos, retain)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stalledClient is an MQTT client whose publishes are never acknowledged,
+// like those with a QoS above 0 while the connection is down
+type stalledClient struct {
+	mqtt.Client
+}
+
+func (c stalledClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return stalledToken{}
+}
+
+// stalledToken is a token that never completes
+type stalledToken struct {
+	mqtt.Token
+}
+
+func (stalledToken) WaitTimeout(timeout time.Duration) bool {
+	time.Sleep(timeout)
+	return false
+}
+
+func TestMQTTConnPublishTimeout(t *testing.T) {
+	conn := &mqttConn{client: stalledClient{}, publishTimeout: 10 * time.Millisecond}
+
+	start := time.Now()
+	err := conn.publish("temp_diff", "1", 1, false)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("publishing took %v, want it to give up after the timeout", elapsed)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// mqttTLSConfig builds the TLS config of the MQTT connection from the MQTT
+// TLS flags, or returns nil if none is set
+func mqttTLSConfig(ctx *cli.Context) (*tls.Config, error) {
+	ca := ctx.String("mqtt-ca")
+	cert := ctx.String("mqtt-cert")
+	key := ctx.String("mqtt-key")
+	insecure := ctx.Bool("mqtt-insecure-skip-verify")
+	if len(ca) == 0 && len(cert) == 0 && len(key) == 0 && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) > 0 {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in MQTT CA file %s", ca)
+		}
+	}
+
+	if len(cert) > 0 || len(key) > 0 {
+		if len(cert) == 0 || len(key) == 0 {
+			return nil, errors.New("--mqtt-cert and --mqtt-key must be given together")
+		}
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if insecure {
+		log.Warn("NOT VERIFYING THE MQTT SERVER CERTIFICATE. The connection can be intercepted, so only use --mqtt-insecure-skip-verify for testing.")
+	}
+	return config, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// writeCertificate writes a self-signed certificate and its key as PEM files
+// to dir, returning their paths
+func writeCertificate(t *testing.T, dir string) (cert, key string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "math-diff-service"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// tlsContext returns a context with the MQTT TLS flags set to flags
+func tlsContext(t *testing.T, flags map[string]string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("mqtt-ca", "", "")
+	set.String("mqtt-cert", "", "")
+	set.String("mqtt-key", "", "")
+	set.Bool("mqtt-insecure-skip-verify", false, "")
+	for name, value := range flags {
+		if err := set.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestMQTTTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if config, err := mqttTLSConfig(tlsContext(t, nil)); config != nil || err != nil {
+		t.Errorf("without flags: got %v, %v, want no config", config, err)
+	}
+
+	config, err := mqttTLSConfig(tlsContext(t, map[string]string{
+		"mqtt-ca":   cert,
+		"mqtt-cert": cert,
+		"mqtt-key":  key,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 || config.InsecureSkipVerify {
+		t.Errorf("got roots %v, %d certificates, insecure %t, want roots, 1 certificate, verified", config.RootCAs, len(config.Certificates), config.InsecureSkipVerify)
+	}
+
+	config, err = mqttTLSConfig(tlsContext(t, map[string]string{"mqtt-insecure-skip-verify": "true"}))
+	if err != nil || !config.InsecureSkipVerify || config.RootCAs != nil {
+		t.Errorf("insecure: got %+v, %v, want InsecureSkipVerify with the system roots", config, err)
+	}
+
+	for _, flags := range []map[string]string{
+		{"mqtt-ca": filepath.Join(dir, "missing.pem")},
+		{"mqtt-ca": garbage},
+		{"mqtt-cert": cert},
+		{"mqtt-key": key},
+		{"mqtt-cert": cert, "mqtt-key": garbage},
+		{"mqtt-cert": key, "mqtt-key": cert},
+	} {
+		if _, err := mqttTLSConfig(tlsContext(t, flags)); err == nil {
+			t.Errorf("with %v: got no error", flags)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// errorTopic is the device topic parse and range errors are published to
+	errorTopic = "diff_error"
+	// errorInterval is the minimum time between parse errors published for
+	// the same input topic
+	errorInterval = time.Minute
+	// errorPayloadLength is the number of payload bytes included in a
+	// published parse error
+	errorPayloadLength = 64
+)
+
+// publishError publishes the input topic and payload of a message that
+// failed to parse to errorTopic, if PublishErrors is set
+func (d *Device) publishError(ctrl deviceControl, logitem *log.Entry, intopic string, payload []byte) {
+	if !d.publisherrors {
+		return
+	}
+	truncated := ""
+	if len(payload) > errorPayloadLength {
+		payload = payload[:errorPayloadLength]
+		truncated = "..."
+	}
+	d.reportError(ctrl, logitem, intopic, fmt.Sprintf("%s: failed to parse %q%s", intopic, payload, truncated))
+}
+
+// reportError publishes the error message about a message on intopic to
+// errorTopic, if PublishErrors is set. Errors are published at most once
+// every errorInterval per input topic, so a misbehaving sensor cannot flood
+// the broker.
+func (d *Device) reportError(ctrl deviceControl, logitem *log.Entry, intopic, message string) {
+	if !d.publisherrors {
+		return
+	}
+
+	now := d.opts.now()
+	if sent, ok := d.errorsent[intopic]; ok && now.Sub(sent) < errorInterval {
+		return
+	}
+	if d.errorsent == nil {
+		d.errorsent = make(map[string]time.Time)
+	}
+	d.errorsent[intopic] = now
+	d.publish(ctrl, logitem, errorTopic, message)
+}
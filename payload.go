@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// numberFormat selects the normalizations applied to plain text payloads
+// that are not numbers as they are
+type numberFormat struct {
+	// stripunits ignores a trailing unit, such as the C of "23.5 C"
+	stripunits bool
+	// decimalcomma accepts a comma as the decimal separator, as in "1,5"
+	decimalcomma bool
+	// booleans accepts true and on as 1, and false and off as 0
+	booleans bool
+	// prefixed accepts integers with a 0x or 0b prefix, as in "0x1A3F"
+	prefixed bool
+}
+
+// parseValue parses the numeric value of a plain text payload, ignoring
+// surrounding whitespace. Payloads that are not numbers as they are get the
+// normalizations of format before they are parsed again.
+func parseValue(payload []byte, format numberFormat) (float64, error) {
+	value, _, err := parseValueUnit(payload, format)
+	return value, err
+}
+
+// parseValueUnit parses a plain text payload like parseValue, and also
+// returns the unit that was stripped from it, if any
+func parseValueUnit(payload []byte, format numberFormat) (float64, string, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if !format.booleans && !format.prefixed {
+		// Plain numbers are parsed without keeping a string of the payload,
+		// so they do not allocate
+		if value, err := strconv.ParseFloat(string(trimmed), 64); err == nil {
+			return value, "", nil
+		}
+	}
+
+	text := string(trimmed)
+	if format.booleans {
+		switch strings.ToLower(text) {
+		case "true", "on":
+			return 1, "", nil
+		case "false", "off":
+			return 0, "", nil
+		}
+	}
+	if format.prefixed {
+		if value, ok, err := parsePrefixed(text); ok {
+			return value, "", err
+		}
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err == nil || (!format.stripunits && !format.decimalcomma) {
+		return value, "", err
+	}
+
+	normalized, unit := text, ""
+	if format.stripunits {
+		normalized = stripUnit(normalized)
+		unit = strings.TrimSpace(text[len(normalized):])
+	}
+	if format.decimalcomma && strings.Count(normalized, ",") == 1 && !strings.Contains(normalized, ".") {
+		normalized = strings.Replace(normalized, ",", ".", 1)
+	}
+	if normalized == text {
+		return value, "", err
+	}
+	if value, nerr := strconv.ParseFloat(normalized, 64); nerr == nil {
+		return value, unit, nil
+	}
+	// Report the payload as received rather than what is left of it
+	return value, "", err
+}
+
+// parsePrefixed parses text as an optionally signed integer with a 0x or 0b
+// prefix. It reports whether text has such a prefix, and fails for values
+// that do not fit in 64 bits. Values beyond 2^53 lose precision as floats.
+func parsePrefixed(text string) (float64, bool, error) {
+	digits, sign := text, 1.0
+	if strings.HasPrefix(digits, "-") {
+		digits, sign = digits[1:], -1
+	} else if strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+	}
+	if len(digits) < 2 || digits[0] != '0' {
+		return 0, false, nil
+	}
+	var base int
+	switch digits[1] {
+	case 'x', 'X':
+		base = 16
+	case 'b', 'B':
+		base = 2
+	default:
+		return 0, false, nil
+	}
+	value, err := strconv.ParseUint(digits[2:], base, 64)
+	if err != nil {
+		if numerr, ok := err.(*strconv.NumError); ok && numerr.Err == strconv.ErrRange {
+			return 0, true, fmt.Errorf("%s does not fit in 64 bits", text)
+		}
+		return 0, true, fmt.Errorf("invalid base %d number %s", base, text)
+	}
+	return sign * float64(value), true, nil
+}
+
+// stripUnit removes the trailing run of characters that cannot end a number,
+// along with the whitespace before it
+func stripUnit(text string) string {
+	end := len(text)
+	for end > 0 {
+		c := text[end-1]
+		if (c >= '0' && c <= '9') || c == '.' || c == ',' {
+			break
+		}
+		end--
+	}
+	return strings.TrimSpace(text[:end])
+}
+
+// splitTimestamp separates a payload of the form value<delimiter>epoch into
+// the value and the sample time, given in seconds since the Unix epoch
+func splitTimestamp(payload []byte, delimiter string) ([]byte, time.Time, error) {
+	i := bytes.LastIndex(payload, []byte(delimiter))
+	if i < 0 {
+		return nil, time.Time{}, fmt.Errorf("missing timestamp delimiter %q", delimiter)
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(payload[i+len(delimiter):])), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return nil, time.Time{}, fmt.Errorf("invalid timestamp %q", payload[i+len(delimiter):])
+	}
+	whole, frac := math.Modf(seconds)
+	return payload[:i], time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// parse extracts the numeric value from a payload received on the topic,
+// following the topic's field path through JSON or CBOR payloads when one
+// is configured. Plain text
+// payloads are parsed in format, and the unit stripped from them is
+// returned. Topics detecting edges also accept booleans.
+func (t *topic) parse(payload []byte, format numberFormat) (float64, string, error) {
+	if t.base64 {
+		var err error
+		if payload, err = decodeBase64(payload); err != nil {
+			return 0, "", err
+		}
+	}
+	if t.encoding != nil {
+		value, err := t.encoding.decodeBinary(payload, t.offset)
+		return value, "", err
+	}
+	format.booleans = t.mode == modeEdges || t.mode == modeEdgeCount
+	if t.cbor {
+		doc, err := decodeCBOR(payload)
+		if err != nil {
+			return 0, "", err
+		}
+		value, err := resolvePath(doc, t.jsonpath, format.booleans)
+		return value, "", err
+	}
+	if t.extract != nil {
+		match := t.extract.FindSubmatch(payload)
+		if match == nil {
+			return 0, "", fmt.Errorf("payload does not match %s %s", configKeyExtractRegex, t.extract)
+		}
+		return parseValueUnit(match[1], format)
+	}
+	if t.jsonpath == nil {
+		return parseValueUnit(payload, format)
+	}
+	value, err := parseJSONField(payload, t.jsonpath, format.booleans)
+	return value, "", err
+}
+
+// parseArray decodes a payload received on the array diff topic as a JSON
+// array of numbers
+func (t *topic) parseArray(payload []byte) ([]float64, error) {
+	if t.base64 {
+		var err error
+		if payload, err = decodeBase64(payload); err != nil {
+			return nil, err
+		}
+	}
+	return parseJSONArray(payload)
+}
+
+// decodeBase64 decodes payload from base64 in either the standard or the
+// URL-safe alphabet, with or without padding
+func decodeBase64(payload []byte) ([]byte, error) {
+	payload = bytes.TrimRight(bytes.TrimSpace(payload), "=")
+	encoding := base64.RawStdEncoding
+	if bytes.ContainsAny(payload, "-_") {
+		encoding = base64.RawURLEncoding
+	}
+	decoded := make([]byte, encoding.DecodedLen(len(payload)))
+	n, err := encoding.Decode(decoded, payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	return decoded[:n], nil
+}
+
+// parseJSONArray decodes payload as a JSON array of numbers
+func parseJSONArray(payload []byte) ([]float64, error) {
+	var values []float64
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return nil, fmt.Errorf("payload is not an array")
+	}
+	return values, nil
+}
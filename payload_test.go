@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseValueUnit(t *testing.T) {
+	var (
+		plain = numberFormat{}
+		units = numberFormat{stripunits: true}
+		comma = numberFormat{decimalcomma: true}
+		both  = numberFormat{stripunits: true, decimalcomma: true}
+	)
+	tests := []struct {
+		payload string
+		format  numberFormat
+		value   float64
+		unit    string
+		fails   bool
+	}{
+		{payload: "42", format: plain, value: 42},
+		{payload: " \t42.5\r\n", format: plain, value: 42.5},
+		{payload: "+2.3e1", format: plain, value: 23},
+		{payload: "-1.5E-3", format: plain, value: -0.0015},
+		{payload: "23.5 C", format: plain, fails: true},
+		{payload: "23.5 C", format: units, value: 23.5, unit: "C"},
+		{payload: " 23.5kWh ", format: units, value: 23.5, unit: "kWh"},
+		{payload: "+2.3e1 W", format: units, value: 23, unit: "W"},
+		{payload: "1,5", format: plain, fails: true},
+		{payload: "1,5", format: comma, value: 1.5},
+		{payload: "-0,25", format: comma, value: -0.25},
+		{payload: "1,5 kWh", format: comma, fails: true},
+		{payload: "1,5 kWh", format: both, value: 1.5, unit: "kWh"},
+		{payload: "1,234.5", format: comma, fails: true},
+		{payload: "1,2,3", format: comma, fails: true},
+		{payload: "", format: both, fails: true},
+		{payload: "abc", format: both, fails: true},
+		{payload: "C 23.5", format: units, fails: true},
+	}
+	for _, test := range tests {
+		value, unit, err := parseValueUnit([]byte(test.payload), test.format)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseValueUnit(%q, %+v) = %v, %q, want an error", test.payload, test.format, value, unit)
+			}
+			continue
+		}
+		if err != nil || value != test.value || unit != test.unit {
+			t.Errorf("parseValueUnit(%q, %+v) = %v, %q, %v, want %v, %q", test.payload, test.format, value, unit, err, test.value, test.unit)
+		}
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{"aGVsbG8=", "hello"},
+		{"aGVsbG8", "hello"},
+		{" aGVsbG8=\n", "hello"},
+		{"AAABLA==", "\x00\x00\x01\x2c"},
+		{"AAABLA", "\x00\x00\x01\x2c"},
+		// Standard alphabet
+		{"+/+/", "\xfb\xff\xbf"},
+		{"++8=", "\xfb\xef"},
+		{"++8", "\xfb\xef"},
+		// URL alphabet, detected by - or _
+		{"-_-_", "\xfb\xff\xbf"},
+		{"--8=", "\xfb\xef"},
+		{"--8", "\xfb\xef"},
+		{"_w", "\xff"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := decodeBase64([]byte(test.payload))
+		if err != nil || string(got) != test.want {
+			t.Errorf("decodeBase64(%q) = %q, %v, want %q", test.payload, got, err, test.want)
+		}
+	}
+}
+
+func TestDecodeBase64Invalid(t *testing.T) {
+	for _, payload := range []string{
+		// Both alphabets mixed
+		"+_",
+		"-/-/",
+		"aGVs bG8=",
+		"a",
+		"aGVsbG8*",
+	} {
+		if got, err := decodeBase64([]byte(payload)); err == nil {
+			t.Errorf("decodeBase64(%q) = %q, want an error", payload, got)
+		}
+	}
+}
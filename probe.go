@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultProbeInterval is the interval the connection is probed at
+	defaultProbeInterval = 30 * time.Second
+)
+
+// probeClient is the part of the framework's service client the connection
+// probe uses
+type probeClient interface {
+	Subscribe(topic string, callback func(topic string, payload []byte)) error
+	Unsubscribe(topics ...string) error
+	Publish(topic string, payload interface{}) error
+}
+
+// defaultProbeTopic returns the echo topic of the service serviceid
+func defaultProbeTopic(serviceid string) string {
+	return fmt.Sprintf("openchirp/service/%s/probe", serviceid)
+}
+
+// connectionProbe publishes a numbered probe to an echo topic it subscribes
+// to every interval. The connection counts as lost when a probe has not
+// come back by the time the next one is due, and as up again when one
+// does. This stands in for connection callbacks, which the framework client
+// does not offer.
+type connectionProbe struct {
+	client probeClient
+	topic  string
+	status *health
+
+	mu sync.Mutex
+	// sent is the number of the last probe published, and echoed is set
+	// once it came back
+	sent   uint64
+	echoed bool
+}
+
+// run probes the connection every interval until stop is closed
+func (p *connectionProbe) run(interval time.Duration, stop <-chan struct{}) {
+	subscribed := p.subscribe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			missed := p.sent > 0 && !p.echoed
+			p.sent++
+			p.echoed = false
+			sent := p.sent
+			p.mu.Unlock()
+
+			if missed {
+				if p.status.isConnected() {
+					log.Warn("Connection probe did not come back, the MQTT connection seems lost")
+				}
+				p.status.setConnected(false)
+				// The subscription may not have survived a reconnect
+				if subscribed {
+					p.client.Unsubscribe(p.topic)
+				}
+				subscribed = p.subscribe()
+			}
+			if err := p.client.Publish(p.topic, strconv.FormatUint(sent, 10)); err != nil {
+				log.Debug("Failed to publish connection probe: ", err)
+			}
+		case <-stop:
+			if subscribed {
+				p.client.Unsubscribe(p.topic)
+			}
+			return
+		}
+	}
+}
+
+// subscribe subscribes to the echo topic and reports whether it could
+func (p *connectionProbe) subscribe() bool {
+	if err := p.client.Subscribe(p.topic, p.echo); err != nil {
+		log.Debug("Failed to subscribe to the connection probe topic: ", err)
+		return false
+	}
+	return true
+}
+
+// echo receives a probe back, which shows the connection is up
+func (p *connectionProbe) echo(topic string, payload []byte) {
+	p.mu.Lock()
+	current := string(payload) == strconv.FormatUint(p.sent, 10)
+	if current {
+		p.echoed = true
+	}
+	p.mu.Unlock()
+	if current {
+		p.status.setConnected(true)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// publishRetries is the number of times a failed publish is retried
+	// before its output is dropped
+	publishRetries = 2
+	// publishRetryBackoff is the wait before the first retry, which doubles
+	// for each retry after it
+	publishRetryBackoff = 50 * time.Millisecond
+	// publishFailingAfter is the number of outputs dropped in a row after
+	// which a device is considered to be failing to publish
+	publishFailingAfter = 5
+)
+
+// notePublish accounts for the outcome err of publishing p. A dropped
+// output is counted and logged. Once publishFailingAfter outputs in a row
+// are dropped the device counts as failing in the service status, and when
+// publishing recovers the number dropped is published to errorTopic, if
+// PublishErrors is set. It may be called without the device lock, from a
+// worker of the publish queue.
+func (d *Device) notePublish(p *pendingPublish, err error) {
+	d.pubmu.Lock()
+	if err != nil {
+		d.publishfailures++
+		d.failedinarow++
+		failing := d.failedinarow == publishFailingAfter
+		d.pubmu.Unlock()
+		atomic.AddUint64(&d.opts.stats.publishfailures, 1)
+		p.logitem.Warnf("Failed to publish to %s, dropping the output: %v", p.subtopic, err)
+		if failing {
+			atomic.AddInt64(&d.opts.stats.failing, 1)
+			p.logitem.Errorf("The last %d publishes failed, outputs are being dropped", publishFailingAfter)
+		}
+		return
+	}
+	dropped := d.failedinarow
+	if dropped > 0 {
+		d.resetPublishFailing()
+	}
+	d.pubmu.Unlock()
+	if dropped == 0 {
+		return
+	}
+	p.logitem.Infof("Publishing recovered after %d dropped outputs", dropped)
+	if p.reporterrors && p.subtopic != errorTopic {
+		// Published directly rather than queued, since a worker of a full
+		// blocking queue must not wait on the queue, and without waiting
+		// on retries, since the device lock may be held
+		report := *p
+		report.subtopic = errorTopic
+		report.payload = fmt.Sprintf("dropped %d outputs that failed to publish", dropped)
+		report.trySend()
+	}
+}
+
+// resetPublishFailing forgets the outputs dropped in a row, so the device no
+// longer counts as failing to publish. pubmu must be held.
+func (d *Device) resetPublishFailing() {
+	if d.failedinarow >= publishFailingAfter {
+		atomic.AddInt64(&d.opts.stats.failing, -1)
+	}
+	d.failedinarow = 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultPublishWorkers is the number of workers draining the publish
+	// queue
+	defaultPublishWorkers = 4
+
+	publishQueueDropOldest = "drop-oldest"
+	publishQueueDropNewest = "drop-newest"
+	publishQueueBlock      = "block"
+)
+
+// pendingPublish is an output waiting to be published. The link settings
+// it is published with are taken when it is queued, so a config change
+// while it waits does not race with the worker publishing it.
+type pendingPublish struct {
+	d        *Device
+	ctrl     deviceControl
+	logitem  *log.Entry
+	subtopic string
+	payload  interface{}
+	qos      byte
+	retain   bool
+	// reporterrors is set if PublishErrors is
+	reporterrors bool
+}
+
+// publishQueue publishes outputs from a pool of workers, so processing a
+// message does not wait on the MQTT server. Every worker has its own part
+// of the queue, and the outputs of a device always go to the same worker,
+// so they are published in order. It is safe for concurrent use.
+type publishQueue struct {
+	// dropped counts the outputs dropped for the queue being full. It is
+	// accessed atomically, so it must stay 64-bit aligned.
+	dropped uint64
+	// mu is held for reading while queueing and for writing to close the
+	// queue, so nothing is queued once the workers are told to finish
+	mu     sync.RWMutex
+	closed bool
+	policy string
+	size   int
+	queues []chan pendingPublish
+	wg     sync.WaitGroup
+}
+
+// parsePublishQueuePolicy checks that policy is one of the overflow
+// policies of the publish queue
+func parsePublishQueuePolicy(policy string) error {
+	switch policy {
+	case publishQueueDropOldest, publishQueueDropNewest, publishQueueBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown publish queue policy \"%s\", must be %s, %s, or %s", policy, publishQueueDropOldest, publishQueueDropNewest, publishQueueBlock)
+}
+
+// newPublishQueue starts workers that drain a queue of size outputs in
+// total. When a worker's part of the queue is full, policy decides whether
+// the oldest output is dropped, the new one is, or queueing blocks until
+// there is room.
+func newPublishQueue(size, workers int, policy string) *publishQueue {
+	if workers > size {
+		workers = size
+	}
+	q := &publishQueue{
+		policy: policy,
+		size:   size,
+		queues: make([]chan pendingPublish, workers),
+	}
+	for i := range q.queues {
+		// Spread the remainder over the first workers
+		n := size / workers
+		if i < size%workers {
+			n++
+		}
+		q.queues[i] = make(chan pendingPublish, n)
+		q.wg.Add(1)
+		go q.work(q.queues[i])
+	}
+	return q
+}
+
+// work publishes the outputs of queue until it is closed and empty
+func (q *publishQueue) work(queue <-chan pendingPublish) {
+	defer q.wg.Done()
+	for p := range queue {
+		p.send()
+	}
+}
+
+// push queues p on the worker of its device. Once the queue is closed, p
+// is published right away instead. It is called with the device lock held.
+func (q *publishQueue) push(p pendingPublish) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		p.trySend()
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(p.d.id))
+	queue := q.queues[h.Sum32()%uint32(len(q.queues))]
+	switch q.policy {
+	case publishQueueBlock:
+		queue <- p
+		return
+	case publishQueueDropNewest:
+		select {
+		case queue <- p:
+		default:
+			q.drop(p)
+		}
+		return
+	}
+	for {
+		select {
+		case queue <- p:
+			return
+		default:
+		}
+		// Make room by dropping the oldest output, unless a worker just
+		// took it
+		select {
+		case old := <-queue:
+			q.drop(old)
+		default:
+		}
+	}
+}
+
+// drop counts the output p dropped for the queue being full
+func (q *publishQueue) drop(p pendingPublish) {
+	atomic.AddUint64(&q.dropped, 1)
+	if debugging() {
+		p.logitem.Debugf("Publish queue full, dropping the output to %s", p.subtopic)
+	}
+}
+
+// depth returns the number of outputs waiting in the queue
+func (q *publishQueue) depth() int {
+	n := 0
+	for _, queue := range q.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// drops returns the number of outputs dropped for the queue being full
+func (q *publishQueue) drops() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// close stops queueing and waits for the workers to publish what is left
+func (q *publishQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, queue := range q.queues {
+			close(queue)
+		}
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
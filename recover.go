@@ -0,0 +1,23 @@
+package main
+
+import (
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverPanic recovers from a panic in the framework callback named where,
+// so a single bad message or config cannot take down the service and every
+// other linked device. It must be deferred while the device lock is held.
+// If status is not nil, it is set to an error for the service status.
+func (d *Device) recoverPanic(logitem *log.Entry, where string, status *string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	d.panics++
+	logitem.Errorf("Recovered from panic in %s: %v | panics=%d\n%s", where, r, d.panics, debug.Stack())
+	if status != nil {
+		*status = "Error: internal error, see the service log"
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// replayDeviceID is the device id of the replayed link
+	replayDeviceID = "replay"
+)
+
+// replayCommand is the replay subcommand, which runs the samples of a CSV
+// file through a link config and writes out what it would have published
+var replayCommand = cli.Command{
+	Name:      "replay",
+	Usage:     "Run the samples of a CSV file of timestamp,topic,value rows through a link config and write the outputs as CSV",
+	ArgsUsage: "[Key=Value...]",
+	Description: "The link config is given as for validate. Timestamps are RFC 3339 times or\n" +
+		"   seconds since the Unix epoch, and drive the rates and time windows in\n" +
+		"   place of the wall clock. Each output is written as a timestamp,topic,payload\n" +
+		"   row with the timestamp of the sample that produced it.",
+	Action: replay,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "input",
+			Usage: "CSV file to read the samples from, or - for stdin",
+			Value: "-",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "CSV file to write the outputs to, or - for stdout",
+			Value: "-",
+		},
+		cli.StringFlag{
+			Name:  "input-topics",
+			Usage: "InputTopics of the link",
+		},
+		cli.StringFlag{
+			Name:  "output-topics",
+			Usage: "OutputTopics of the link",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "Mode of the link",
+		},
+	},
+}
+
+// replay implements the replay subcommand
+func replay(ctx *cli.Context) error {
+	global := ctx.Parent()
+	if _, err := loadConfigFile(global); err != nil {
+		log.Error("Failed to load config file: ", err)
+		return cli.NewExitError(nil, 1)
+	}
+
+	config, err := validateConfig(ctx, nil)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(nil, 1)
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := ctx.String("input"); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Error("Failed to open input: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+		defer f.Close()
+		in = f
+	}
+	out := io.Writer(os.Stdout)
+	if path := ctx.String("output"); path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Error("Failed to create output: ", err)
+			return cli.NewExitError(nil, 1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	r := &replayer{
+		out:  csv.NewWriter(out),
+		subs: make(map[string]interface{}),
+	}
+	opts := &serviceOptions{
+		defaultSuffix: strings.TrimSpace(global.String("default-suffix")),
+		precision:     global.Int("default-precision"),
+		maxTopics:     global.Int("max-topics-per-device"),
+		clock:         func() time.Time { return r.now },
+	}
+	if err := r.run(opts, config, in); err != nil {
+		log.Error(err)
+		return cli.NewExitError(nil, 1)
+	}
+	return nil
+}
+
+// replayer feeds the rows of a CSV file to a device as messages, with the
+// clock set to the time of each row, and writes out what the device
+// publishes. It implements deviceControl for the device.
+type replayer struct {
+	config map[string]string
+	out    *csv.Writer
+	// subs maps the topic filters the device subscribed to to their keys
+	subs map[string]interface{}
+	// now is the time of the row being replayed, and stamp its timestamp
+	// as written in the file
+	now   time.Time
+	stamp string
+	// err is the first error writing an output
+	err error
+}
+
+// run links a device with config and replays the rows read from in. The
+// stale, republish, and statistics timers are not started, since they run
+// on the wall clock.
+func (r *replayer) run(opts *serviceOptions, config map[string]string, in io.Reader) error {
+	r.config = config
+	d := newDeviceFactory(opts)().(*Device)
+	d.id = replayDeviceID
+	if status := d.configure(log.WithField("deviceid", replayDeviceID), config, opts); len(status) > 0 {
+		return fmt.Errorf("invalid link config: %s", status)
+	}
+	d.subscribe(r)
+
+	rows := csv.NewReader(in)
+	rows.FieldsPerRecord = 3
+	rows.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		t, err := parseReplayTime(row[0])
+		if err != nil {
+			// Allow a header row
+			if line == 1 {
+				continue
+			}
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		r.now, r.stamp = t, row[0]
+		for filter, key := range r.subs {
+			if matchFilter(filter, row[1]) {
+				d.processMessage(r, row[1], key, []byte(row[2]))
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	r.out.Flush()
+	return r.out.Error()
+}
+
+// parseReplayTime parses an RFC 3339 time or seconds since the Unix epoch
+func parseReplayTime(text string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", text)
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// matchFilter reports whether topic matches the MQTT topic filter
+func matchFilter(filter, topic string) bool {
+	flevels := strings.Split(filter, "/")
+	tlevels := strings.Split(topic, "/")
+	for i, level := range flevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(tlevels) || (level != wildcardLevel && level != tlevels[i]) {
+			return false
+		}
+	}
+	return len(flevels) == len(tlevels)
+}
+
+// Id implements deviceControl
+func (r *replayer) Id() string {
+	return replayDeviceID
+}
+
+// Config implements deviceControl
+func (r *replayer) Config() map[string]string {
+	return r.config
+}
+
+// Subscribe records the key the rows matching subtopic are delivered with
+func (r *replayer) Subscribe(subtopic string, key interface{}) error {
+	r.subs[subtopic] = key
+	return nil
+}
+
+// Unsubscribe forgets the keys of subtopics
+func (r *replayer) Unsubscribe(subtopics ...string) error {
+	for _, subtopic := range subtopics {
+		delete(r.subs, subtopic)
+	}
+	return nil
+}
+
+// Publish writes payload as an output row with the timestamp of the row
+// being replayed
+func (r *replayer) Publish(subtopic string, payload interface{}) error {
+	if err := r.out.Write([]string{r.stamp, subtopic, fmt.Sprint(payload)}); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
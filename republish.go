@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// republishRecheckInterval is how often a device without a Republish
+	// interval checks whether the service's default interval was enabled
+	republishRecheckInterval = time.Minute
+)
+
+// startRepublish starts a goroutine that publishes the last payload of every
+// topic again every Republish interval. Devices without one follow the
+// service's default interval, which a SIGHUP may change.
+func (d *Device) startRepublish(ctrl deviceControl) {
+	if d.paused {
+		return
+	}
+	stop := make(chan struct{})
+	d.stoprepublish = stop
+
+	go func(interval time.Duration) {
+		for {
+			current := interval
+			if current <= 0 {
+				current = d.opts.defaultRepublish()
+			}
+			wait := current
+			if wait <= 0 {
+				wait = republishRecheckInterval
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				if current <= 0 {
+					continue
+				}
+				d.mu.Lock()
+				// The goroutine may have been stopped while waiting on the lock
+				select {
+				case <-stop:
+				default:
+					d.processRepublish(ctrl, current)
+				}
+				d.mu.Unlock()
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}(d.republish)
+}
+
+// stopRepublish stops the goroutine started by startRepublish
+func (d *Device) stopRepublish() {
+	if d.stoprepublish != nil {
+		close(d.stoprepublish)
+		d.stoprepublish = nil
+	}
+}
+
+// processRepublish publishes the last payload of every topic that has not
+// published within the interval, so that topics publishing on their own, or
+// held back by MinInterval, are not published twice. This includes the _min
+// and _max payloads of minmax topics and the PairDiff difference. With
+// CombinedOutput, the combined output is published again instead.
+// The device lock must be held.
+func (d *Device) processRepublish(ctrl deviceControl, interval time.Duration) {
+	now := d.opts.now()
+	if len(d.combined) > 0 {
+		if now.Sub(d.combinedsent) >= interval {
+			d.publishCombined(ctrl)
+		}
+		return
+	}
+	d.eachTopic(func(index int, t *topic) {
+		if now.Sub(t.lastsent) < interval {
+			return
+		}
+		logitem := log.WithFields(log.Fields{
+			"deviceid": ctrl.Id(),
+			"topic":    t.intopic,
+			"index":    index,
+			"outtopic": t.outtopic,
+		})
+		if len(t.lastpayload) > 0 {
+			logitem.Debugf("Republishing %s", t.lastpayload)
+			d.publishTopic(ctrl, logitem, t, t.lastpayload)
+		}
+		if len(t.lastextremes[0]) > 0 || len(t.lastextremes[1]) > 0 {
+			for i, suffix := range []string{minTopicSuffix, maxTopicSuffix} {
+				if len(t.lastextremes[i]) > 0 {
+					logitem.Debugf("Republishing %s=%s", suffix, t.lastextremes[i])
+					d.publish(ctrl, logitem, t.outtopic+suffix, t.lastextremes[i])
+				}
+			}
+			t.lastsent = now
+		}
+	})
+	if d.pair != nil && len(d.pair.lastpayload) > 0 && now.Sub(d.pair.lastsent) >= interval {
+		logitem := log.WithFields(log.Fields{
+			"deviceid": ctrl.Id(),
+			"outtopic": d.pair.outtopic,
+		})
+		logitem.Debugf("Republishing %s", d.pair.lastpayload)
+		d.publishPair(ctrl, logitem, d.pair.lastpayload)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStatusInterval is the interval the service status is updated
+	// with the service statistics at
+	defaultStatusInterval = time.Minute
+)
+
+// serviceStats are the counters shared by all devices that the service
+// status reports
+type serviceStats struct {
+	// messages counts the messages processed by all devices. It is
+	// accessed atomically, so it must stay 64-bit aligned.
+	messages uint64
+	// refused counts the links refused for exceeding the device limit
+	refused uint64
+	// evictions counts the times idle devices had their state evicted
+	evictions uint64
+	// publishfailures counts the outputs dropped for failing to publish
+	publishfailures uint64
+	// failing is the number of devices whose recent publishes all failed
+	failing int64
+}
+
+// countMessage counts a message processed by a device
+func (s *serviceStats) countMessage() {
+	atomic.AddUint64(&s.messages, 1)
+}
+
+// countRefused counts a link refused for exceeding the device limit
+func (s *serviceStats) countRefused() {
+	atomic.AddUint64(&s.refused, 1)
+}
+
+// count returns the number of linked devices
+func (r *deviceRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.devices)
+}
+
+// reportStatus updates the service status with the number of linked
+// devices out of the limit, the message rate, the uptime, the links
+// refused for the limit, the idle evictions, the publish failures, the MQTT
+// disconnects, and the publish queue every interval, until stop is closed
+func reportStatus(c serviceClient, opts *serviceOptions, conn *health, started time.Time, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, lasttime := atomic.LoadUint64(&opts.stats.messages), time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			messages := atomic.LoadUint64(&opts.stats.messages)
+			rate := float64(messages-last) / now.Sub(lasttime).Minutes()
+			last, lasttime = messages, now
+			devices := fmt.Sprint(opts.devices.count())
+			if opts.maxDevices > 0 {
+				devices += fmt.Sprintf("/%d", opts.maxDevices)
+			}
+			status := fmt.Sprintf("Running: %s devices, %s msgs/min, up %s", devices, formatCount(rate), formatUptime(now.Sub(started)))
+			if refused := atomic.LoadUint64(&opts.stats.refused); refused > 0 {
+				status += fmt.Sprintf(", %d links refused", refused)
+			}
+			if evictions := atomic.LoadUint64(&opts.stats.evictions); evictions > 0 {
+				status += fmt.Sprintf(", %d idle evictions", evictions)
+			}
+			if failures := atomic.LoadUint64(&opts.stats.publishfailures); failures > 0 {
+				status += fmt.Sprintf(", %d publish failures", failures)
+			}
+			if failing := atomic.LoadInt64(&opts.stats.failing); failing > 0 {
+				status += fmt.Sprintf(", %d devices failing to publish", failing)
+			}
+			if disconnects := conn.disconnectCount(); disconnects > 0 {
+				status += fmt.Sprintf(", %d disconnects", disconnects)
+			}
+			if opts.queue != nil {
+				status += fmt.Sprintf(", queue %d/%d", opts.queue.depth(), opts.queue.size)
+				if drops := opts.queue.drops(); drops > 0 {
+					status += fmt.Sprintf(", %d queue drops", drops)
+				}
+			}
+			if err := c.SetStatus(status); err != nil {
+				log.Warn("Failed to publish service status: ", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// formatCount renders n compactly, such as 950, 1.2k, or 3.4M
+func formatCount(n float64) string {
+	switch {
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	case n >= 10:
+		return fmt.Sprintf("%.0f", n)
+	default:
+		return fmt.Sprintf("%.1f", n)
+	}
+}
+
+// formatUptime renders d in its two largest units, such as 3d4h or 5m12s
+func formatUptime(d time.Duration) string {
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm%ds", minutes, seconds)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
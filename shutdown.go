@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// deviceRegistry tracks the linked devices, so they can be paused when the
+// service shuts down. The zero value is ready to use.
+type deviceRegistry struct {
+	mu      sync.Mutex
+	devices map[*Device]deviceControl
+}
+
+// register adds the linked device d, which publishes through ctrl, unless
+// max is positive and max other devices are registered already. It reports
+// whether d was registered.
+func (r *deviceRegistry) register(d *Device, ctrl deviceControl, max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.devices[d]; !ok && max > 0 && len(r.devices) >= max {
+		return false
+	}
+	if r.devices == nil {
+		r.devices = make(map[*Device]deviceControl)
+	}
+	r.devices[d] = ctrl
+	return true
+}
+
+// unregister forgets the unlinked device d
+func (r *deviceRegistry) unregister(d *Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.devices, d)
+}
+
+// pause pauses every linked device, publishing marker to their status
+// topics unless it is empty
+func (r *deviceRegistry) pause(marker string) {
+	r.mu.Lock()
+	devices := make(map[*Device]deviceControl, len(r.devices))
+	for d, ctrl := range r.devices {
+		devices[d] = ctrl
+	}
+	r.mu.Unlock()
+
+	// Devices are locked without holding the registry lock, since
+	// ProcessLink registers while holding the device lock
+	for d, ctrl := range devices {
+		d.pause(ctrl, marker)
+	}
+}
+
+// pause stops the device from processing further messages, so that its
+// state no longer changes, and publishes marker to the status topic of every
+// output topic, so downstream users know the diffs will be discontinuous
+func (d *Device) pause(ctrl deviceControl, marker string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.paused = true
+	d.stopStaleTimers()
+	d.stopRepublish()
+	d.stopStats()
+	d.stopCombined()
+	if len(marker) == 0 {
+		return
+	}
+
+	d.eachTopic(func(index int, t *topic) {
+		logitem := log.WithFields(log.Fields{
+			"deviceid": ctrl.Id(),
+			"topic":    t.intopic,
+			"index":    index,
+			"outtopic": t.outtopic,
+		})
+		d.publish(ctrl, logitem, t.outtopic+statusTopicSuffix, marker)
+	})
+	if d.pair != nil {
+		logitem := log.WithFields(log.Fields{
+			"deviceid": ctrl.Id(),
+			"outtopic": d.pair.outtopic,
+		})
+		d.publish(ctrl, logitem, d.pair.outtopic+statusTopicSuffix, marker)
+	}
+}
+
+// waitTimeout runs fn and waits for it to return for at most timeout, or
+// indefinitely if timeout is 0. It reports whether fn returned in time.
+func waitTimeout(timeout time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-expired:
+		return false
+	}
+}
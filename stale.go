@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// statusTopicSuffix is appended to an output topic to form the topic its
+	// stale and shutdown markers are published to
+	statusTopicSuffix  = "_status"
+	defaultStaleMarker = "stale"
+)
+
+// startStaleTimers starts a timer for every input topic that fires when the
+// topic receives no message for StaleTimeout. Topics matched by wildcards
+// get their timer once they first match.
+func (d *Device) startStaleTimers(ctrl deviceControl) {
+	d.eachTopic(func(index int, t *topic) {
+		d.startStaleTimer(ctrl, index, t)
+	})
+}
+
+// startStaleTimer starts the stale timer of t, the topic of the config entry
+// at index
+func (d *Device) startStaleTimer(ctrl deviceControl, index int, t *topic) {
+	if d.staletimeout <= 0 || d.paused {
+		return
+	}
+	var timer *time.Timer
+	// timer is read under the device lock, which the caller holds until it
+	// is assigned
+	timer = time.AfterFunc(d.staletimeout, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.processStale(ctrl, index, t, timer)
+	})
+	t.staletimer = timer
+	t.staletouched = time.Now()
+}
+
+// stopStaleTimers stops the timers started by startStaleTimers
+func (d *Device) stopStaleTimers() {
+	d.eachTopic(func(index int, t *topic) {
+		if t.staletimer != nil {
+			t.staletimer.Stop()
+			t.staletimer = nil
+		}
+	})
+}
+
+// touchStaleTimer restarts the stale timer of t after it received a message
+func (d *Device) touchStaleTimer(t *topic) {
+	if t.staletimer != nil {
+		t.staletimer.Reset(d.staletimeout)
+		t.staletouched = time.Now()
+	}
+}
+
+// processStale publishes the stale marker for t when its timer fires. The
+// timer may have been replaced or stopped while the callback waited on the
+// lock, or restarted by a message, in which case it does nothing. A
+// restarted timer fires again once the topic is stale. The device lock must
+// be held.
+func (d *Device) processStale(ctrl deviceControl, index int, t *topic, timer *time.Timer) {
+	if t.staletimer != timer || time.Since(t.staletouched) < d.staletimeout {
+		return
+	}
+
+	logitem := log.WithFields(log.Fields{
+		"deviceid": ctrl.Id(),
+		"topic":    t.intopic,
+		"index":    index,
+		"outtopic": t.outtopic,
+	})
+	logitem.Warnf("No message received for %v", d.staletimeout)
+	d.publish(ctrl, logitem, t.outtopic+statusTopicSuffix, d.stalemarker)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// standaloneQoS is the QoS of the publishes of the standalone client
+	// without a QoS of their own
+	standaloneQoS = 0
+)
+
+// standaloneClient links the devices of a local devices file directly over
+// an MQTT broker, without a framework server. Device topics are used as raw
+// MQTT topics.
+type standaloneClient struct {
+	conn *mqttConn
+
+	mu sync.Mutex
+	// devices are the linked devices by name
+	devices map[string]*Device
+	// controls are the deviceControls of the linked devices by name
+	controls map[string]*standaloneControl
+}
+
+// standaloneControl is the deviceControl of a device linked by a
+// standaloneClient
+type standaloneControl struct {
+	conn   *mqttConn
+	device *Device
+	id     string
+	config map[string]string
+}
+
+// loadDevicesFile reads the JSON file mapping device names to their link
+// config, such as {"boiler": {"InputTopics": "sensors/boiler/temp"}}
+func loadDevicesFile(path string) (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices map[string]map[string]string
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%s: no devices", path)
+	}
+	return devices, nil
+}
+
+// startStandalone connects to the MQTT broker and links every device of the
+// devices file. A nil tlsconfig dials tls:// brokers with the defaults.
+// Devices whose config is invalid are logged and skipped.
+func startStandalone(broker string, mqttopts mqttClientOptions, tlsconfig *tls.Config, devicesFile string, opts *serviceOptions, status *health) (*standaloneClient, error) {
+	configs, err := loadDevicesFile(devicesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialMQTT(broker, "", "", mqttopts, tlsconfig, status)
+	if err != nil {
+		return nil, err
+	}
+	s := &standaloneClient{
+		conn:     conn,
+		devices:  make(map[string]*Device),
+		controls: make(map[string]*standaloneControl),
+	}
+
+	// Link in a stable order, so the logs are reproducible
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	newDevice := newDeviceFactory(opts)
+	for _, name := range names {
+		d := newDevice().(*Device)
+		ctrl := &standaloneControl{conn: conn, device: d, id: name, config: configs[name]}
+		s.mu.Lock()
+		s.devices[name] = d
+		s.controls[name] = ctrl
+		s.mu.Unlock()
+
+		logitem := log.WithField("deviceid", name)
+		linkstatus := d.processLink(ctrl)
+		if !strings.HasPrefix(linkstatus, "Success") {
+			logitem.Error("Failed to link: ", linkstatus)
+			s.mu.Lock()
+			delete(s.devices, name)
+			delete(s.controls, name)
+			s.mu.Unlock()
+			continue
+		}
+		logitem.Info("Linked: ", linkstatus)
+	}
+	return s, nil
+}
+
+// SetStatus logs the service status, since there is no framework server to
+// report it to
+func (s *standaloneClient) SetStatus(msgs ...interface{}) error {
+	log.Info("Service status: ", fmt.Sprint(msgs...))
+	return nil
+}
+
+// StopClient unlinks every device and disconnects from the broker
+func (s *standaloneClient) StopClient() {
+	s.mu.Lock()
+	devices := make(map[*standaloneControl]*Device, len(s.devices))
+	for name, d := range s.devices {
+		devices[s.controls[name]] = d
+	}
+	s.mu.Unlock()
+
+	for ctrl, d := range devices {
+		d.processUnlink(ctrl)
+	}
+	s.conn.close()
+}
+
+// Id implements deviceControl
+func (c *standaloneControl) Id() string {
+	return c.id
+}
+
+// Config implements deviceControl
+func (c *standaloneControl) Config() map[string]string {
+	return c.config
+}
+
+// Subscribe subscribes the device to the raw topic filter subtopic
+func (c *standaloneControl) Subscribe(subtopic string, key interface{}) error {
+	c.conn.subscribe(c.device, c, subtopic, key)
+	return nil
+}
+
+// Unsubscribe removes the device's subscriptions to the raw topic filters
+// subtopics. The client stays subscribed while other devices use a filter.
+func (c *standaloneControl) Unsubscribe(subtopics ...string) error {
+	c.conn.unsubscribe(c.device, subtopics...)
+	return nil
+}
+
+// Publish publishes payload to the raw topic subtopic
+func (c *standaloneControl) Publish(subtopic string, payload interface{}) error {
+	return c.PublishOptions(subtopic, payload, standaloneQoS, false)
+}
+
+// PublishOptions publishes payload to the topic subtopic with the given QoS
+// and retained flag
+func (c *standaloneControl) PublishOptions(subtopic string, payload interface{}, qos byte, retain bool) error {
+	return c.conn.publish(subtopic, payload, qos, retain)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStartupRetries is the number of times starting the service
+	// client is retried before the service gives up
+	defaultStartupRetries = 5
+	// defaultStartupBackoff is the wait before the first retry, which
+	// doubles for each retry after it
+	defaultStartupBackoff = time.Second
+	// maxStartupBackoff caps the wait between retries
+	maxStartupBackoff = time.Minute
+)
+
+// retryStartup calls start until it succeeds, retrying up to retries times,
+// or forever if forever is set, with exponential backoff from backoff. what
+// names the attempt in the logs. The error of the last attempt is returned.
+func retryStartup(what string, retries int, backoff time.Duration, forever bool, start func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := start()
+		if err == nil {
+			return nil
+		}
+		if !forever && attempt > retries {
+			return err
+		}
+		log.Warnf("Failed to %s on attempt %d, retrying in %v: %v", what, attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// stateSaveInterval is how often the state file is rewritten
+	stateSaveInterval = 30 * time.Second
+)
+
+// topicState is the persisted state of a single input topic
+type topicState struct {
+	Mode string `json:"mode"`
+	// LastValue and LastDiff are omitted until known, since JSON has no NaN
+	LastValue *float64  `json:"lastvalue,omitempty"`
+	LastTime  time.Time `json:"lasttime"`
+	LastDiff  *float64  `json:"lastdiff,omitempty"`
+	Sum       float64   `json:"sum,omitempty"`
+	// Period is the start of the day of the daily mode baseline in Sum
+	Period *time.Time `json:"period,omitempty"`
+	// Min and Max are the extremes of minmax mode
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// deviceState maps the input topics of a device to their persisted state
+type deviceState map[string]topicState
+
+// stateBackend loads and saves the persisted state of all devices
+type stateBackend interface {
+	// load returns the saved state of every device
+	load() (map[string]deviceState, error)
+	// save stores states, replacing the saved state of those devices, and
+	// removes the state of the removed device ids
+	save(states map[string]deviceState, removed []string) error
+	// String describes the backend for log messages
+	String() string
+}
+
+// deviceLoader is implemented by backends that can load the state of a
+// single device. Devices read their state from them again when they link,
+// since the backend may not have been reachable at startup, or the state
+// may have been saved by another instance of the service since.
+type deviceLoader interface {
+	loadDevice(id string) (deviceState, error)
+}
+
+// stateStore persists the state of all linked devices through a backend,
+// so that diffs continue where they left off after a restart. Device state
+// is only snapshotted periodically, so ProcessMessage never waits on the
+// backend.
+type stateStore struct {
+	backend stateBackend
+
+	mu sync.Mutex
+	// devices are the currently linked devices
+	devices map[string]*Device
+	// saved holds the loaded states of devices that have not been linked
+	// since, so that they are not lost by the next save
+	saved map[string]deviceState
+	// removed are the ids of devices unlinked since the last save
+	removed []string
+}
+
+// newStateStore creates a store on backend and loads any state it holds.
+// A failure to load only produces a warning.
+func newStateStore(backend stateBackend) *stateStore {
+	s := &stateStore{
+		backend: backend,
+		devices: make(map[string]*Device),
+		saved:   make(map[string]deviceState),
+	}
+
+	saved, err := backend.load()
+	if err != nil {
+		log.Warnf("Ignoring state from %v: %v", backend, err)
+		return s
+	}
+	if saved != nil {
+		s.saved = saved
+	}
+	log.Infof("Loaded state of %d devices from %v", len(s.saved), backend)
+	return s
+}
+
+// register adds the linked device d under id and returns the state saved
+// for it, which may be nil. Backends that can load a single device are
+// asked for its current state, falling back to the state loaded at startup.
+func (s *stateStore) register(id string, d *Device) deviceState {
+	var loaded deviceState
+	if loader, ok := s.backend.(deviceLoader); ok {
+		// The backend is read without holding the store lock, so a slow
+		// backend does not hold up the other devices
+		var err error
+		if loaded, err = loader.loadDevice(id); err != nil {
+			log.WithField("deviceid", id).Warnf("Failed to load state from %v: %v", s.backend, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[id] = d
+	state := s.saved[id]
+	delete(s.saved, id)
+	if loaded != nil {
+		state = loaded
+	}
+	return state
+}
+
+// unregister forgets the device with id, so its state is no longer saved
+func (s *stateStore) unregister(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.devices, id)
+	delete(s.saved, id)
+	s.removed = append(s.removed, id)
+}
+
+// save writes the state of all devices to the backend
+func (s *stateStore) save() error {
+	s.mu.Lock()
+	states := make(map[string]deviceState, len(s.devices)+len(s.saved))
+	for id, state := range s.saved {
+		states[id] = state
+	}
+	devices := make(map[string]*Device, len(s.devices))
+	for id, d := range s.devices {
+		devices[id] = d
+	}
+	removed := s.removed
+	s.removed = nil
+	s.mu.Unlock()
+
+	// Devices are snapshotted without holding the store lock, since
+	// ProcessLink registers while holding the device lock
+	for id, d := range devices {
+		states[id] = d.snapshot()
+	}
+	// A device unlinked and linked again since the last save is saved
+	// rather than removed, since backends may apply the removals last
+	var kept []string
+	for _, id := range removed {
+		if _, ok := states[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+	removed = kept
+
+	if err := s.backend.save(states, removed); err != nil {
+		// Retry the removals with the next save
+		s.mu.Lock()
+		s.removed = append(s.removed, removed...)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// run saves the state every stateSaveInterval until stop is closed
+func (s *stateStore) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Warnf("Failed to save state to %v: %v", s.backend, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fileBackend keeps the state of all devices in a single JSON file
+type fileBackend struct {
+	path string
+}
+
+func (f *fileBackend) String() string {
+	return "state file " + f.path
+}
+
+// load reads the state file. A missing file holds no state.
+func (f *fileBackend) load() (map[string]deviceState, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states map[string]deviceState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// save atomically rewrites the state file with states. Removed devices are
+// simply not written.
+func (f *fileBackend) save(states map[string]deviceState, removed []string) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file next to the target and rename it over the
+	// target, so a crash never leaves a partially written state file
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// snapshot returns the persistable state of the device's topics
+func (d *Device) snapshot() deviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := make(deviceState, len(d.topics))
+	d.eachTopic(func(index int, t *topic) {
+		ts := topicState{
+			Mode:     t.mode,
+			LastTime: t.state.LastTime,
+			Sum:      t.state.Sum,
+		}
+		if !math.IsNaN(t.state.Last) {
+			lastvalue := t.state.Last
+			ts.LastValue = &lastvalue
+		}
+		if !math.IsNaN(t.state.LastDiff) {
+			lastdiff := t.state.LastDiff
+			ts.LastDiff = &lastdiff
+		}
+		if !t.state.Period.IsZero() {
+			period := t.state.Period
+			ts.Period = &period
+		}
+		if !math.IsNaN(t.state.Min) {
+			min, max := t.state.Min, t.state.Max
+			ts.Min, ts.Max = &min, &max
+		}
+		state[t.name()] = ts
+	})
+	return state
+}
+
+// restore applies the saved state to the device's topics. Saved topics
+// matching a wildcard, and the saved fields of JsonAllFields topics, are
+// matched again. State that depends on the mode is
+// only restored when the mode is unchanged.
+func (d *Device) restore(state deviceState) {
+	for i := range d.topics {
+		t := &d.topics[i]
+		if t.allfields {
+			// Sorted names claim the fields up to the limit as messages do
+			prefix := t.intopic + fieldNameSeparator
+			var names []string
+			for name := range state {
+				if strings.HasPrefix(name, prefix) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if f := d.field(t, strings.TrimPrefix(name, prefix)); f != nil {
+					f.restore(state[name])
+				}
+			}
+			continue
+		}
+		if !t.wildcard {
+			if ts, ok := state[t.name()]; ok {
+				t.restore(ts)
+			}
+			continue
+		}
+		for intopic, ts := range state {
+			if matched, ok := matchTopic(t.intopic, intopic); ok && matched == intopic {
+				if m := d.match(t, intopic); m != nil {
+					m.restore(ts)
+				}
+			}
+		}
+	}
+}
+
+// restore applies the saved state ts to the topic
+func (t *topic) restore(ts topicState) {
+	if ts.LastValue != nil {
+		t.state.Last = *ts.LastValue
+		t.state.LastTime = ts.LastTime
+	}
+	if ts.Mode != t.mode {
+		return
+	}
+	if ts.LastDiff != nil {
+		t.state.LastDiff = *ts.LastDiff
+	}
+	t.state.Sum = ts.Sum
+	if ts.Period != nil {
+		t.state.Period = *ts.Period
+	}
+	if ts.Min != nil && ts.Max != nil {
+		t.state.Min, t.state.Max = *ts.Min, *ts.Max
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// redisStateKey is the hash that maps device ids to their JSON state
+	redisStateKey = "math-diff-service:state"
+	// redisTimeout bounds connecting to Redis and each command, so an
+	// unreachable server cannot stall ProcessLink or a save
+	redisTimeout = 5 * time.Second
+)
+
+// redisBackend keeps the state of each device as a field of a Redis hash.
+// Like the state file, it is written by the periodic saves of the state
+// store, so ProcessMessage never waits on the network.
+type redisBackend struct {
+	uri  string
+	pool *redis.Pool
+}
+
+// newRedisBackend creates a backend connecting to the Redis server at uri,
+// such as redis://:password@localhost:6379/0
+func newRedisBackend(uri string) *redisBackend {
+	return &redisBackend{
+		uri: uri,
+		pool: &redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(uri,
+					redis.DialConnectTimeout(redisTimeout),
+					redis.DialReadTimeout(redisTimeout),
+					redis.DialWriteTimeout(redisTimeout))
+			},
+		},
+	}
+}
+
+func (r *redisBackend) String() string {
+	return "redis " + redisStateKey
+}
+
+// load reads the state of every device from the hash
+func (r *redisBackend) load() (map[string]deviceState, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", redisStateKey))
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]deviceState, len(fields))
+	for id, data := range fields {
+		var state deviceState
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			// A single corrupt entry should not discard the others
+			continue
+		}
+		states[id] = state
+	}
+	return states, nil
+}
+
+// loadDevice reads the state of the device with id from its field, or nil
+// if it has none
+func (r *redisBackend) loadDevice(id string) (deviceState, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", redisStateKey, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state deviceState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes each device's state to its field and deletes removed devices
+func (r *redisBackend) save(states map[string]deviceState, removed []string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if len(states) > 0 {
+		args := redis.Args{}.Add(redisStateKey)
+		for id, state := range states {
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			args = args.Add(id, data)
+		}
+		if _, err := conn.Do("HSET", args...); err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		if _, err := conn.Do("HDEL", redis.Args{}.Add(redisStateKey).AddFlat(removed)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// memoryBackend is a stateBackend holding the state in a map. The state of
+// single devices is loaded from devices, which load never returns.
+type memoryBackend struct {
+	states  map[string]deviceState
+	devices map[string]deviceState
+	// err is returned by loadDevice, if set
+	err error
+}
+
+func (m *memoryBackend) String() string {
+	return "memory"
+}
+
+func (m *memoryBackend) load() (map[string]deviceState, error) {
+	return m.states, nil
+}
+
+// save stores states and then deletes removed, in the order the Redis
+// backend does
+func (m *memoryBackend) save(states map[string]deviceState, removed []string) error {
+	if m.states == nil {
+		m.states = make(map[string]deviceState)
+	}
+	for id, state := range states {
+		m.states[id] = state
+	}
+	for _, id := range removed {
+		delete(m.states, id)
+	}
+	return nil
+}
+
+func (m *memoryBackend) loadDevice(id string) (deviceState, error) {
+	return m.devices[id], m.err
+}
+
+func TestLinkLoadsDeviceState(t *testing.T) {
+	last := 10.0
+	tests := []struct {
+		name    string
+		backend *memoryBackend
+		want    []published
+	}{
+		{
+			name:    "state loaded at startup",
+			backend: &memoryBackend{states: map[string]deviceState{"device": {"a": {Mode: modeDiff, LastValue: &last}}}},
+			want:    []published{{"a_diff", "2"}},
+		},
+		{
+			name:    "state loaded on link",
+			backend: &memoryBackend{devices: map[string]deviceState{"device": {"a": {Mode: modeDiff, LastValue: &last}}}},
+			want:    []published{{"a_diff", "2"}},
+		},
+		{
+			name: "state loaded on link replaces the state loaded at startup",
+			backend: &memoryBackend{
+				states:  map[string]deviceState{"device": {"a": {Mode: modeDiff}}},
+				devices: map[string]deviceState{"device": {"a": {Mode: modeDiff, LastValue: &last}}},
+			},
+			want: []published{{"a_diff", "2"}},
+		},
+		{
+			name: "failing to load on link keeps the state loaded at startup",
+			backend: &memoryBackend{
+				states: map[string]deviceState{"device": {"a": {Mode: modeDiff, LastValue: &last}}},
+				err:    errors.New("connection refused"),
+			},
+			want: []published{{"a_diff", "2"}},
+		},
+		{
+			name:    "no state",
+			backend: &memoryBackend{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.store = newStateStore(test.backend)
+			d := newDeviceFactory(opts)().(*Device)
+			ctrl := newFakeControl(map[string]string{configKeyInputTopics: "a"})
+			if status := d.processLink(ctrl); status != "Success" {
+				t.Fatalf("link failed: %s", status)
+			}
+			defer d.processUnlink(ctrl)
+			ctrl.deliver(t, d, "a", "12")
+			if got := ctrl.take(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got publishes %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSaveKeepsRelinkedDevice(t *testing.T) {
+	backend := &memoryBackend{}
+	opts := testOptions()
+	opts.store = newStateStore(backend)
+	d := newDeviceFactory(opts)().(*Device)
+	ctrl := newFakeControl(map[string]string{configKeyInputTopics: "a"})
+	if status := d.processLink(ctrl); status != "Success" {
+		t.Fatalf("link failed: %s", status)
+	}
+	d.processUnlink(ctrl)
+	if status := d.processLink(ctrl); status != "Success" {
+		t.Fatalf("relink failed: %s", status)
+	}
+	defer d.processUnlink(ctrl)
+	ctrl.deliver(t, d, "a", "10")
+
+	if err := opts.store.save(); err != nil {
+		t.Fatal(err)
+	}
+	state, ok := backend.states["device"]
+	if !ok {
+		t.Fatal("the state of the relinked device was removed")
+	}
+	if last := state["a"].LastValue; last == nil || *last != 10 {
+		t.Errorf("got last value %v, want 10", last)
+	}
+}
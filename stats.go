@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// statsTopic is the device topic the statistics are published to
+	statsTopic           = "diff_stats"
+	defaultStatsInterval = time.Minute
+)
+
+// deviceStats is the payload published to statsTopic
+type deviceStats struct {
+	// Messages is the number of messages received on the input topics
+	Messages uint64 `json:"messages"`
+	// ParseErrors is the number of messages that could not be parsed
+	ParseErrors uint64 `json:"parseerrors"`
+	// Panics is the number of panics recovered from while processing
+	Panics uint64 `json:"panics"`
+	// Evictions is the number of times the device state was evicted for
+	// being idle
+	Evictions uint64 `json:"evictions"`
+	// Ignored is the number of inputs dropped for matching IgnoreValues
+	Ignored uint64 `json:"ignored"`
+	// Rejected is the number of inputs dropped for being outside the valid
+	// range
+	Rejected uint64 `json:"rejected"`
+	// WrongLength is the number of binary payloads dropped for having the
+	// wrong length
+	WrongLength uint64 `json:"wronglength"`
+	// PathMisses is the number of JSON payloads dropped for holding no
+	// number at the path of their topic
+	PathMisses uint64 `json:"pathmisses"`
+	// PublishFailures is the number of outputs dropped because publishing
+	// them failed
+	PublishFailures uint64 `json:"publishfailures"`
+	// MaxTopics is the most input topics the device may have, or 0 if
+	// unlimited
+	MaxTopics int `json:"maxtopics"`
+	// Topics maps the input topics to their statistics
+	Topics map[string]topicStats `json:"topics"`
+}
+
+// topicStats are the statistics of a single input topic
+type topicStats struct {
+	// LastInput and LastValue are omitted until the topic receives a message
+	LastInput string      `json:"lastinput,omitempty"`
+	LastValue json.Number `json:"lastvalue,omitempty"`
+}
+
+// startStats starts a ticker that publishes the device statistics every
+// StatsInterval, if PublishStats is set
+func (d *Device) startStats(ctrl deviceControl) {
+	if !d.publishstats || d.paused {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopstats = stop
+
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mu.Lock()
+				// The ticker may have been stopped while waiting on the lock
+				select {
+				case <-stop:
+				default:
+					d.processStats(ctrl)
+				}
+				d.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}(d.statsinterval)
+}
+
+// stopStats stops the ticker started by startStats
+func (d *Device) stopStats() {
+	if d.stopstats != nil {
+		close(d.stopstats)
+		d.stopstats = nil
+	}
+}
+
+// processStats publishes the device statistics to statsTopic.
+// The device lock must be held.
+func (d *Device) processStats(ctrl deviceControl) {
+	d.pubmu.Lock()
+	publishfailures := d.publishfailures
+	d.pubmu.Unlock()
+	stats := deviceStats{
+		Messages:        d.processed,
+		ParseErrors:     d.dropped,
+		Panics:          d.panics,
+		Evictions:       d.evictions,
+		Ignored:         d.ignored,
+		Rejected:        d.rejected,
+		WrongLength:     d.wronglength,
+		PathMisses:      d.pathmisses,
+		PublishFailures: publishfailures,
+		MaxTopics:       d.maxtopics,
+		Topics:          make(map[string]topicStats),
+	}
+	d.eachTopic(func(index int, t *topic) {
+		var ts topicStats
+		if !t.lastinput.IsZero() {
+			ts.LastInput = t.lastinput.UTC().Format(time.RFC3339)
+		}
+		if !isNonFinite(t.state.Last) {
+			ts.LastValue = json.Number(d.format(t.state.Last))
+		}
+		stats.Topics[t.name()] = ts
+	})
+
+	logitem := log.WithField("deviceid", ctrl.Id())
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		logitem.Errorf("Failed to encode stats: %v", err)
+		return
+	}
+	d.publish(ctrl, logitem, statsTopic, string(payload))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStatusPulseInterval is the least time between running pulses
+	defaultStatusPulseInterval = time.Minute
+	// statusPulseMessage is the service status a pulse publishes
+	statusPulseMessage = "Running"
+)
+
+// statusPulse refreshes the service status as devices process messages, at
+// most once per interval however many messages arrive. It is safe for
+// concurrent use.
+type statusPulse struct {
+	mu sync.Mutex
+	// client receives the status, or is nil while the pulse is stopped
+	client   serviceClient
+	interval time.Duration
+	// last is when the status was last published
+	last time.Time
+}
+
+// start publishes the status to client at most once per interval from now
+// on
+func (p *statusPulse) start(client serviceClient, interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client = client
+	p.interval = interval
+	p.last = time.Time{}
+}
+
+// stop stops publishing the status
+func (p *statusPulse) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client = nil
+}
+
+// beat publishes the status if the pulse is started and the interval has
+// passed since the last time it did. The status is published without
+// holding the lock, so concurrent beats are not held up by it.
+func (p *statusPulse) beat(now time.Time) {
+	p.mu.Lock()
+	client := p.client
+	if client == nil || (!p.last.IsZero() && now.Sub(p.last) < p.interval) {
+		p.mu.Unlock()
+		return
+	}
+	p.last = now
+	p.mu.Unlock()
+
+	if err := client.SetStatus(statusPulseMessage); err != nil {
+		log.Warn("Failed to publish service status: ", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// validateCommand is the validate subcommand, which checks a link config
+// the way linking a device does and prints what the device would do
+var validateCommand = cli.Command{
+	Name:      "validate",
+	Usage:     "Check a link config and print the topics it subscribes and publishes to, or the error linking it would report",
+	ArgsUsage: "[Key=Value...]",
+	Description: "The config is given by the flags and by Key=Value arguments for any other\n" +
+		"   config key, such as Window=5, which override a JSON object read from stdin\n" +
+		"   with --stdin. The service's own flags and config file supply the defaults.",
+	Action: validate,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "input-topics",
+			Usage: "InputTopics of the link",
+		},
+		cli.StringFlag{
+			Name:  "output-topics",
+			Usage: "OutputTopics of the link",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "Mode of the link",
+		},
+		cli.BoolFlag{
+			Name:  "stdin",
+			Usage: "Read the config as a JSON object of strings from stdin, as in the devices file",
+		},
+	},
+}
+
+// validate implements the validate subcommand
+func validate(ctx *cli.Context) error {
+	global := ctx.Parent()
+	if _, err := loadConfigFile(global); err != nil {
+		log.Error("Failed to load config file: ", err)
+		return cli.NewExitError(nil, 1)
+	}
+
+	config, err := validateConfig(ctx, os.Stdin)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(nil, 1)
+	}
+
+	opts := &serviceOptions{
+		defaultSuffix: strings.TrimSpace(global.String("default-suffix")),
+		precision:     global.Int("default-precision"),
+		qos:           byte(global.Int("default-qos")),
+		retain:        global.Bool("default-retain"),
+		maxTopics:     global.Int("max-topics-per-device"),
+	}
+	var l link
+	status := l.configure(log.WithField("deviceid", "validate"), config, opts)
+	if len(status) > 0 {
+		fmt.Println(status)
+		return cli.NewExitError(nil, 1)
+	}
+	printPlan(os.Stdout, &l, config)
+	return nil
+}
+
+// validateConfig builds the link config from stdin, if --stdin is set,
+// followed by the flags and Key=Value arguments
+func validateConfig(ctx *cli.Context, stdin io.Reader) (map[string]string, error) {
+	config := make(map[string]string)
+	if ctx.Bool("stdin") {
+		if err := json.NewDecoder(stdin).Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to read the config from stdin: %v", err)
+		}
+	}
+	for flag, key := range map[string]string{
+		"input-topics":  configKeyInputTopics,
+		"output-topics": configKeyOutputTopics,
+		"mode":          configKeyMode,
+	} {
+		if ctx.IsSet(flag) {
+			config[key] = ctx.String(flag)
+		}
+	}
+	for _, arg := range ctx.Args() {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("argument %q is not of the form Key=Value", arg)
+		}
+		config[arg[:i]] = arg[i+1:]
+	}
+	return config, nil
+}
+
+// printPlan writes the link status of the configured link l, the topics it
+// subscribes to, and where each input topic is published to. Keys of config
+// that linking ignores are reported, since they are often typos.
+func printPlan(w io.Writer, l *link, config map[string]string) {
+	known := make(map[string]bool, len(configParams))
+	for _, param := range configParams {
+		known[param.Name] = true
+	}
+	var unknown []string
+	for key := range config {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	fmt.Fprintln(w, "Link status:", l.linkStatus())
+	for _, key := range unknown {
+		fmt.Fprintf(w, "Ignored unknown key: %s\n", key)
+	}
+	fmt.Fprintln(w, "Subscriptions:")
+	for _, topic := range l.subscriptions() {
+		fmt.Fprintf(w, "  %s\n", topic)
+	}
+	fmt.Fprintln(w, "Topics:")
+	for _, t := range l.topics {
+		mode := t.mode
+		if t.arraydiff {
+			mode += ", array"
+		}
+		if t.extract != nil {
+			mode += ", extract " + t.extract.String()
+		}
+		if t.cbor {
+			mode += ", " + payloadFormatCBOR
+		}
+		outtopic := t.outtopic
+		if t.wildcard {
+			outtopic = l.outputprefix + "<matched topic>" + l.outputsuffix
+		}
+		if t.allfields {
+			outtopic = l.outputprefix + t.intopic + fieldSeparator + "<field>" + l.outputsuffix
+		}
+		fmt.Fprintf(w, "  %s -> %s (%s)\n", t.intopic, outtopic, mode)
+	}
+	if l.pair != nil {
+		fmt.Fprintf(w, "  %s - %s -> %s (pair)\n", l.pair.intopics[0], l.pair.intopics[1], l.pair.outtopic)
+	}
+	if len(l.combined) > 0 {
+		fmt.Fprintln(w, "Combined output:", l.combined)
+	}
+}
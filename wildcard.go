@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/openchirp/math-diff-service/internal/processor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// wildcardLevel matches any single level of a topic
+	wildcardLevel = "+"
+)
+
+// isWildcard reports whether the input topic contains an MQTT wildcard
+func isWildcard(intopic string) bool {
+	return strings.ContainsAny(intopic, "+#")
+}
+
+// matchTopic matches the trailing levels of topic against the wildcard
+// pattern and returns the matched levels. Messages may carry the full topic
+// the framework subscribed to, so only the levels the pattern spans are
+// compared.
+func matchTopic(pattern, topic string) (string, bool) {
+	plevels := strings.Split(pattern, "/")
+	tlevels := strings.Split(topic, "/")
+	if len(tlevels) < len(plevels) {
+		return "", false
+	}
+	tlevels = tlevels[len(tlevels)-len(plevels):]
+	for i, level := range plevels {
+		if level != wildcardLevel && level != tlevels[i] {
+			return "", false
+		}
+	}
+	return strings.Join(tlevels, "/"), true
+}
+
+// match returns the topic state of the concrete topic matched by the
+// wildcard topic tmpl, creating it on first use with the configuration
+// of tmpl. Topics that are outputs of the wildcard itself are ignored, so
+// an output matching the pattern cannot feed back into the device.
+func (l *link) match(tmpl *topic, concrete string) *topic {
+	if t, ok := tmpl.matches[concrete]; ok {
+		return t
+	}
+	if l.isOutput(tmpl, concrete) {
+		return nil
+	}
+	if l.maxtopics > 0 && l.topicCount() >= l.maxtopics {
+		if !tmpl.limitwarned {
+			tmpl.limitwarned = true
+			tmpl.logitem.Warnf("Ignoring topic %s and any further matches beyond the limit of %d topics", concrete, l.maxtopics)
+		}
+		return nil
+	}
+
+	t := l.instantiate(tmpl, concrete, l.outputprefix+concrete+l.outputsuffix, log.Fields{"topic": concrete})
+	tmpl.matches[concrete] = t
+	return t
+}
+
+// rematch returns the topic of the key of matches of the template tmpl,
+// which is a concrete topic for wildcards and a field for JsonAllFields
+func (l *link) rematch(tmpl *topic, key string) *topic {
+	if tmpl.allfields {
+		return l.field(tmpl, key)
+	}
+	return l.match(tmpl, key)
+}
+
+// instantiate returns a new topic configured like the template tmpl, which
+// publishes to outtopic, for the match of tmpl logged with fields
+func (l *link) instantiate(tmpl *topic, intopic, outtopic string, fields log.Fields) *topic {
+	t := new(topic)
+	*t = *tmpl
+	t.intopic = intopic
+	t.outtopic = outtopic
+	t.matches = nil
+	t.limitwarned = false
+	t.staletimer = nil
+	t.seeding = false
+	fields["outtopic"] = outtopic
+	t.logitem = tmpl.logitem.WithFields(fields)
+	t.state = processor.NewState(l.window)
+	if tmpl.median != nil {
+		t.median = processor.NewRing(tmpl.median.Size())
+	}
+	t.proc = l.newProcessor(t)
+	t.reset()
+
+	if tmpl.matches == nil {
+		tmpl.matches = make(map[string]*topic)
+	}
+	return t
+}
+
+// isOutput reports whether concrete is the output topic of another topic
+// matched by the wildcard topic tmpl
+func (l *link) isOutput(tmpl *topic, concrete string) bool {
+	if !strings.HasPrefix(concrete, l.outputprefix) || !strings.HasSuffix(concrete, l.outputsuffix) {
+		return false
+	}
+	input := strings.TrimSuffix(strings.TrimPrefix(concrete, l.outputprefix), l.outputsuffix)
+	matched, ok := matchTopic(tmpl.intopic, input)
+	return ok && matched == input
+}
+
+// eachTopic calls fn with every input topic of the device, including the
+// topics matched by wildcards and the fields of JsonAllFields topics, along
+// with the index of their config entry
+func (l *link) eachTopic(fn func(index int, t *topic)) {
+	for i := range l.topics {
+		t := &l.topics[i]
+		if !t.template() {
+			fn(i, t)
+			continue
+		}
+		for _, m := range t.matches {
+			fn(i, m)
+		}
+	}
+}
+
+// template reports whether t holds no state of its own, but is the
+// template of the topics in its matches
+func (t *topic) template() bool {
+	return t.wildcard || t.allfields
+}
+
+// topicCount returns the number of input topics of the device, counting
+// the topics matched by wildcards and the fields of JsonAllFields topics
+// rather than the topics themselves
+func (l *link) topicCount() int {
+	count := 0
+	l.eachTopic(func(index int, t *topic) {
+		count++
+	})
+	return count
+}